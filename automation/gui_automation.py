@@ -6,12 +6,21 @@ fuzzy image matching (confidence-based) for improved reliability.
 Compatible with Ubuntu 20.04 LTS (aarch64) and XFCE desktop environment.
 """
 
+import glob
 import logging
 import os
+import queue
+import re
+import shlex
 import shutil
 import subprocess
+import threading
 import time
-from typing import Callable, List, Optional, Tuple
+import uuid
+from concurrent.futures import Future
+from dataclasses import dataclass
+from enum import Enum
+from typing import Callable, Dict, List, Optional, Tuple, Union
 
 import pyperclip
 from PIL import Image
@@ -96,16 +105,169 @@ logging.basicConfig(
 )
 logger = logging.getLogger(__name__)
 
+
+class CommandRunner:
+    """
+    外部命令（xdotool、xclip / wl-copy、截屏、tesseract）的统一调用入口。
+
+    本模块所有 subprocess 调用都经过当前 runner，测试或诊断时可用
+    set_command_runner() 换成记录调用序列的替身，而不必真的操作 X 桌面。
+    参数与 subprocess.run / subprocess.Popen 相同。
+    """
+
+    def run(self, args, **kwargs) -> subprocess.CompletedProcess:
+        return subprocess.run(args, **kwargs)
+
+    def popen(self, args, **kwargs) -> subprocess.Popen:
+        return subprocess.Popen(args, **kwargs)
+
+
+_runner = CommandRunner()
+
+
+def set_command_runner(runner: CommandRunner) -> CommandRunner:
+    """替换外部命令的执行者，返回原来的 runner，便于调用方恢复。"""
+    global _runner
+    previous, _runner = _runner, runner
+    return previous
+
+
+def _env_int(name: str, default: int) -> int:
+    """读取整数环境变量，未设置或格式错误时返回默认值。
+
+    在调用时读取而不是在导入时读取，因为 .env 由 main.py 在导入本模块之后加载。
+    """
+    raw = os.getenv(name, "").strip()
+    if not raw:
+        return default
+    try:
+        return int(raw)
+    except ValueError:
+        logger.warning(f"环境变量 {name}={raw!r} 不是整数，使用默认值 {default}")
+        return default
+
+
+def _env_float(name: str, default: float) -> float:
+    """读取浮点数环境变量，未设置或格式错误时返回默认值。"""
+    raw = os.getenv(name, "").strip()
+    if not raw:
+        return default
+    try:
+        return float(raw)
+    except ValueError:
+        logger.warning(f"环境变量 {name}={raw!r} 不是数字，使用默认值 {default}")
+        return default
+
+
+def _env_flag(name: str, default: bool = False) -> bool:
+    """读取布尔环境变量（1/true/yes/on 为真）。"""
+    raw = os.getenv(name, "").strip().lower()
+    if not raw:
+        return default
+    return raw in ("1", "true", "yes", "on")
+
+
+def _match_grayscale() -> bool:
+    """
+    MATCH_MODE=luma 时按亮度（灰度）匹配模板，忽略 IDE 主题色调和抗锯齿带来的颜色差异；
+    默认 rgb 按彩色匹配。灰度下不同颜色的区域更难区分，必要时配合调高置信度。
+    """
+    return os.getenv("MATCH_MODE", "rgb").strip().lower() == "luma"
+
+
+def _env_region(name: str) -> Optional[Tuple[int, int, int, int]]:
+    """读取屏幕区域环境变量，格式为 "x,y,width,height"；未设置或格式错误时返回 None。"""
+    raw = os.getenv(name, "").strip()
+    if not raw:
+        return None
+    try:
+        x, y, w, h = (int(part) for part in raw.split(","))
+    except ValueError:
+        logger.warning(f"环境变量 {name}={raw!r} 格式应为 x,y,width,height，忽略")
+        return None
+    if w <= 0 or h <= 0:
+        logger.warning(f"环境变量 {name}={raw!r} 宽高必须为正数，忽略")
+        return None
+    return (x, y, w, h)
+
+
+# 上一次解析的 CAPTURE_GEOMETRY: (原始字符串, 区域)，避免每次匹配都重复解析和告警
+_capture_geometry_cache: Tuple[Optional[str], Optional[Tuple[int, int, int, int]]] = (None, None)
+
+
+def parse_geometry(spec: str) -> Optional[Tuple[int, int, int, int]]:
+    """解析 X11 风格的几何字符串 "WxH+X+Y"（如 1920x1080+1920+0），返回 (x, y, width, height)。"""
+    match = re.fullmatch(r'\s*(\d+)x(\d+)\+(\d+)\+(\d+)\s*', spec or '')
+    if not match:
+        return None
+    w, h, x, y = (int(g) for g in match.groups())
+    if w <= 0 or h <= 0:
+        return None
+    return (x, y, w, h)
+
+
+def _capture_region() -> Optional[Tuple[int, int, int, int]]:
+    """
+    CAPTURE_GEOMETRY（如 1920x1080+0+0）指定的模板搜索区域，多显示器时只在 IDE 所在屏幕上匹配，
+    更快且不会匹配到另一块屏幕上相似的元素。匹配返回的坐标仍是整个桌面的绝对坐标。
+
+    未设置、格式错误或超出屏幕范围时返回 None（全屏搜索），错误只告警一次。
+    """
+    global _capture_geometry_cache
+    raw = os.getenv("CAPTURE_GEOMETRY", "").strip()
+    if not raw:
+        return None
+    if _capture_geometry_cache[0] == raw:
+        return _capture_geometry_cache[1]
+    region = parse_geometry(raw)
+    if region is None:
+        logger.warning(f"CAPTURE_GEOMETRY={raw!r} 格式应为 WxH+X+Y（如 1920x1080+0+0），忽略")
+    else:
+        _ensure_pyautogui()
+        screen_w, screen_h = pyautogui.size()
+        x, y, w, h = region
+        if x + w > screen_w or y + h > screen_h:
+            logger.warning(f"CAPTURE_GEOMETRY={raw!r} 超出桌面范围 {screen_w}x{screen_h}，忽略")
+            region = None
+        else:
+            logger.info(f"模板搜索限定在 CAPTURE_GEOMETRY 区域 {region}")
+    _capture_geometry_cache = (raw, region)
+    return region
+
+
+def capture_origin() -> Tuple[int, int]:
+    """take_screenshot 默认截图（CAPTURE_GEOMETRY 区域）左上角的桌面坐标，整个桌面时为 (0, 0)。"""
+    region = _capture_region()
+    return region[:2] if region else (0, 0)
+
+
 # Persistent templates directory for PyInstaller binary mode
 _PERSISTENT_TEMPLATES_DIR = None
 _PERSISTENT_DIR_PATH = "/tmp/antigravity_templates"
 
 
-def backup_templates(templates_dir: str) -> bool:
+def _overlay_templates(override_dir: str, target_dir: str) -> int:
+    """把 override_dir 中的模板（png 及同名 json 配置，含子目录）覆盖复制到 target_dir，返回复制的文件数。"""
+    copied = 0
+    for root, _dirs, files in os.walk(override_dir):
+        rel = os.path.relpath(root, override_dir)
+        for name in files:
+            if not name.lower().endswith((".png", ".json")):
+                continue
+            dest_dir = os.path.normpath(os.path.join(target_dir, rel))
+            os.makedirs(dest_dir, exist_ok=True)
+            shutil.copy2(os.path.join(root, name), os.path.join(dest_dir, name))
+            copied += 1
+    return copied
+
+
+def backup_templates(templates_dir: str, override_dir: Optional[str] = None) -> bool:
     """将模板文件备份到持久化目录。在 main.py 启动时调用（仅 PyInstaller 模式）。
     
     Args:
         templates_dir: 原始模板目录路径（通常是 sys._MEIPASS/templates）
+        override_dir: 用户模板目录（通常是二进制所在目录下的 templates），
+                      其中的同名文件覆盖内置模板，缺少的文件仍使用内置版本
     
     Returns:
         True if backup succeeded
@@ -117,6 +279,9 @@ def backup_templates(templates_dir: str) -> bool:
         shutil.copytree(templates_dir, _PERSISTENT_DIR_PATH)
         _PERSISTENT_TEMPLATES_DIR = _PERSISTENT_DIR_PATH
         logger.info(f"模板已备份到持久化目录: {_PERSISTENT_DIR_PATH}")
+        if override_dir and os.path.isdir(override_dir):
+            copied = _overlay_templates(override_dir, _PERSISTENT_DIR_PATH)
+            logger.info(f"已用 {override_dir} 中的 {copied} 个文件覆盖内置模板")
         return True
     except Exception as e:
         logger.error(f"模板备份失败: {e}")
@@ -170,15 +335,86 @@ def _ensure_templates(templates_dir: str) -> str:
     return templates_dir
 
 
+# 每个 chat 自定义模板的持久化根目录：<root>/<chat_id>/
+CHAT_TEMPLATES_ROOT = os.path.join(os.path.expanduser("~"), ".antigravity-bridge", "templates")
+
+
+def get_chat_templates_dir(chat_id: int) -> Optional[str]:
+    """返回该 chat 的自定义模板目录；未设置过自定义模板时返回 None。"""
+    chat_dir = os.path.join(CHAT_TEMPLATES_ROOT, str(chat_id))
+    if os.path.exists(os.path.join(chat_dir, "input_box.png")):
+        return chat_dir
+    return None
+
+
+def save_chat_template(
+    templates_dir: str,
+    chat_id: int,
+    name: str,
+    image_path: str
+) -> Tuple[bool, str]:
+    """将上传的图片保存为该 chat 的模板覆盖。
+
+    首次设置时会先把当前默认模板整套复制到 chat 目录，
+    之后该 chat 的工作流直接使用这个目录，未覆盖的模板保持默认。
+
+    Args:
+        templates_dir: 默认模板目录
+        chat_id: Telegram chat ID
+        name: 模板名（如 input_box 或 input_box.png）
+        image_path: 上传图片的本地路径
+
+    Returns:
+        tuple: (success: bool, message: str)
+    """
+    name = name.strip()
+    if name.lower().endswith(".png"):
+        name = name[:-4]
+    if not name or not all(c.isalnum() or c in "._-" for c in name) or name.startswith("."):
+        return False, f"模板名无效: {name!r}"
+
+    try:
+        with Image.open(image_path) as img:
+            img.load()
+            width, height = img.size
+            template = img.convert("RGBA") if "A" in img.getbands() else img.convert("RGB")
+    except Exception as e:
+        return False, f"图片无法解码: {e}"
+
+    chat_dir = os.path.join(CHAT_TEMPLATES_ROOT, str(chat_id))
+    try:
+        if not os.path.isdir(chat_dir):
+            shutil.copytree(_ensure_templates(templates_dir), chat_dir)
+            logger.info(f"已为 chat {chat_id} 创建模板目录: {chat_dir}")
+        target_path = os.path.join(chat_dir, f"{name}.png")
+        template.save(target_path, format="PNG")
+    except Exception as e:
+        logger.error(f"save_chat_template 错误: {e}")
+        return False, f"保存失败: {e}"
+
+    logger.info(f"chat {chat_id} 模板已更新: {target_path} ({width}x{height})")
+    return True, f"{name}.png ({width}x{height})"
+
+
 # Default confidence levels to try (from high to low)
 DEFAULT_CONFIDENCE_LEVELS = [0.8, 0.7, 0.6, 0.5, 0.4, 0.3]
 
 
+def _temp_image_path(prefix: str, workflow_id: Optional[str] = None) -> str:
+    """
+    临时截图路径。传入 workflow_id 时按工作流区分，否则使用随机后缀。
+
+    不用进程/线程号：线程结束后线程号会被复用，并发工作流之间仍可能互相覆盖。
+    """
+    return f"/tmp/{prefix}_{workflow_id or uuid.uuid4().hex[:8]}.png"
+
+
 def smart_find_image(
     image_path: str,
     confidence_levels: list = None,
     region: tuple = None,
-    save_screenshot: bool = False
+    save_screenshot: bool = False,
+    workflow_id: Optional[str] = None
 ) -> dict:
     """
     智能查找图像模板 - 公共工具函数
@@ -191,6 +427,7 @@ def smart_find_image(
         confidence_levels: 要尝试的 confidence 级别列表，默认 [0.8, 0.7, 0.6, 0.5, 0.4, 0.3]
         region: 可选的搜索区域 (x, y, width, height)
         save_screenshot: 是否保存当前屏幕截图用于调试
+        workflow_id: 所属工作流 ID，用于区分并发工作流的调试截图文件名
     
     Returns:
         dict: {
@@ -209,6 +446,8 @@ def smart_find_image(
             print(f"未找到. 调试信息: {result['debug_info']}")
     """
     _ensure_pyautogui()
+    if region is None:
+        region = _capture_region()
     if confidence_levels is None:
         confidence_levels = DEFAULT_CONFIDENCE_LEVELS.copy()
     
@@ -247,8 +486,9 @@ def smart_find_image(
     # 保存截图用于调试
     if save_screenshot:
         try:
-            screenshot_path = "/tmp/smart_find_screenshot.png"
-            screenshot = pyautogui.screenshot()
+            # 按工作流区分，避免并发工作流互相覆盖调试截图
+            screenshot_path = _temp_image_path("smart_find_screenshot", workflow_id)
+            screenshot = _grab_screen()
             screenshot.save(screenshot_path)
             result['screenshot_path'] = screenshot_path
             debug_parts.append(f"截图已保存: {screenshot_path}")
@@ -259,22 +499,16 @@ def smart_find_image(
     tried_levels = []
     for conf in confidence_levels:
         try:
-            location = pyautogui.locateCenterOnScreen(
-                image_path,
-                confidence=conf,
-                region=region
-            )
+            location = locate_center_on_screen(image_path, conf, region)
             if location:
                 result['found'] = True
-                result['location'] = (location.x, location.y)
+                result['location'] = location
                 result['confidence'] = conf
-                debug_parts.append(f"成功! confidence={conf}, 位置=({location.x}, {location.y})")
-                logger.info(f"smart_find_image: 找到 {image_path} @ ({location.x}, {location.y}), confidence={conf}")
+                debug_parts.append(f"成功! confidence={conf}, 位置=({location[0]}, {location[1]})")
+                logger.info(f"smart_find_image: 找到 {image_path} @ {location}, confidence={conf}")
                 break
             else:
                 tried_levels.append(f"{conf}:未找到")
-        except pyautogui.ImageNotFoundException:
-            tried_levels.append(f"{conf}:未找到")
         except Exception as e:
             tried_levels.append(f"{conf}:错误({e})")
     
@@ -286,6 +520,249 @@ def smart_find_image(
     return result
 
 
+def capture_predelay():
+    """截屏/匹配前等待 CAPTURE_PREDELAY_MS 毫秒（默认 0），让点击或切换窗口后的画面稳定下来。"""
+    delay_ms = _env_int("CAPTURE_PREDELAY_MS", 0)
+    if delay_ms > 0:
+        time.sleep(delay_ms / 1000.0)
+
+
+def take_screenshot(path: str, region: Optional[Tuple[int, int, int, int]] = None) -> Tuple[bool, str]:
+    """
+    截取屏幕并保存到 path（截屏命令见 _screenshot_command）。
+
+    region (x, y, width, height) 未指定时使用 CAPTURE_GEOMETRY（未设置时为整个桌面）。
+    截图只包含该区域，图中坐标需加上区域左上角才是桌面绝对坐标。
+
+    CHECK_SCREENSHOT_FRESH=1 时额外检查文件修改时间是否在 1 秒内，
+    否则视为拿到了旧帧并重试（最多 3 次）。
+
+    Returns:
+        tuple: (success: bool, error: str)
+    """
+    capture_predelay()
+    if region is None:
+        region = _capture_region()
+    attempts = 3 if _env_flag("CHECK_SCREENSHOT_FRESH") else 1
+    for attempt in range(attempts):
+        ok, error = _capture_screen(path, region)
+        if not ok or attempts == 1:
+            return ok, error
+        try:
+            age = time.time() - os.path.getmtime(path)
+        except OSError as e:
+            return False, f"截图文件不存在: {e}"
+        if age <= 1.0:
+            return True, ""
+        logger.warning(f"take_screenshot: 截图修改时间已是 {age:.1f} 秒前，疑似旧帧，重试 ({attempt + 1}/{attempts})")
+        time.sleep(0.2)
+    return False, "截图疑似旧帧（修改时间不是最新）"
+
+
+def _screenshot_command(path: str, region: Optional[Tuple[int, int, int, int]] = None) -> List[str]:
+    """
+    截屏命令：SCREENSHOT_CMD 优先，否则 Wayland 下用 grim、X11 下用 scrot。
+
+    SCREENSHOT_CMD 中的 {file} 替换为输出路径，没有 {file} 时把路径追加为最后一个参数，
+    如 SCREENSHOT_CMD="gnome-screenshot -f {file}"。
+    指定 region 时 grim / scrot 只截取该区域（grim -g "x,y wxh" / scrot -a x,y,w,h）；
+    SCREENSHOT_CMD 不传区域，由 _capture_screen 截图后裁剪。
+    """
+    custom = shlex.split(os.getenv('SCREENSHOT_CMD', ''))
+    if custom:
+        if any('{file}' in arg for arg in custom):
+            return [arg.replace('{file}', path) for arg in custom]
+        return custom + [path]
+    if region is None:
+        return ['grim', path] if _is_wayland() else ['scrot', path]
+    x, y, w, h = region
+    if _is_wayland():
+        return ['grim', '-g', f"{x},{y} {w}x{h}", path]
+    return ['scrot', '-a', f"{x},{y},{w},{h}", path]
+
+
+def _capture_screen(path: str, region: Optional[Tuple[int, int, int, int]] = None) -> Tuple[bool, str]:
+    """运行一次截屏命令，截图只包含 region（None 为整个桌面）。"""
+    command = _screenshot_command(path, region)
+    try:
+        # 新版 scrot 遇到同名文件会另存为 *_000.png，先删除旧文件
+        if os.path.exists(path):
+            os.remove(path)
+        result = _runner.run(
+            command,
+            capture_output=True,
+            timeout=10
+        )
+    except Exception as e:
+        logger.error(f"take_screenshot 错误: {e}")
+        return False, str(e)
+
+    if result.returncode != 0:
+        stderr = result.stderr.decode(errors='ignore').strip() if result.stderr else ''
+        logger.error(f"take_screenshot: {command[0]} 失败 (exit={result.returncode}) {stderr}")
+        return False, stderr or f"{command[0]} exit={result.returncode}"
+    if region is not None and os.getenv('SCREENSHOT_CMD', '').strip():
+        x, y, w, h = region
+        try:
+            with Image.open(path) as img:
+                cropped = img.crop((x, y, x + w, y + h))
+            cropped.save(path)
+        except Exception as e:
+            logger.error(f"take_screenshot: 裁剪到区域 {region} 失败: {e}")
+            return False, str(e)
+    return True, ""
+
+
+def _grab_screen(region: Optional[Tuple[int, int, int, int]] = None):
+    """
+    截取屏幕区域（None 为整个桌面），返回 PIL 图像；截屏失败时抛出异常。
+
+    pyautogui 的截屏只支持 X11，Wayland 下改用 _capture_screen（grim / SCREENSHOT_CMD）
+    截到临时文件再读入，模板匹配、颜色检查、OCR 等都通过这里取图。
+    """
+    if not _is_wayland():
+        return pyautogui.screenshot(region=region)
+    path = _temp_image_path("antigravity_grab")
+    try:
+        ok, error = _capture_screen(path, region)
+        if not ok:
+            raise RuntimeError(f"截屏失败: {error}")
+        with Image.open(path) as img:
+            return img.convert('RGB')
+    finally:
+        try:
+            os.remove(path)
+        except OSError:
+            pass
+
+
+def annotate_boxes(
+    image_path: str,
+    boxes: List[Tuple[int, int, int, int]],
+    output_path: str,
+    color: str = "red"
+) -> bool:
+    """
+    在图片上绘制矩形框和序号，保存到 output_path。
+
+    Args:
+        image_path: 原始图片路径
+        boxes: (x, y, width, height) 列表，序号从 1 开始
+        output_path: 输出图片路径
+        color: 框线颜色
+    """
+    try:
+        from PIL import ImageDraw
+        with Image.open(image_path) as img:
+            canvas = img.convert('RGB')
+        draw = ImageDraw.Draw(canvas)
+        for idx, (x, y, w, h) in enumerate(boxes, start=1):
+            draw.rectangle([x, y, x + w - 1, y + h - 1], outline=color, width=2)
+            draw.text((x + 2, max(0, y - 12)), str(idx), fill=color)
+        canvas.save(output_path)
+        return True
+    except Exception as e:
+        logger.error(f"annotate_boxes 错误: {e}")
+        return False
+
+
+def find_edge_regions(
+    image_path: str,
+    min_area: int = 200,
+    min_density: float = 0.08,
+    max_regions: int = 30
+) -> List[Tuple[int, int, int, int]]:
+    """
+    按边缘密度查找截图中的候选区域（按钮、文字等），用于辅助裁剪模板。
+
+    先做 Canny 边缘检测，再膨胀合并相邻边缘，取外轮廓的外接矩形，
+    过滤掉面积过小或边缘密度过低的区域，按密度从高到低排序。
+
+    Returns:
+        (x, y, width, height) 列表
+    """
+    import cv2
+
+    img = cv2.imread(image_path, cv2.IMREAD_GRAYSCALE)
+    if img is None:
+        logger.error(f"find_edge_regions: 无法读取图片 {image_path}")
+        return []
+
+    edges = cv2.Canny(img, 50, 150)
+    kernel = cv2.getStructuringElement(cv2.MORPH_RECT, (9, 3))
+    merged = cv2.dilate(edges, kernel, iterations=2)
+    # OpenCV 3 返回 3 个值，OpenCV 4 返回 2 个值
+    contours = cv2.findContours(merged, cv2.RETR_EXTERNAL, cv2.CHAIN_APPROX_SIMPLE)[-2]
+
+    candidates = []
+    for contour in contours:
+        x, y, w, h = cv2.boundingRect(contour)
+        area = w * h
+        if area < min_area:
+            continue
+        density = cv2.countNonZero(edges[y:y + h, x:x + w]) / float(area)
+        if density < min_density:
+            continue
+        candidates.append((density, (x, y, w, h)))
+
+    candidates.sort(key=lambda item: item[0], reverse=True)
+    regions = [box for _, box in candidates[:max_regions]]
+    logger.info(f"find_edge_regions: {len(contours)} 个轮廓, 保留 {len(regions)} 个候选区域")
+    return regions
+
+
+def match_score_heatmap(
+    image_path: str,
+    template_path: str,
+    output_path: str
+) -> Tuple[bool, str]:
+    """
+    计算模板在整张截图上每个位置的匹配分数，输出热力图（调试用）。
+
+    分数图按模板中心对齐叠加在截图上，越红表示越接近匹配，
+    便于分辨"差一点匹配上"（容差/缩放问题）和"完全不像"。
+
+    Args:
+        image_path: 屏幕截图路径
+        template_path: 模板图片路径
+        output_path: 热力图输出路径（PNG）
+
+    Returns:
+        tuple: (success: bool, message: str)，成功时 message 为最高分及其中心坐标
+    """
+    import cv2
+    import numpy as np
+
+    screen = cv2.imread(image_path, cv2.IMREAD_COLOR)
+    template, mask = _read_template(template_path, False)
+    if screen is None:
+        return False, f"无法读取截图 {image_path}"
+    if template is None:
+        return False, f"无法读取模板 {template_path}"
+    th, tw = template.shape[:2]
+    sh, sw = screen.shape[:2]
+    if th > sh or tw > sw:
+        return False, f"模板 ({tw}x{th}) 比截图 ({sw}x{sh}) 还大"
+
+    scores = _match_template(screen, template, mask)
+    _, max_val, _, max_loc = cv2.minMaxLoc(scores)
+
+    # 分数 [-1, 1] 映射到 [0, 255]，按模板中心位置放回截图坐标系
+    full = np.zeros((sh, sw), dtype=np.uint8)
+    scaled = np.clip((scores + 1.0) * 127.5, 0, 255).astype(np.uint8)
+    full[th // 2:th // 2 + scaled.shape[0], tw // 2:tw // 2 + scaled.shape[1]] = scaled
+    heatmap = cv2.applyColorMap(full, cv2.COLORMAP_JET)
+    blended = cv2.addWeighted(screen, 0.4, heatmap, 0.6, 0)
+
+    center = (max_loc[0] + tw // 2, max_loc[1] + th // 2)
+    cv2.rectangle(blended, max_loc, (max_loc[0] + tw, max_loc[1] + th), (255, 255, 255), 2)
+    if not cv2.imwrite(output_path, blended):
+        return False, f"无法写入 {output_path}"
+
+    logger.info(f"match_score_heatmap: {template_path} 最高分 {max_val:.3f} @ {center}")
+    return True, f"最高分 {max_val:.3f} @ ({center[0]}, {center[1]})"
+
+
 def find_input_box(templates_dir: str, save_screenshot: bool = False) -> dict:
     """
     查找输入框 - 便捷公共函数
@@ -303,6 +780,285 @@ def find_input_box(templates_dir: str, save_screenshot: bool = False) -> dict:
     return smart_find_image(image_path, save_screenshot=save_screenshot)
 
 
+def load_template_config(image_path: str) -> dict:
+    """
+    读取模板旁的同名 JSON 配置（如 accept_button.png -> accept_button.json）。
+
+    支持的键:
+        button: 点击使用的鼠标按键，1=左键 2=中键 3=右键
+        enabled_color: [R, G, B]，匹配区域平均颜色需接近此值才点击（区分按钮启用/置灰）
+        color_tolerance: 与 enabled_color 每个通道允许的最大偏差，默认 40
+        ocr_label: OCR_FALLBACK=1 且模板未匹配时，在屏幕上查找并点击的文字
+        confirm: 为 true 时需要在间隔 confirm_delay 秒（默认 0.3）的两张截图上都匹配才点击
+        click_offset: [dx, dy]，相对匹配中心的点击偏移，用于点击模板中的某个子元素
+    没有配置文件或解析失败时返回空字典。
+    """
+    import json
+    config_path = os.path.splitext(image_path)[0] + ".json"
+    if not os.path.exists(config_path):
+        return {}
+    try:
+        with open(config_path, 'r', encoding='utf-8') as f:
+            config = json.load(f)
+        return config if isinstance(config, dict) else {}
+    except Exception as e:
+        logger.warning(f"模板配置解析失败 {config_path}: {e}")
+        return {}
+
+
+def _confirm_match(image_path: str, center: Tuple[int, int], confidence: float) -> bool:
+    """
+    模板配置了 confirm: true 时，隔一小段时间重新截屏匹配，两次位置相近才视为真正匹配，
+    用于 Accept / 提交等误点代价大的按钮；未配置时直接返回 True。
+    """
+    config = load_template_config(image_path)
+    if not config.get('confirm'):
+        return True
+    try:
+        delay = float(config.get('confirm_delay', 0.3))
+    except (TypeError, ValueError):
+        delay = 0.3
+    time.sleep(delay)
+    second = locate_center_on_screen(image_path, confidence)
+    if second and abs(second[0] - center[0]) <= 5 and abs(second[1] - center[1]) <= 5:
+        return True
+    logger.info(f"_confirm_match: {os.path.basename(image_path)} 第二次截图未在 {center} 附近匹配，跳过点击")
+    return False
+
+
+def _matches_enabled_color(image_path: str, center: Tuple[int, int]) -> bool:
+    """
+    模板配置了 enabled_color 时，检查屏幕上匹配区域的平均颜色是否在启用色范围内。
+    
+    置灰的按钮形状相同，模板照样能匹配上，只能靠颜色区分。
+    未配置 enabled_color 时总是返回 True。
+    """
+    config = load_template_config(image_path)
+    expected = config.get('enabled_color')
+    if not expected:
+        return True
+    try:
+        expected = [int(c) for c in expected][:3]
+        tolerance = int(config.get('color_tolerance', 40))
+        with Image.open(image_path) as template:
+            width, height = template.size
+        left = max(0, center[0] - width // 2)
+        top = max(0, center[1] - height // 2)
+        region_img = _grab_screen(region=(left, top, width, height)).convert('RGB')
+        pixels = list(region_img.getdata())
+    except Exception as e:
+        logger.warning(f"启用色检查失败 {image_path}: {e}，按启用处理")
+        return True
+    if not pixels:
+        return True
+    average = [sum(p[i] for p in pixels) / len(pixels) for i in range(3)]
+    ok = all(abs(a - e) <= tolerance for a, e in zip(average, expected))
+    if not ok:
+        logger.info(
+            f"{os.path.basename(image_path)} 平均颜色 {[int(a) for a in average]} "
+            f"不在启用色 {expected}±{tolerance} 范围内，视为禁用"
+        )
+    return ok
+
+
+# 未在模板 JSON 中配置 ocr_label 时使用的默认按钮文字
+_DEFAULT_OCR_LABELS = {
+    "accept_button.png": "Accept",
+    "accept_all.png": "Accept all",
+    "Retry.png": "Retry",
+}
+
+
+def ocr_find_text(label: str, workflow_id: Optional[str] = None) -> Optional[Tuple[int, int]]:
+    """
+    用 tesseract 识别当前屏幕文字，返回与 label 匹配的文字框中心坐标。
+
+    label 可以是多个单词，需在同一行中连续出现；不区分大小写。
+    tesseract 未安装或识别失败时返回 None。workflow_id 用于区分并发工作流的临时截图。
+    """
+    words = label.lower().split()
+    if not words:
+        return None
+    screenshot_path = _temp_image_path("ocr_screen", workflow_id)
+    # 截图只包含 CAPTURE_GEOMETRY 区域，识别出的坐标加上区域左上角才是桌面绝对坐标
+    region = _capture_region()
+    origin_x, origin_y = region[:2] if region else (0, 0)
+    ok, error = take_screenshot(screenshot_path, region)
+    if not ok:
+        logger.error(f"ocr_find_text: 截屏失败 {error}")
+        return None
+    try:
+        result = _runner.run(
+            ['tesseract', screenshot_path, 'stdout', 'tsv'],
+            capture_output=True,
+            text=True,
+            timeout=30
+        )
+    except FileNotFoundError:
+        logger.error("ocr_find_text: 未安装 tesseract (apt install tesseract-ocr)")
+        return None
+    except Exception as e:
+        logger.error(f"ocr_find_text 错误: {e}")
+        return None
+    finally:
+        try:
+            os.remove(screenshot_path)
+        except OSError:
+            pass
+    if result.returncode != 0:
+        logger.error(f"ocr_find_text: tesseract 失败 {result.stderr.strip()[:200]}")
+        return None
+
+    # TSV 列: level page_num block_num par_num line_num word_num left top width height conf text
+    lines = {}
+    for row in result.stdout.splitlines()[1:]:
+        cols = row.split('\t')
+        if len(cols) < 12 or not cols[11].strip():
+            continue
+        key = tuple(cols[1:5])
+        left, top, width, height = (int(v) for v in cols[6:10])
+        lines.setdefault(key, []).append((cols[11].strip().lower(), left, top, width, height))
+
+    for line_words in lines.values():
+        texts = [w[0] for w in line_words]
+        for i in range(len(texts) - len(words) + 1):
+            if texts[i:i + len(words)] == words:
+                boxes = line_words[i:i + len(words)]
+                x1 = min(b[1] for b in boxes)
+                y1 = min(b[2] for b in boxes)
+                x2 = max(b[1] + b[3] for b in boxes)
+                y2 = max(b[2] + b[4] for b in boxes)
+                center = (origin_x + (x1 + x2) // 2, origin_y + (y1 + y2) // 2)
+                logger.info(f"ocr_find_text: 找到 '{label}' @ {center}")
+                return center
+    logger.info(f"ocr_find_text: 屏幕上未识别到 '{label}'")
+    return None
+
+
+def _ocr_fallback_click(image_path: str, button: Optional[int], workflow_id: Optional[str] = None) -> Optional[Tuple[int, int]]:
+    """OCR_FALLBACK=1 时，按模板的 ocr_label 用文字识别定位并点击；返回点击坐标。"""
+    if not _env_flag("OCR_FALLBACK"):
+        return None
+    label = load_template_config(image_path).get('ocr_label') or _DEFAULT_OCR_LABELS.get(os.path.basename(image_path))
+    if not label:
+        return None
+    location = ocr_find_text(label, workflow_id)
+    if location:
+        logger.info(f"模板 {os.path.basename(image_path)} 未匹配，OCR 回退点击 '{label}' @ {location}")
+        click_at(location[0], location[1], _template_button(image_path, button))
+    return location
+
+
+_PYAUTOGUI_BUTTONS = {1: 'left', 2: 'middle', 3: 'right'}
+
+
+def click_at(x: int, y: int, button: int = 1, settle: float = 0.2):
+    """
+    移动鼠标到 (x, y) 并点击。优先使用 xdotool，失败时回退到 pyautogui。
+
+    Args:
+        button: 1=左键, 2=中键, 3=右键
+    """
+    if button not in _PYAUTOGUI_BUTTONS:
+        raise ValueError(f"不支持的鼠标按键: {button}")
+    if _env_flag("DRY_RUN"):
+        logger.info(f"DRY_RUN: 跳过点击 ({x}, {y}) button={button}")
+        return
+    try:
+        _runner.run(['xdotool', 'mousemove', str(int(x)), str(int(y))], check=True)
+        time.sleep(settle)
+        _runner.run(['xdotool', 'click', str(button)], check=True)
+    except Exception as e:
+        logger.warning(f"xdotool click failed: {e}. Falling back to pyautogui.")
+        _ensure_pyautogui()
+        pyautogui.moveTo(x, y)
+        time.sleep(settle)
+        pyautogui.click(button=_PYAUTOGUI_BUTTONS[button])
+
+
+# pyautogui 键名 -> xdotool keysym
+_XDOTOOL_KEYS = {
+    'ctrl': 'ctrl',
+    'shift': 'shift',
+    'alt': 'alt',
+    'return': 'Return',
+    'enter': 'Return',
+    'tab': 'Tab',
+    'esc': 'Escape',
+    'escape': 'Escape',
+}
+
+
+def press_keys(*keys: str):
+    """
+    按下一个键或组合键（如 press_keys('ctrl', 'v')）。优先使用 xdotool，失败时回退到 pyautogui。
+
+    键名沿用 pyautogui 的写法，单个字母原样传给 xdotool。
+    """
+    if not keys:
+        raise ValueError("press_keys: 至少需要一个键")
+    try:
+        combo = "+".join(_XDOTOOL_KEYS.get(key.lower(), key) for key in keys)
+        _runner.run(['xdotool', 'key', combo], check=True, timeout=5)
+    except Exception as e:
+        logger.warning(f"xdotool key failed: {e}. Falling back to pyautogui.")
+        _ensure_pyautogui()
+        if len(keys) == 1:
+            pyautogui.press(keys[0])
+        else:
+            pyautogui.hotkey(*keys)
+
+
+def _click_point(
+    image_path: str,
+    center: Tuple[int, int],
+    offset: Optional[Tuple[int, int]],
+    default_offset: Tuple[int, int] = (0, 0)
+) -> Tuple[int, int]:
+    """
+    计算点击坐标：匹配中心加偏移。显式传入的 offset 优先，其次是模板配置里的 click_offset。
+
+    偏移会被限制在模板范围内，模板截得比目标元素大、或偏移写错时仍然点在匹配区域之内。
+    """
+    if offset is None:
+        try:
+            dx, dy = (int(v) for v in load_template_config(image_path).get('click_offset', default_offset))
+            offset = (dx, dy)
+        except (TypeError, ValueError):
+            offset = default_offset
+    try:
+        with Image.open(image_path) as template:
+            half_w, half_h = template.size[0] // 2, template.size[1] // 2
+    except Exception:
+        return center[0] + offset[0], center[1] + offset[1]
+    dx = max(-half_w, min(half_w, offset[0]))
+    dy = max(-half_h, min(half_h, offset[1]))
+    if (dx, dy) != tuple(offset):
+        logger.debug(f"_click_point: 偏移 {offset} 超出 {os.path.basename(image_path)} 范围，收回到 ({dx}, {dy})")
+    return center[0] + dx, center[1] + dy
+
+
+def _template_size(image_path: str) -> Tuple[int, int]:
+    """模板的 (宽, 高)；读取失败时返回 (1, 1)，此时只有完全相同的位置才视为重叠。"""
+    try:
+        with Image.open(image_path) as template:
+            width, height = template.size
+        return int(width), int(height)
+    except Exception as e:
+        logger.debug(f"_template_size failed for {image_path}: {e}")
+        return 1, 1
+
+
+def _template_button(image_path: str, button: Optional[int]) -> int:
+    """显式传入的 button 优先，其次是模板配置里的 button，默认左键。"""
+    if button is not None:
+        return button
+    try:
+        return int(load_template_config(image_path).get('button', 1))
+    except (TypeError, ValueError):
+        return 1
+
+
 def activate_window(window_name_pattern: str = "antigravity") -> bool:
     """
     Activate window by name pattern using xdotool.
@@ -317,7 +1073,7 @@ def activate_window(window_name_pattern: str = "antigravity") -> bool:
         # Search for window ID
         # Only search for visible windows
         cmd = ['xdotool', 'search', '--onlyvisible', '--name', window_name_pattern]
-        result = subprocess.run(cmd, capture_output=True, text=True)
+        result = _runner.run(cmd, capture_output=True, text=True)
         
         if result.returncode == 0 and result.stdout.strip():
             # Get the last window ID (usually the most relevant one if multiple)
@@ -326,9 +1082,18 @@ def activate_window(window_name_pattern: str = "antigravity") -> bool:
             
             # Activate window
             # --sync waits for the window to be active
-            subprocess.run(['xdotool', 'windowactivate', '--sync', target_id], check=True)
-            logger.info(f"Activated window '{window_name_pattern}' (ID: {target_id})")
+            _runner.run(['xdotool', 'windowactivate', '--sync', target_id], check=True, timeout=5)
             time.sleep(0.5) # Wait for animation/focus
+            
+            # Verify the target window actually has focus now
+            active = _runner.run(['xdotool', 'getactivewindow'], capture_output=True, text=True, timeout=5)
+            if active.stdout.strip() != target_id:
+                logger.warning(
+                    f"Window '{window_name_pattern}' (ID: {target_id}) not focused after activation, "
+                    f"active window is {active.stdout.strip() or 'unknown'}"
+                )
+                return False
+            logger.info(f"Activated window '{window_name_pattern}' (ID: {target_id})")
             return True
         else:
             logger.warning(f"Window '{window_name_pattern}' not found")
@@ -340,106 +1105,477 @@ def activate_window(window_name_pattern: str = "antigravity") -> bool:
 
 def click_input_box(
     templates_dir: str,
-    offset_x: int = -20,
-    offset_y: int = -10,
-    confidence: float = 0.8
+    offset_x: Optional[int] = None,
+    offset_y: Optional[int] = None,
+    confidence: float = 0.8,
+    button: Optional[int] = None,
+    window_title: Optional[str] = None
 ) -> tuple:
     """
     查找并点击输入框 - 公共工具函数
     
-    自动将 'antigravity' 窗口置顶，防止被遮挡。
+    自动将目标窗口（默认 'antigravity'）置顶，防止被遮挡。
+    指定了 window_title 时每次点击前都重新激活并确认焦点，用户中途切换到其他窗口时
+    直接失败，而不是把内容粘贴进终端或浏览器。
     使用 xdotool 实现可靠的点击操作。
     
     Args:
         templates_dir: 模板目录路径
-        offset_x: X轴偏移量（负值向左，默认-20）
-        offset_y: Y轴偏移量（负值向上，默认-10）
+        offset_x: X轴偏移量（负值向左），默认读取 input_box.json 的 click_offset，否则 -20
+        offset_y: Y轴偏移量（负值向上），默认同上，否则 -10
         confidence: 图像匹配置信度
+        button: 鼠标按键（1/2/3），默认读取 input_box.json，否则左键
+        window_title: 目标窗口标题子串，默认 'antigravity'
     
     Returns:
         tuple: (success: bool, debug_info: str)
     """
-    import subprocess
     _ensure_pyautogui()
     
     # 确保模板目录可用（防止 _MEI 临时目录被清理）
     templates_dir = _ensure_templates(templates_dir)
     
     # 1. 尝试激活目标窗口
-    activate_window("antigravity")
-    
-    image_path = os.path.join(templates_dir, "input_box.png")
+    if not activate_window(window_title or "antigravity") and window_title:
+        return False, f"无法激活标题包含 \"{window_title}\" 的窗口"
     
     try:
-        location = pyautogui.locateCenterOnScreen(image_path, confidence=confidence)
+        image_path, location = _locate_input_box(templates_dir, confidence)
         if location:
-            x = int(location.x) + offset_x
-            y = int(location.y) + offset_y
+            offset = None if offset_x is None and offset_y is None else (offset_x or 0, offset_y or 0)
+            x, y = _input_box_click_point(image_path, location, offset)
             
-            logger.info(f"click_input_box: 找到 input_box.png @ ({location.x}, {location.y}), 点击位置 ({x}, {y})")
+            logger.info(f"click_input_box: 找到 input_box.png @ {location}, 点击位置 ({x}, {y})")
             
             # 使用 xdotool 点击（更可靠）
-            subprocess.run(['xdotool', 'mousemove', str(x), str(y)], check=True)
-            time.sleep(0.2)
-            subprocess.run(['xdotool', 'click', '1'], check=True)
+            click_at(x, y, _template_button(image_path, button))
             
             return True, f"点击成功 @ ({x}, {y})"
         else:
             return False, "未找到 input_box.png"
-    except pyautogui.ImageNotFoundException:
-        return False, "未找到 input_box.png"
     except Exception as e:
         logger.error(f"click_input_box 错误: {e}")
         return False, f"错误: {e}"
 
 
-def find_replying(templates_dir: str, confidence: float = 0.9) -> tuple:
+def _locate_input_box(templates_dir: str, confidence: float) -> Tuple[str, Optional[Tuple[int, int]]]:
+    """按 click_input_box 的方式查找输入框，返回 (模板路径, 中心坐标或 None)；DRY_RUN 也用它，保证结论一致。"""
+    image_path = os.path.join(templates_dir, "input_box.png")
+    capture_predelay()
+    return image_path, locate_center_on_screen(image_path, confidence)
+
+
+def _input_box_click_point(
+    image_path: str,
+    location: Tuple[int, int],
+    offset: Optional[Tuple[int, int]] = None
+) -> Tuple[int, int]:
+    """输入框的点击位置：默认在匹配中心左上方 (-20, -10)，可由 input_box.json 的 click_offset 覆盖。"""
+    return _click_point(image_path, location, offset, default_offset=(-20, -10))
+
+
+def _read_template(image_path: str, grayscale: bool):
     """
-    查找 Replying 指示器 - 公共工具函数
-    
-    Args:
-        templates_dir: 模板目录路径
-        confidence: 图像匹配置信度
-    
-    Returns:
-        tuple: (found: bool, location: tuple or None)
-    
-    Example:
-        found, location = find_replying('/path/to/templates')
-        if found:
-            print(f"找到Replying @ {location}")
+    读取模板，返回 (图像, 掩码)；读取失败返回 (None, None)。
+
+    带透明通道的 PNG 按 IMREAD_COLOR 读取会直接丢弃 alpha，透明像素残留的颜色值
+    （常见为黑色或任意值）仍参与比较，与屏幕上实际露出的背景对不上，导致带阴影、圆角
+    等半透明区域的模板匹配失败。这里统一读成非预乘的 BGRA 后去掉 alpha，只把 alpha 不低于
+    TEMPLATE_ALPHA_THRESHOLD（默认 255，即完全不透明）的像素作为掩码参与比较，其余像素视为
+    通配；所有像素都达到阈值时掩码为 None，与原来的匹配方式完全相同。
     """
-    _ensure_pyautogui()
-    templates_dir = _ensure_templates(templates_dir)
-    image_path = os.path.join(templates_dir, "Replying.png")
-    
-    try:
-        location = pyautogui.locateCenterOnScreen(image_path, confidence=confidence)
-        if location:
-            logger.info(f"find_replying: 找到 @ ({location.x}, {location.y})")
-            return True, (int(location.x), int(location.y))
-        else:
-            return False, None
+    import cv2
+    import numpy as np
+
+    raw = cv2.imread(image_path, cv2.IMREAD_UNCHANGED)
+    if raw is None:
+        return None, None
+    if raw.dtype != np.uint8:
+        # 16 位 PNG 缩放到 8 位，与 8 位的屏幕截图保持同一取值范围
+        raw = (raw / 257).astype(np.uint8)
+    alpha = None
+    if raw.ndim == 2:
+        color = cv2.cvtColor(raw, cv2.COLOR_GRAY2BGR)
+    elif raw.shape[2] == 4:
+        alpha = raw[:, :, 3]
+        color = cv2.cvtColor(raw, cv2.COLOR_BGRA2BGR)
+    else:
+        color = raw
+    template = cv2.cvtColor(color, cv2.COLOR_BGR2GRAY) if grayscale else color
+    threshold = min(255, max(1, _env_int("TEMPLATE_ALPHA_THRESHOLD", 255)))
+    if alpha is None or alpha.min() >= threshold:
+        return template, None
+    opaque = alpha >= threshold
+    if not opaque.any():
+        # 没有达到阈值的像素（如整张半透明的遮罩层），无法单独比较，按去掉 alpha 后的颜色匹配
+        return template, None
+    mask = opaque.astype(np.uint8) * 255
+    if not grayscale:
+        mask = cv2.merge([mask, mask, mask])
+    return template, mask
+
+
+def _match_template(screen, template, mask=None):
+    """TM_CCOEFF_NORMED 匹配；带掩码时纯色区域方差为 0 会产生 NaN / inf，统一按 0 分处理。"""
+    import cv2
+    import numpy as np
+
+    if mask is None:
+        return cv2.matchTemplate(screen, template, cv2.TM_CCOEFF_NORMED)
+    scores = cv2.matchTemplate(screen, template, cv2.TM_CCOEFF_NORMED, mask=mask)
+    return np.nan_to_num(scores, nan=0.0, posinf=0.0, neginf=0.0)
+
+
+# (路径, 修改时间, 文件大小, TEMPLATE_ALPHA_THRESHOLD) -> 是否需要掩码匹配；/settemplate 替换模板后自动失效
+_transparency_cache: Dict[Tuple[str, float, int, int], bool] = {}
+
+
+def _template_has_transparency(image_path: str) -> bool:
+    """
+    模板是否带有需要掩码匹配的透明像素（读取失败时按否处理，交给常规匹配报错）。
+
+    监控循环每次轮询都会调用，结果按文件缓存，避免每次都重新解码模板。
+    """
+    try:
+        stat = os.stat(image_path)
+    except OSError:
+        return False
+    key = (image_path, stat.st_mtime, stat.st_size, _env_int("TEMPLATE_ALPHA_THRESHOLD", 255))
+    cached = _transparency_cache.get(key)
+    if cached is not None:
+        return cached
+    try:
+        _, mask = _read_template(image_path, False)
+    except Exception as e:
+        logger.debug(f"_template_has_transparency failed for {image_path}: {e}")
+        return False
+    _transparency_cache[key] = mask is not None
+    return mask is not None
+
+
+def locate_center_on_screen(
+    image_path: str,
+    confidence: float,
+    region: Optional[Tuple[int, int, int, int]] = None
+) -> Optional[Tuple[int, int]]:
+    """
+    在屏幕上查找模板，返回中心坐标；未找到返回 None。
+
+    MATCH_COARSE_STEP > 1 时先把截图和模板都缩小为 1/step 做粗扫描，
+    再只在粗扫描候选附近按原分辨率精确匹配，大屏幕上每秒一次的监控循环会快很多。
+    默认 1 时与 pyautogui.locateCenterOnScreen 相同。
+
+    带透明像素的模板（以及 Wayland 会话）改用 OpenCV 匹配（见 _read_template），pyautogui 会丢弃 alpha 通道；
+    是否有需要忽略的像素按 TEMPLATE_ALPHA_THRESHOLD 判断，与粗到精匹配使用同一个掩码。
+
+    MATCH_JITTER=k（默认 0）容忍界面重排造成的几个像素偏移：搜索区域向四周各扩大 k 像素，
+    粗扫描候选附近的精确匹配窗口也多搜 ±k 像素，取其中最佳位置。
+    """
+    if region is None:
+        region = _capture_region()
+    jitter = max(0, _env_int("MATCH_JITTER", 0))
+    if region and jitter:
+        region = _expand_region(region, jitter)
+    step = _env_int("MATCH_COARSE_STEP", 1)
+    if step > 1:
+        location = _coarse_locate(image_path, confidence, region, step, jitter=jitter)
+        if location is not False:
+            return location
+    # Wayland 下 pyautogui 无法截屏，同样改用 OpenCV 匹配 _grab_screen 取得的画面
+    if _is_wayland() or _template_has_transparency(image_path):
+        match = _best_match(image_path, region)
+        return match[1] if match and match[0] >= confidence else None
+    try:
+        location = pyautogui.locateCenterOnScreen(image_path, confidence=confidence, region=region, grayscale=_match_grayscale())
     except pyautogui.ImageNotFoundException:
+        return None
+    return (int(location.x), int(location.y)) if location else None
+
+
+def _expand_region(region: Tuple[int, int, int, int], pad: int) -> Tuple[int, int, int, int]:
+    """把搜索区域向四周各扩大 pad 像素，并裁剪到屏幕范围内。"""
+    _ensure_pyautogui()
+    screen_w, screen_h = pyautogui.size()
+    x, y, w, h = region
+    left, top = max(0, x - pad), max(0, y - pad)
+    right, bottom = min(screen_w, x + w + pad), min(screen_h, y + h + pad)
+    return (left, top, right - left, bottom - top)
+
+
+def _coarse_locate(
+    image_path: str,
+    confidence: float,
+    region: Optional[Tuple[int, int, int, int]],
+    step: int,
+    max_candidates: int = 5,
+    jitter: int = 0
+):
+    """粗到精两级匹配。返回中心坐标、None（未找到），模板太小无法缩放时返回 False 交给常规匹配。"""
+    import cv2
+    import numpy as np
+
+    grayscale = _match_grayscale()
+    template, mask = _read_template(image_path, grayscale)
+    if template is None:
+        return False
+    th, tw = template.shape[:2]
+    if th // step < 4 or tw // step < 4:
+        return False
+
+    screen = cv2.cvtColor(
+        np.array(_grab_screen(region=region)),
+        cv2.COLOR_RGB2GRAY if grayscale else cv2.COLOR_RGB2BGR,
+    )
+    sh, sw = screen.shape[:2]
+    if th > sh or tw > sw:
+        return None
+
+    small_screen = cv2.resize(screen, (sw // step, sh // step), interpolation=cv2.INTER_AREA)
+    small_template = cv2.resize(template, (tw // step, th // step), interpolation=cv2.INTER_AREA)
+    small_mask = None if mask is None else cv2.resize(mask, (tw // step, th // step), interpolation=cv2.INTER_NEAREST)
+    coarse = _match_template(small_screen, small_template, small_mask)
+
+    # 缩小会损失细节，粗扫描阈值放宽，最终以原分辨率的分数为准
+    ys, xs = np.where(coarse >= confidence - 0.2)
+    if len(xs) == 0:
+        return None
+    order = np.argsort(coarse[ys, xs])[::-1][:max_candidates]
+
+    offset_x, offset_y = (region[0], region[1]) if region else (0, 0)
+    margin = 2 * step + jitter
+    # matchTemplate 的结果大小是 (H - h + 1, W - w + 1)，紧贴右/下边缘的位置也在其中；
+    # 精确匹配窗口裁剪到 sw/sh（而不是 sw - tw），贴边的模板同样能匹配上
+    for idx in order:
+        x0 = max(0, xs[idx] * step - margin)
+        y0 = max(0, ys[idx] * step - margin)
+        x1 = min(sw, xs[idx] * step + tw + margin)
+        y1 = min(sh, ys[idx] * step + th + margin)
+        # 切片是指向整屏缓冲区的视图（行跨度仍是整屏宽度），复制为连续数组再交给 OpenCV，
+        # 不依赖绑定层对非连续视图的处理
+        window = np.ascontiguousarray(screen[y0:y1, x0:x1])
+        if window.shape[0] < th or window.shape[1] < tw:
+            continue
+        fine = _match_template(window, template, mask)
+        _, max_val, _, max_loc = cv2.minMaxLoc(fine)
+        if max_val >= confidence:
+            return (int(offset_x + x0 + max_loc[0] + tw // 2), int(offset_y + y0 + max_loc[1] + th // 2))
+    return None
+
+
+def replying_frames(templates_dir: str) -> List[str]:
+    """
+    Replying 指示器的全部模板帧文件名。
+
+    指示器带动画（如跳动的省略号）时，单帧模板可能在动画中途匹配不上，
+    可额外放 Replying_1.png、Replying_2.png 等帧，任意一帧匹配即视为 Replying 可见。
+    """
+    frames = ["Replying.png"] if os.path.exists(os.path.join(templates_dir, "Replying.png")) else []
+    frames += sorted(
+        os.path.basename(path) for path in glob.glob(os.path.join(templates_dir, "Replying_*.png"))
+    )
+    return frames or ["Replying.png"]
+
+
+def find_replying(
+    templates_dir: str,
+    confidence: float = 0.9,
+    region: Optional[Tuple[int, int, int, int]] = None,
+    raise_errors: bool = False
+) -> tuple:
+    """
+    查找 Replying 指示器 - 公共工具函数
+    
+    Args:
+        templates_dir: 模板目录路径
+        confidence: 图像匹配置信度
+        region: 搜索区域 (x, y, width, height)，默认读取 REPLYING_REGION，未设置时全屏
+        raise_errors: 为 True 时截屏/匹配出错直接抛出，而不是当作未找到
+    
+    Returns:
+        tuple: (found: bool, location: tuple or None)
+    
+    Example:
+        found, location = find_replying('/path/to/templates')
+        if found:
+            print(f"找到Replying @ {location}")
+    """
+    _ensure_pyautogui()
+    templates_dir = _ensure_templates(templates_dir)
+    if region is None:
+        region = _env_region("REPLYING_REGION")
+    
+    try:
+        for frame in replying_frames(templates_dir):
+            location = locate_center_on_screen(os.path.join(templates_dir, frame), confidence, region)
+            if location:
+                logger.info(f"find_replying: {frame} 找到 @ {location}")
+                return True, location
         return False, None
     except Exception as e:
         logger.error(f"find_replying 错误: {e}")
+        if raise_errors:
+            raise
         return False, None
 
 
-def click_accept_button(templates_dir: str, confidence: float = 0.7) -> tuple:
+def wait_for_template(
+    templates_dir: str,
+    template: Union[str, List[str]],
+    timeout: float,
+    confidence: float = 0.8,
+    region: Optional[Tuple[int, int, int, int]] = None,
+    interval: float = 0.5,
+    stop_event=None,
+    max_capture_errors: int = 0
+) -> Tuple[bool, Optional[Tuple[int, int]]]:
+    """
+    轮询直到模板出现在屏幕上或超时 - 公共工具函数
+    
+    Args:
+        templates_dir: 模板目录路径
+        template: 模板文件名（如 "input_box.png"），或多个文件名（任意一个出现即可）
+        timeout: 最长等待秒数
+        confidence: 图像匹配置信度
+        region: 可选的搜索区域 (x, y, width, height)
+        interval: 轮询间隔秒数
+        stop_event: 可选的 threading.Event，被 set 时提前返回 (False, None)
+        max_capture_errors: > 0 时连续这么多次截屏/匹配出错就抛出最后一次的异常；
+            超时前一次都没有截屏成功时同样抛出，而不是当作“未出现”
+    
+    Returns:
+        tuple: (found: bool, location: tuple or None)
+    """
+    _ensure_pyautogui()
+    templates_dir = _ensure_templates(templates_dir)
+    names = [template] if isinstance(template, str) else list(template)
+    deadline = time.time() + timeout
+    capture_errors = 0
+    captured = False
+    
+    while True:
+        if stop_event and stop_event.is_set():
+            return False, None
+        try:
+            for name in names:
+                location = locate_center_on_screen(os.path.join(templates_dir, name), confidence, region)
+                if location:
+                    logger.info(f"wait_for_template: {name} 出现 @ {location}")
+                    return True, location
+            capture_errors = 0
+            captured = True
+        except Exception as e:
+            capture_errors += 1
+            logger.error(f"wait_for_template 错误: {e}")
+            if max_capture_errors > 0 and (capture_errors >= max_capture_errors
+                                           or (not captured and time.time() >= deadline)):
+                raise
+        if time.time() >= deadline:
+            logger.info(f"wait_for_template: {timeout} 秒内未见 {template}")
+            return False, None
+        time.sleep(interval)
+
+
+def _activate_target_window(window_title: Optional[str], send_status: Callable[[str], None]) -> bool:
+    """指定了目标窗口时，在工作流开始前激活并确认其获得焦点；未指定时不做检查。"""
+    if not window_title:
+        return True
+    if activate_window(window_title):
+        return True
+    send_status(f"错误: 无法激活标题包含 \"{window_title}\" 的窗口，已取消发送")
+    return False
+
+
+def _wait_input_ready(templates_dir: str):
+    """INPUT_READY_TIMEOUT > 0 时，在工作流开始前等待输入框出现（IDE 可能仍在加载）。"""
+    timeout = _env_float("INPUT_READY_TIMEOUT", 0)
+    if timeout > 0:
+        wait_for_template(templates_dir, "input_box.png", timeout)
+
+
+def ensure_ide_mode(
+    templates_dir: str,
+    mode: Optional[str],
+    send_status: Callable[[str], None],
+    workflow_id: Optional[str] = None
+) -> bool:
+    """
+    确保 IDE 处于指定交互模式（如 plan / act）后再粘贴。
+
+    mode_<mode>.png 是该模式激活时的指示器模板，mode_toggle.png 是模式切换按钮。
+    看不到目标指示器时点击切换按钮（最多 3 次，兼容多于两种模式的循环切换），
+    每次点击后重新检查。mode 为空时不做任何事。
+
+    Returns:
+        False 如果无法确认切换到目标模式（仅提示，不中断发送）
+    """
+    if not mode:
+        return True
+    templates_dir = _ensure_templates(templates_dir)
+    indicator = os.path.join(templates_dir, f"mode_{mode}.png")
+    toggle = os.path.join(templates_dir, "mode_toggle.png")
+    if not os.path.exists(indicator):
+        logger.warning(f"ensure_ide_mode: 缺少模式指示器模板 {indicator}")
+        send_status(f"⚠️ 缺少模板 mode_{mode}.png，无法确认 IDE 模式")
+        return False
+    for attempt in range(4):
+        if find_image(indicator, 0.8):
+            if attempt:
+                logger.info(f"ensure_ide_mode: 已切换到 {mode} 模式")
+            return True
+        if attempt == 3:
+            break
+        success, debug_info = find_and_click(toggle, workflow_id=workflow_id)
+        if not success:
+            logger.warning(f"ensure_ide_mode: 找不到模式切换按钮: {debug_info}")
+            break
+        time.sleep(0.5)
+    send_status(f"⚠️ 无法切换到 {mode} 模式，按当前模式发送")
+    return False
+
+
+def _verify_accept_gone(
+    image_path: str,
+    confidence: float,
+    clicked_at: Tuple[int, int],
+    button: Optional[int]
+) -> bool:
+    """
+    VERIFY_ACCEPT=1 时使用：点击后重新截屏确认按钮已消失，仍在原处则补点一次。
+
+    Returns:
+        True 如果按钮已消失（点击生效）
+    """
+    for attempt in range(2):
+        time.sleep(0.8)
+        location = locate_center_on_screen(image_path, confidence)
+        # 位置变了说明是另一个待确认的按钮，不算这次点击失败
+        if not location or abs(location[0] - clicked_at[0]) > 5 or abs(location[1] - clicked_at[1]) > 5:
+            return True
+        if attempt == 0:
+            logger.warning(f"click_accept_button: 点击后按钮仍在 @ {clicked_at}，重试一次")
+            click_at(clicked_at[0], clicked_at[1], _template_button(image_path, button))
+    logger.warning(f"click_accept_button: 重试后按钮仍在 @ {clicked_at}，点击可能未生效")
+    return False
+
+
+def click_accept_button(
+    templates_dir: str,
+    confidence: float = 0.7,
+    button: Optional[int] = None,
+    workflow_id: Optional[str] = None
+) -> tuple:
     """
     查找并点击 Accept 或 Accept all 按钮 - 公共工具函数
     
     Args:
         templates_dir: 模板目录路径
         confidence: 图像匹配置信度
+        button: 鼠标按键（1/2/3），默认读取模板 JSON 配置，否则左键
+        workflow_id: 所属工作流 ID，用于区分 OCR 回退的临时截图
     
     Returns:
         tuple: (success: bool, debug_info: str)
     """
-    import subprocess
-    
     _ensure_pyautogui()
     templates_dir = _ensure_templates(templates_dir)
     # 尝试查找的模板列表
@@ -453,54 +1589,280 @@ def click_accept_button(templates_dir: str, confidence: float = 0.7) -> tuple:
             continue
             
         try:
-            location = pyautogui.locateCenterOnScreen(image_path, confidence=confidence)
+            location = locate_center_on_screen(image_path, confidence)
             if location:
-                x, y = int(location.x), int(location.y)
+                x, y = location
                 
                 logger.info(f"click_accept_button: 找到 {template_name} @ ({x}, {y})")
                 
+                if not _matches_enabled_color(image_path, (x, y)):
+                    continue
+                if not _confirm_match(image_path, (x, y), confidence):
+                    continue
+                
                 # 使用 xdotool 点击
-                subprocess.run(['xdotool', 'mousemove', str(x), str(y)], check=True)
-                time.sleep(0.2)
-                subprocess.run(['xdotool', 'click', '1'], check=True)
+                click_at(x, y, _template_button(image_path, button))
+                
+                if _env_flag("VERIFY_ACCEPT") and not _verify_accept_gone(image_path, confidence, (x, y), button):
+                    return True, f"已点击 ({template_name}) @ ({x}, {y})，但按钮仍然存在"
                 
                 return True, f"点击成功 ({template_name}) @ ({x}, {y})"
-        except pyautogui.ImageNotFoundException:
-            continue
         except Exception as e:
             logger.error(f"click_accept_button 错误 ({template_name}): {e}")
     
+    for template_name in templates:
+        image_path = os.path.join(templates_dir, template_name)
+        location = _ocr_fallback_click(image_path, button, workflow_id)
+        if location:
+            return True, f"OCR 回退点击成功 ({template_name}) @ {location}"
+    
     return False, "未找到 accept 按钮"
 
 
+def click_all_accept_buttons(
+    templates_dir: str,
+    confidence: float = 0.7,
+    button: Optional[int] = None,
+    max_clicks: int = 5,
+    workflow_id: Optional[str] = None
+) -> Tuple[int, str]:
+    """
+    点击屏幕上所有 Accept / Accept all 按钮（多个文件修改时 IDE 会堆叠多个确认提示）。
+    
+    每次最多点击 max_clicks 个，防止模板误匹配时连续乱点。一个都没找到时退回
+    click_accept_button()（含 OCR 回退）。
+    
+    Returns:
+        tuple: (clicked_count: int, debug_info: str)
+    """
+    _ensure_pyautogui()
+    templates_dir = _ensure_templates(templates_dir)
+    matches = []
+    for template_name in ["accept_button.png", "accept_all.png"]:
+        image_path = os.path.join(templates_dir, template_name)
+        if not os.path.exists(image_path):
+            continue
+        size = _template_size(image_path)
+        for score, center in find_all_on_screen(image_path, confidence, max_results=max_clicks):
+            matches.append((score, template_name, image_path, center, size))
+    
+    # 两个模板可能匹配到同一个按钮：跨模板按分数从高到低保留，与已保留的匹配区域重叠的丢弃，
+    # 否则第二次点击会落在第一次点击后移到该位置的内容上
+    matches.sort(key=lambda match: match[0], reverse=True)
+    candidates = []
+    kept = []
+    for score, template_name, image_path, (x, y), (w, h) in matches:
+        if any(abs(x - kx) < (w + kw) / 2 and abs(y - ky) < (h + kh) / 2 for (kx, ky), (kw, kh) in kept):
+            continue
+        if not _matches_enabled_color(image_path, (x, y)):
+            continue
+        if not _confirm_match(image_path, (x, y), confidence):
+            continue
+        kept.append(((x, y), (w, h)))
+        candidates.append((template_name, image_path, (x, y)))
+    
+    if not candidates:
+        success, info = click_accept_button(templates_dir, confidence, button, workflow_id)
+        return (1 if success else 0), info
+    
+    # 从下往上点：接受一个提示后，其下方的内容会上移，而上方的按钮位置不变
+    candidates.sort(key=lambda candidate: candidate[2][1], reverse=True)
+    if len(candidates) > max_clicks:
+        logger.warning(f"click_all_accept_buttons: 找到 {len(candidates)} 个按钮，本次只点击 {max_clicks} 个")
+        candidates = candidates[:max_clicks]
+    clicked = []
+    for template_name, image_path, (x, y) in candidates:
+        logger.info(f"click_all_accept_buttons: 点击 {template_name} @ ({x}, {y})")
+        click_at(x, y, _template_button(image_path, button))
+        if _env_flag("VERIFY_ACCEPT"):
+            _verify_accept_gone(image_path, confidence, (x, y), button)
+        else:
+            time.sleep(0.3)
+        clicked.append(f"{template_name} @ ({x}, {y})")
+    return len(clicked), f"点击成功 {len(clicked)} 个: " + ", ".join(clicked)
+
+
+def _destructive_change_visible(templates_dir: str) -> bool:
+    """IDE 是否显示了破坏性变更（如删除文件）警告，模板为 destructive_warning.png，未提供时视为不检测。"""
+    image_path = os.path.join(_ensure_templates(templates_dir), "destructive_warning.png")
+    if not os.path.exists(image_path):
+        return False
+    try:
+        return locate_center_on_screen(image_path, 0.8) is not None
+    except Exception as e:
+        logger.error(f"_destructive_change_visible 错误: {e}")
+        return False
+
+
+def _accept_button_visible(templates_dir: str, confidence: float = 0.7) -> bool:
+    """屏幕上是否有可点击的 Accept / Accept all 按钮（AUTO_ACCEPT=0 时用于请求人工批准，只检测不点击）。"""
+    templates_dir = _ensure_templates(templates_dir)
+    for template_name in ["accept_button.png", "accept_all.png"]:
+        image_path = os.path.join(templates_dir, template_name)
+        if not os.path.exists(image_path):
+            continue
+        try:
+            location = locate_center_on_screen(image_path, confidence)
+        except Exception as e:
+            logger.error(f"_accept_button_visible 错误 ({template_name}): {e}")
+            continue
+        if location and _matches_enabled_color(image_path, (int(location[0]), int(location[1]))):
+            return True
+    return False
+
+
+def _request_accept_approval(
+    templates_dir: str,
+    send_status: Optional[Callable[[str], None]],
+    approval_func: Optional[Callable[[str], Optional[bool]]],
+    change: str = "破坏性变更（如删除文件）",
+    workflow_id: Optional[str] = None
+) -> bool:
+    """
+    需要人工批准后才点击 Accept（破坏性变更，或 AUTO_ACCEPT=0 时的所有修改）。
+
+    approval_func(提示) 返回 True 批准、False 拒绝、None 超时；拒绝时若有 reject_button.png 则点击它。
+    未提供 approval_func 时只提示，不自动 Accept。
+
+    Returns:
+        True 如果用户批准
+    """
+    if approval_func is None:
+        if send_status:
+            send_status(f"⚠️ 检测到{change}，已停止自动 Accept，请在 IDE 中手动确认。")
+        return False
+    
+    decision = approval_func(f"⚠️ IDE 请求执行{change}，是否批准？")
+    if decision:
+        logger.info(f"{change}: 用户已批准")
+        return True
+    if decision is None:
+        logger.info(f"{change}: 等待批准超时")
+        if send_status:
+            send_status("⏰ 等待批准超时，未自动 Accept，请在 IDE 中手动处理。")
+        return False
+    
+    logger.info(f"{change}: 用户已拒绝")
+    reject_img = os.path.join(_ensure_templates(templates_dir), "reject_button.png")
+    if os.path.exists(reject_img):
+        success, info = find_and_click(reject_img, workflow_id=workflow_id)
+        if not success:
+            logger.warning(f"{change}: 未找到 Reject 按钮: {info}")
+    return False
+
+
+CLIPBOARD_HINT = "如果剪贴板写入后读回为空，通常是缺少剪贴板管理器（极简 WM 下可安装 parcellite / clipit）"
+
+
+def _is_wayland() -> bool:
+    """当前是否为 Wayland 会话（xclip 在 Wayland 下会静默失败，需要改用 wl-copy / wl-paste）。"""
+    return bool(os.getenv('WAYLAND_DISPLAY')) or os.getenv('XDG_SESSION_TYPE', '').lower() == 'wayland'
+
+
+def _clipboard_tool_missing() -> Optional[str]:
+    """当前会话所需的剪贴板工具未安装时返回错误说明。"""
+    if _is_wayland():
+        if not shutil.which('wl-copy'):
+            return "Wayland 会话需要 wl-copy（apt install wl-clipboard）"
+    elif not shutil.which('xclip'):
+        return "X11 会话需要 xclip（apt install xclip）"
+    return None
+
+
+def check_dependencies() -> List[str]:
+    """
+    检查 GUI 自动化依赖的外部命令是否在 PATH 中，返回缺失项的说明（为空表示齐全）。
+
+    缺少这些命令时截屏、点击、粘贴会在运行中途以各种难懂的方式失败，启动时先检查一次。
+    """
+    missing = []
+    screenshot_tool = _screenshot_command("")[0]
+    if not shutil.which(screenshot_tool):
+        hints = {'scrot': "apt install scrot", 'grim': "apt install grim"}
+        hint = hints.get(screenshot_tool, "检查 SCREENSHOT_CMD")
+        missing.append(f"截屏需要 {screenshot_tool}（{hint}）")
+    if not shutil.which('xdotool'):
+        missing.append("点击和窗口激活需要 xdotool（apt install xdotool）")
+    clipboard = _clipboard_tool_missing()
+    if clipboard:
+        missing.append(clipboard)
+    return missing
+
+
+def _read_clipboard() -> str:
+    """读回当前剪贴板文本，失败时返回空字符串。"""
+    cmd = ['wl-paste', '--no-newline'] if _is_wayland() else ['xclip', '-selection', 'clipboard', '-o']
+    try:
+        result = _runner.run(
+            cmd,
+            capture_output=True,
+            text=True,
+            timeout=2
+        )
+        if result.returncode == 0:
+            return result.stdout
+    except Exception:
+        pass
+    try:
+        return pyperclip.paste() or ""
+    except Exception:
+        return ""
+
+
 def set_clipboard(text: str) -> bool:
     """
     Set text content to X11 clipboard.
     
+    After setting, the selection is read back: xclip can exit 0 without
+    actually owning the selection (e.g. no clipboard manager on a minimal
+    WM), which otherwise shows up as a silent empty paste.
+    
+    On Wayland sessions wl-copy is used instead of xclip.
+    
     Args:
         text: Text to copy to clipboard
         
     Returns:
         True if successful, False otherwise
     """
+    if _is_wayland():
+        missing = _clipboard_tool_missing()
+        if missing:
+            logger.error(f"set_clipboard: {missing}")
+            return False
+        try:
+            _runner.run(['wl-copy'], input=text, text=True, timeout=2, check=True)
+        except Exception as e:
+            logger.error(f"Error setting clipboard (wl-copy): {e}")
+            return False
+        if text and not _read_clipboard():
+            logger.error(CLIPBOARD_HINT)
+            return False
+        return True
+    
     try:
         # 优先使用 pyperclip，它处理得更好
         pyperclip.copy(text)
-        return True
     except Exception as e:
         logger.warning(f"pyperclip failed, falling back to xclip: {e}")
         try:
             # Fallback to xclip
-            process = subprocess.Popen(
+            process = _runner.popen(
                 ['xclip', '-selection', 'clipboard'],
                 stdin=subprocess.PIPE,
                 text=True
             )
             process.communicate(input=text, timeout=2)
-            return process.returncode == 0
+            if process.returncode != 0:
+                return False
         except Exception as e2:
             logger.error(f"Error setting clipboard: {e2}")
             return False
+    
+    if text and not _read_clipboard():
+        logger.error(CLIPBOARD_HINT)
+        return False
+    return True
 
 
 from PIL import Image
@@ -509,20 +1871,34 @@ from PIL import Image
 
 # ... (previous code)
 
-def set_clipboard_image(image_path: str) -> Tuple[bool, Optional[subprocess.Popen]]:
+# 剪贴板图片 MIME 类型 -> PIL 保存格式
+_CLIPBOARD_IMAGE_FORMATS = {
+    'image/png': 'PNG',
+    'image/jpeg': 'JPEG',
+    'image/jpg': 'JPEG',
+    'image/bmp': 'BMP',
+    'image/gif': 'GIF',
+    'image/webp': 'WEBP',
+}
+
+
+def _clipboard_image_mime() -> str:
     """
-    Copy image to clipboard using xclip directly.
-    Ensures image is in PNG format before copying.
-    Dependencies: xclip, pillow
-    
-    Args:
-        image_path: Path to the image file
-        
-    Returns:
-        Tuple[bool, Optional[subprocess.Popen]]: (Success, Process object if running)
-        NOTE: If successful, the xclip process is returned and MUST be terminated
-              by the caller after pasting is complete to release the clipboard.
+    CLIPBOARD_IMAGE_MIME 指定的剪贴板图片类型，默认 image/png。
+
+    可写逗号分隔的多个类型表示偏好顺序，但 xclip 一个进程只能提供一种 target，
+    实际使用第一个受支持的类型；都不支持时退回 image/png。
     """
+    raw = os.getenv('CLIPBOARD_IMAGE_MIME', '').strip().lower()
+    for mime in (m.strip() for m in raw.split(',') if m.strip()):
+        if mime in _CLIPBOARD_IMAGE_FORMATS:
+            return mime
+        logger.warning(f"CLIPBOARD_IMAGE_MIME: 不支持的类型 {mime}，已忽略")
+    return 'image/png'
+
+
+def _set_clipboard_image_once(image_path: str) -> Tuple[bool, Optional[subprocess.Popen]]:
+    """set_clipboard_image() 的单次设置，不确认剪贴板是否就绪。"""
     temp_png_path = None
     try:
         if not os.path.exists(image_path):
@@ -531,33 +1907,51 @@ def set_clipboard_image(image_path: str) -> Tuple[bool, Optional[subprocess.Pope
         
         abs_path = os.path.abspath(image_path)
         target_path = abs_path
+        mime = _clipboard_image_mime()
+        image_format = _CLIPBOARD_IMAGE_FORMATS[mime]
         
-        # 1. Ensure/Convert to PNG
+        # 1. Ensure/Convert to the clipboard format
         try:
             with Image.open(abs_path) as img:
-                if img.format != 'PNG':
-                    logger.info(f"Converting {img.format} to PNG for clipboard...")
-                    # Create temporary PNG file
+                if img.format != image_format:
+                    logger.info(f"Converting {img.format} to {image_format} for clipboard...")
+                    # Create temporary file in the target format
                     import tempfile
-                    fd, temp_png_path = tempfile.mkstemp(suffix='.png')
+                    fd, temp_png_path = tempfile.mkstemp(suffix=f".{image_format.lower()}")
                     os.close(fd)
                     
-                    img.save(temp_png_path, format="PNG")
+                    if image_format in ('JPEG', 'BMP') and img.mode not in ('RGB', 'L'):
+                        img = img.convert('RGB')
+                    img.save(temp_png_path, format=image_format)
                     target_path = temp_png_path
-                    logger.info(f"Saved temporary PNG to {target_path}")
+                    logger.info(f"Saved temporary {image_format} to {target_path}")
         except Exception as e:
             logger.error(f"Error processing image format: {e}")
             # Fallback to original path if processing fails
             target_path = abs_path
 
         # 2. Set to Clipboard
+        missing = _clipboard_tool_missing()
+        if missing:
+            logger.error(f"set_clipboard_image: {missing}")
+            return False, None
+        if _is_wayland():
+            # wl-copy 会自行转入后台持有剪贴板，不需要调用方管理进程
+            with open(target_path, 'rb') as f:
+                result = _runner.run(['wl-copy', '--type', mime], stdin=f, capture_output=True, timeout=5)
+            if result.returncode != 0:
+                logger.error(f"set_clipboard_image: wl-copy failed - {result.stderr.decode(errors='replace')}")
+                return False, None
+            logger.info(f"set_clipboard_image: {target_path} -> Success (wl-copy)")
+            return True, None
+        
         # Command: xclip -selection clipboard -t image/png -i /path/to/file
-        cmd = ['xclip', '-selection', 'clipboard', '-t', 'image/png', '-i', target_path]
+        cmd = ['xclip', '-selection', 'clipboard', '-t', mime, '-i', target_path]
         
         env = {**os.environ, 'DISPLAY': os.getenv('DISPLAY', ':0')}
         
         # xclip stays running to serve the selection. We must NOT wait for it to exit.
-        process = subprocess.Popen(
+        process = _runner.popen(
             cmd,
             stdout=subprocess.PIPE,
             stderr=subprocess.PIPE,
@@ -603,6 +1997,77 @@ def set_clipboard_image(image_path: str) -> Tuple[bool, Optional[subprocess.Pope
                 pass
 
 
+def _clipboard_offers(mime: str) -> Optional[bool]:
+    """
+    剪贴板当前是否提供 mime 类型（xclip -o -t TARGETS / wl-paste --list-types）。
+
+    Returns:
+        True / False；检查工具不可用或无法执行时返回 None
+    """
+    cmd = ['wl-paste', '--list-types'] if _is_wayland() else ['xclip', '-selection', 'clipboard', '-o', '-t', 'TARGETS']
+    if not shutil.which(cmd[0]):
+        return None
+    try:
+        result = _runner.run(cmd, capture_output=True, text=True, timeout=2)
+    except Exception as e:
+        logger.debug(f"_clipboard_offers: {cmd[0]} 执行失败: {e}")
+        return None
+    # 剪贴板还没有所有者时 xclip 以非 0 退出，视为未就绪
+    return result.returncode == 0 and mime in result.stdout.split()
+
+
+def _wait_clipboard_type(mime: str, timeout: float = 1.0) -> Optional[bool]:
+    """轮询直到剪贴板提供 mime 类型，返回是否就绪；无法检查时返回 None。"""
+    deadline = time.time() + timeout
+    while True:
+        ready = _clipboard_offers(mime)
+        if ready is None or ready or time.time() >= deadline:
+            return ready
+        time.sleep(0.1)
+
+
+def set_clipboard_image(image_path: str) -> Tuple[bool, Optional[subprocess.Popen]]:
+    """
+    Copy image to clipboard using xclip directly (wl-copy on Wayland).
+    Transcodes the image to CLIPBOARD_IMAGE_MIME (default image/png) before copying.
+    Dependencies: xclip or wl-clipboard, pillow
+    
+    设置后确认剪贴板确实提供了该图片类型再返回，避免负载高时在剪贴板就绪前粘贴而丢图；
+    未就绪时重新设置，最多 CLIPBOARD_IMAGE_RETRIES 次（默认 3）。
+    没有 xclip / wl-paste 可用于检查时退回固定等待。
+    
+    Args:
+        image_path: Path to the image file
+        
+    Returns:
+        Tuple[bool, Optional[subprocess.Popen]]: (Success, Process object if running)
+        NOTE: If successful, the xclip process is returned and MUST be terminated
+              by the caller after pasting is complete to release the clipboard.
+    """
+    mime = _clipboard_image_mime()
+    attempts = max(1, _env_int("CLIPBOARD_IMAGE_RETRIES", 3))
+    for attempt in range(1, attempts + 1):
+        success, process = _set_clipboard_image_once(image_path)
+        if not success:
+            return False, None
+        ready = _wait_clipboard_type(mime)
+        if ready is None:
+            time.sleep(0.3)
+            return True, process
+        if ready:
+            return True, process
+        if attempt == attempts:
+            logger.warning(f"set_clipboard_image: 重试 {attempts} 次后剪贴板仍未提供 {mime}，仍尝试粘贴")
+            return True, process
+        logger.warning(f"set_clipboard_image: 剪贴板未提供 {mime}，重新设置 ({attempt}/{attempts})")
+        if process:
+            try:
+                process.terminate()
+                process.wait(timeout=1)
+            except Exception:
+                pass
+
+
 def find_image(
     image_path: str,
     confidence: float = 0.8,
@@ -620,24 +2085,18 @@ def find_image(
         Tuple of (x, y) center coordinates if found, None otherwise
     """
     _ensure_pyautogui()
+    if region is None:
+        region = _capture_region()
     try:
         if not os.path.exists(image_path):
             logger.error(f"Template image not found: {image_path}")
             return None
-            
-        # Try with confidence (requires opencv)
-        try:
-            location = pyautogui.locateCenterOnScreen(
-                image_path,
-                confidence=confidence,
-                region=region
-            )
-        except pyautogui.ImageNotFoundException:
-            location = None
-            
+        
+        capture_predelay()
+        location = locate_center_on_screen(image_path, confidence, region)
         if location:
-            logger.info(f"Found {image_path} at ({location.x}, {location.y})")
-            return (location.x, location.y)
+            logger.info(f"Found {image_path} at {location}")
+            return location
         else:
             logger.debug(f"Image not found on screen: {image_path}")
             return None
@@ -647,60 +2106,342 @@ def find_image(
         return None
 
 
-def find_and_click(
-    image_path: str,
-    confidence: float = 0.8,
-    offset: Tuple[int, int] = (0, 0)
-) -> Tuple[bool, str]:
+def best_match_on_screen(
+    image_path: str,
+    region: Optional[Tuple[int, int, int, int]] = None
+) -> Optional[Tuple[float, Tuple[int, int]]]:
+    """
+    Score the template against the current screen regardless of threshold.
+    
+    Returns:
+        (score 0.0-1.0, center) of the best candidate, or None if it can't be computed
+    """
+    if region is None:
+        region = _capture_region()
+    try:
+        return _best_match(image_path, region)
+    except Exception as e:
+        logger.debug(f"best_match_on_screen failed for {image_path}: {e}")
+        return None
+
+
+def _best_match(
+    image_path: str,
+    region: Optional[Tuple[int, int, int, int]]
+) -> Optional[Tuple[float, Tuple[int, int]]]:
+    """best_match_on_screen 的实现；截屏失败时抛出异常，供需要区分“未找到”和“截屏失败”的调用方使用。"""
+    import cv2
+    import numpy as np
+    
+    grayscale = _match_grayscale()
+    template, mask = _read_template(image_path, grayscale)
+    if template is None:
+        return None
+    screen = cv2.cvtColor(
+        np.array(_grab_screen(region=region)),
+        cv2.COLOR_RGB2GRAY if grayscale else cv2.COLOR_RGB2BGR,
+    )
+    th, tw = template.shape[:2]
+    if th > screen.shape[0] or tw > screen.shape[1]:
+        return None
+    scores = _match_template(screen, template, mask)
+    _, max_val, _, max_loc = cv2.minMaxLoc(scores)
+    offset_x, offset_y = (region[0], region[1]) if region else (0, 0)
+    center = (int(offset_x + max_loc[0] + tw // 2), int(offset_y + max_loc[1] + th // 2))
+    return max(0.0, float(max_val)), center
+
+
+def find_all_on_screen(
+    image_path: str,
+    confidence: float = 0.8,
+    region: Optional[Tuple[int, int, int, int]] = None,
+    max_results: int = 10
+) -> List[Tuple[float, Tuple[int, int]]]:
+    """
+    Find every non-overlapping match of the template above the threshold.
+    
+    Matches are taken best-first; after each pick, the template-sized
+    neighbourhood around it is suppressed so adjacent pixels of the same
+    button are not reported twice.
+    
+    Returns:
+        [(score 0.0-1.0, center), ...] sorted by score, best first
+    """
+    if region is None:
+        region = _capture_region()
+    try:
+        import cv2
+        import numpy as np
+        
+        grayscale = _match_grayscale()
+        template, mask = _read_template(image_path, grayscale)
+        if template is None:
+            return []
+        screen = cv2.cvtColor(
+            np.array(_grab_screen(region=region)),
+            cv2.COLOR_RGB2GRAY if grayscale else cv2.COLOR_RGB2BGR,
+        )
+        th, tw = template.shape[:2]
+        if th > screen.shape[0] or tw > screen.shape[1]:
+            return []
+        scores = _match_template(screen, template, mask)
+    except Exception as e:
+        logger.debug(f"find_all_on_screen failed for {image_path}: {e}")
+        return []
+    
+    offset_x, offset_y = (region[0], region[1]) if region else (0, 0)
+    matches = []
+    while len(matches) < max_results:
+        _, max_val, _, (x, y) = cv2.minMaxLoc(scores)
+        if max_val < confidence:
+            break
+        matches.append((float(max_val), (int(offset_x + x + tw // 2), int(offset_y + y + th // 2))))
+        # 抑制以该匹配为中心、模板大小范围内的所有候选位置，保证结果互不重叠
+        scores[max(0, y - th + 1):y + th, max(0, x - tw + 1):x + tw] = -1.0
+    return matches
+
+
+def find_and_click(
+    image_path: str,
+    confidence: Optional[float] = None,
+    offset: Optional[Tuple[int, int]] = None,
+    button: Optional[int] = None,
+    workflow_id: Optional[str] = None
+) -> Tuple[bool, str]:
+    """
+    Find an image on screen and click it.
+    
+    On failure the debug message includes the best candidate's 0-100 score and
+    location (only with MATCH_DIAGNOSTICS=1, since it costs an extra full-screen
+    match), to tell a stale template (close score) from an element that is
+    simply not on screen (low score).
+    
+    Args:
+        image_path: Path to the template image
+        confidence: Match confidence threshold; defaults to MATCH_CONFIDENCE (0.8)
+        offset: (x, y) offset from the matched center; defaults to the
+                template's JSON click_offset, then (0, 0). Clamped to stay
+                inside the template
+        button: Mouse button (1=left, 2=middle, 3=right); defaults to the
+                template's JSON config, then left click
+        workflow_id: ID of the calling workflow, used to keep the OCR
+                fallback's temporary screenshot apart from concurrent workflows
+        
+    Returns:
+        Tuple of (success, debug_message)
+    """
+    cwd = os.getcwd()
+    display = os.getenv('DISPLAY', 'not set')
+    debug_msg = f"CWD: {cwd}, DISPLAY: {display}. "
+    if confidence is None:
+        confidence = _env_float("MATCH_CONFIDENCE", 0.8)
+    
+    location = find_image(image_path, confidence)
+    if location and not _confirm_match(image_path, (int(location[0]), int(location[1])), confidence):
+        debug_msg += f"Image '{image_path}' matched once but not on the confirmation screenshot."
+        return False, debug_msg
+    
+    if location:
+        click_x, click_y = _click_point(image_path, (int(location[0]), int(location[1])), offset)
+        if _env_flag("DRY_RUN"):
+            logger.info(f"DRY_RUN: Found {image_path}, would click at ({click_x}, {click_y})")
+            return True, f"DRY_RUN: would click ({click_x}, {click_y})"
+        
+        logger.info(f"Found {image_path}, clicking at ({click_x}, {click_y})")
+        
+        click_at(click_x, click_y, _template_button(image_path, button), settle=0.1)
+        
+        return True, "Success"
+    else:
+        location = _ocr_fallback_click(image_path, button, workflow_id)
+        if location:
+            return True, f"OCR fallback @ {location}"
+        debug_msg += f"Image '{image_path}' not found on screen."
+        # 最佳候选需要额外截屏并做一次全屏匹配，只在 MATCH_DIAGNOSTICS=1 时计算
+        best = best_match_on_screen(image_path) if _env_flag("MATCH_DIAGNOSTICS") else None
+        if best:
+            score, (best_x, best_y) = best
+            debug_msg += (
+                f" Best match {round(score * 100)}/100 @ ({best_x}, {best_y}),"
+                f" threshold {round(confidence * 100)}."
+            )
+        return False, debug_msg
+
+
+def paste_and_submit(templates_dir: Optional[str] = None):
+    """Perform Ctrl+V then Enter keystrokes."""
+    _ensure_pyautogui()
+    logger.info("PasteAndSubmit: Sending Ctrl+V...")
+    press_keys('ctrl', 'v')
+    time.sleep(0.2)
+    
+    logger.info("PasteAndSubmit: Sending Enter...")
+    submit_input(templates_dir)
+
+
+def _input_box_region(templates_dir: str) -> Optional[Tuple[int, int, int, int]]:
+    """输入框周围约 600x120 的区域；找不到输入框时返回 None（调用方按整屏处理）。"""
+    try:
+        # 有文字时输入框外观会变，用较低置信度定位大致位置
+        location = locate_center_on_screen(
+            os.path.join(_ensure_templates(templates_dir), "input_box.png"), 0.6
+        )
+    except Exception as e:
+        logger.debug(f"_input_box_region: 定位输入框失败: {e}")
+        return None
+    if not location:
+        return None
+    screen_w, screen_h = pyautogui.size()
+    left, top = max(0, location[0] - 300), max(0, location[1] - 60)
+    return (left, top, min(600, screen_w - left), min(120, screen_h - top))
+
+
+def ocr_region_text(region: Optional[Tuple[int, int, int, int]], workflow_id: Optional[str] = None) -> Optional[str]:
+    """
+    用 tesseract 识别屏幕区域（None 为整屏）中的文字；tesseract 不可用或失败时返回 None。
+
+    识别语言取 TESSERACT_LANG（默认 chi_sim+eng，需要安装 tesseract-ocr-chi-sim）。
+    """
+    image_path = _temp_image_path("ocr_region", workflow_id)
+    lang = os.getenv('TESSERACT_LANG', '').strip() or 'chi_sim+eng'
+    try:
+        _grab_screen(region=region).save(image_path)
+        result = _runner.run(['tesseract', image_path, 'stdout', '-l', lang], capture_output=True, text=True, timeout=30)
+    except FileNotFoundError:
+        logger.error("ocr_region_text: 未安装 tesseract (apt install tesseract-ocr)")
+        return None
+    except Exception as e:
+        logger.error(f"ocr_region_text 错误: {e}")
+        return None
+    finally:
+        try:
+            os.remove(image_path)
+        except OSError:
+            pass
+    if result.returncode != 0:
+        logger.error(f"ocr_region_text: tesseract 失败 {result.stderr.strip()[:200]}")
+        return None
+    return result.stdout
+
+
+_CJK_RUN = re.compile(r'[\u3400-\u4dbf\u4e00-\u9fff\uf900-\ufaff]+')
+
+
+def _paste_tokens(text: str) -> List[str]:
+    """
+    从提示词首尾各 200 字符中取出用于比对 OCR 结果的片段（均为小写）。
+
+    英文/数字取长度 >= 4 的单词；中文没有空格分词，按连续汉字每 4 个字切一段，
+    不足 4 个字的短句（>= 2 个字）整段使用。都没有时退回长度 >= 2 的英文/数字单词。
+    """
+    sample = text[:200] + " " + text[-200:]
+    tokens = set(re.findall(r'[A-Za-z0-9]{4,}', sample))
+    for run in _CJK_RUN.findall(sample):
+        if len(run) < 4:
+            if len(run) >= 2:
+                tokens.add(run)
+            continue
+        tokens.update(run[i:i + 4] for i in range(0, len(run) - 3, 4))
+    if not tokens:
+        tokens = set(re.findall(r'[A-Za-z0-9]{2,}', sample))
+    return sorted(token.lower() for token in tokens)
+
+
+def _paste_landed(templates_dir: str, text: str, workflow_id: Optional[str] = None) -> Optional[bool]:
+    """
+    OCR 输入框区域，检查刚粘贴的文字是否出现。
+
+    输入框可能只显示开头或结尾，识别结果中出现 _paste_tokens 的任意一段即视为粘贴成功。
+    tesseract 常在汉字之间插入空格，比较前去掉识别结果中的空白。
+    无法判断（没有可比对的片段、找不到输入框、OCR 不可用）时返回 None，调用方不应当作成功；
+    找不到输入框时不退回整屏识别，聊天记录里的同样文字会造成误判。
+    """
+    tokens = _paste_tokens(text)
+    if not tokens:
+        logger.warning("_paste_landed: 提示词中没有可用于比对的文字")
+        return None
+    region = _input_box_region(templates_dir)
+    if region is None:
+        logger.warning("_paste_landed: 找不到输入框，无法确认粘贴结果")
+        return None
+    recognized = ocr_region_text(region, workflow_id)
+    if recognized is None:
+        return None
+    recognized = re.sub(r'\s+', '', recognized).lower()
+    return any(token in recognized for token in tokens)
+
+
+def _verify_paste(
+    templates_dir: str,
+    text: str,
+    send_status: Callable[[str], None],
+    result: "WorkflowResult",
+    window_title: Optional[str],
+    select_all: bool,
+    workflow_id: Optional[str] = None
+) -> bool:
+    """
+    VERIFY_PASTE=1 时，提交前用 OCR 确认提示词确实粘贴进了输入框，避免剪贴板竞争导致提交空消息。
+
+    未识别到时重新复制、点击输入框并粘贴一次（select_all 时先全选，替换而不是追加）；
+    仍未识别到返回 False，调用方应取消提交。
     """
-    Find an image on screen and click it.
-    
-    Args:
-        image_path: Path to the template image
-        confidence: Match confidence threshold
-        offset: (x, y) offset from found position
-        
-    Returns:
-        Tuple of (success, debug_message)
+    if not _env_flag("VERIFY_PASTE") or not text:
+        return True
+    for attempt in range(2):
+        landed = _paste_landed(templates_dir, text, workflow_id)
+        if landed is None:
+            send_status("⚠️ 无法确认提示词已粘贴（找不到输入框或 OCR 不可用），已取消提交，请检查 IDE。")
+            return False
+        if landed:
+            return True
+        if attempt == 1:
+            break
+        logger.warning("_verify_paste: 输入框中未识别到粘贴的文字，重新粘贴一次")
+        send_status("⚠️ 输入框中未识别到刚粘贴的提示词，重新粘贴一次...")
+        if not set_clipboard(text):
+            break
+        success, _ = _timed_click_input_box(result, templates_dir, window_title, workflow_id)
+        if not success:
+            break
+        time.sleep(0.3)
+        if select_all:
+            press_keys('ctrl', 'a')
+        press_keys('ctrl', 'v')
+        time.sleep(0.5)
+    send_status("⚠️ 重新粘贴后仍未在输入框中识别到提示词，已取消提交，请检查 IDE。")
+    return False
+
+
+def submit_input(templates_dir: Optional[str] = None) -> bool:
     """
-    cwd = os.getcwd()
-    display = os.getenv('DISPLAY', 'not set')
-    debug_msg = f"CWD: {cwd}, DISPLAY: {display}. "
-    
-    location = find_image(image_path, confidence)
-    
-    if location:
-        click_x = location[0] + offset[0]
-        click_y = location[1] + offset[1]
-        
-        logger.info(f"Found {image_path}, clicking at ({click_x}, {click_y})")
-        
-        try:
-            import subprocess
-            subprocess.run(['xdotool', 'mousemove', str(int(click_x)), str(int(click_y))], check=True)
-            time.sleep(0.1)
-            subprocess.run(['xdotool', 'click', '1'], check=True)
-        except Exception as e:
-            logger.warning(f"xdotool click failed: {e}. Falling back to pyautogui.")
-            pyautogui.moveTo(click_x, click_y)
-            time.sleep(0.1)
-            pyautogui.click()
-        
-        return True, "Success"
-    else:
-        debug_msg += f"Image '{image_path}' not found on screen."
-        return False, debug_msg
+    按 Enter 提交输入框内容。
 
+    VERIFY_SUBMIT=1 时比较提交前后输入框区域（找不到输入框时比较整屏）的截图：
+    内容提交后输入框会被清空，画面完全没变说明 Enter 没生效，补按一次。
 
-def paste_and_submit():
-    """Perform Ctrl+V then Enter keystrokes."""
+    Returns:
+        False 如果开启了校验且补按后画面仍无变化
+    """
     _ensure_pyautogui()
-    logger.info("PasteAndSubmit: Sending Ctrl+V...")
-    pyautogui.hotkey('ctrl', 'v')
-    time.sleep(0.2)
-    
-    logger.info("PasteAndSubmit: Sending Enter...")
-    pyautogui.press('return')
+    if not _env_flag("VERIFY_SUBMIT"):
+        press_keys('return')
+        return True
+
+    from PIL import ImageChops
+    region = _input_box_region(templates_dir) if templates_dir else None
+
+    before = _grab_screen(region=region)
+    for attempt in range(2):
+        press_keys('return')
+        time.sleep(1.0)
+        after = _grab_screen(region=region)
+        if ImageChops.difference(before.convert('RGB'), after.convert('RGB')).getbbox() is not None:
+            return True
+        if attempt == 0:
+            logger.warning("submit_input: 按 Enter 后输入框没有变化，重试一次")
+    logger.warning("submit_input: 重试后输入框仍无变化，提交可能未生效")
+    return False
 
 
 def handle_model_switch(templates_dir: str, reply_event=None, send_status: Optional[Callable[[str], None]] = None) -> str:
@@ -744,34 +2485,28 @@ def handle_model_switch(templates_dir: str, reply_event=None, send_status: Optio
 
     # 查找 panel-ClaudeOpus.png（全屏，confidence=0.8）
     for conf in [0.8]:
-        try:
-            loc = pyautogui.locateCenterOnScreen(panel_opus, confidence=conf)
-            if loc:
-                found_panel = "opus"
-                panel_loc = (int(loc.x), int(loc.y))
-                logger.info(f"✅ 找到 panel-ClaudeOpus.png @ {panel_loc}, confidence={conf}")
-                break
-        except pyautogui.ImageNotFoundException:
-            pass
+        loc = locate_center_on_screen(panel_opus, conf)
+        if loc:
+            found_panel = "opus"
+            panel_loc = loc
+            logger.info(f"✅ 找到 panel-ClaudeOpus.png @ {panel_loc}, confidence={conf}")
+            break
 
     # 查找 panel-Gemini.png（全屏，confidence=0.8）
     if not found_panel:
         for conf in [0.8]:
-            try:
-                loc = pyautogui.locateCenterOnScreen(panel_gemini, confidence=conf)
-                if loc:
-                    found_panel = "gemini"
-                    panel_loc = (int(loc.x), int(loc.y))
-                    logger.info(f"✅ 找到 panel-Gemini.png @ {panel_loc}, confidence={conf}")
-                    break
-            except pyautogui.ImageNotFoundException:
-                pass
+            loc = locate_center_on_screen(panel_gemini, conf)
+            if loc:
+                found_panel = "gemini"
+                panel_loc = loc
+                logger.info(f"✅ 找到 panel-Gemini.png @ {panel_loc}, confidence={conf}")
+                break
         
     if not found_panel:
         logger.warning("❌ 全屏查找均未找到面板")
         try:
             screenshot_path = os.path.join(os.getcwd(), "failed_find_panel.png")
-            pyautogui.screenshot().save(screenshot_path)
+            _grab_screen().save(screenshot_path)
             logger.info(f"✅ 已保存现场截图至: {screenshot_path}")
         except Exception as e:
             logger.error(f"❌ 现场截图保存失败: {e}")
@@ -803,14 +2538,11 @@ def handle_model_switch(templates_dir: str, reply_event=None, send_status: Optio
     # 全屏查找目标模型（confidence=0.8，与 debug 脚本一致）
     target_loc = None
     for conf in [0.8]:
-        try:
-            loc = pyautogui.locateCenterOnScreen(target_img, confidence=conf)
-            if loc:
-                target_loc = (int(loc.x), int(loc.y))
-                logger.info(f"✅ 找到 {os.path.basename(target_img)} @ {target_loc}, confidence={conf}")
-                break
-        except pyautogui.ImageNotFoundException:
-            pass
+        loc = locate_center_on_screen(target_img, conf)
+        if loc:
+            target_loc = loc
+            logger.info(f"✅ 找到 {os.path.basename(target_img)} @ {target_loc}, confidence={conf}")
+            break
 
     if not target_loc:
         logger.error(f"❌ 未找到 {os.path.basename(target_img)}，流程中断")
@@ -827,9 +2559,9 @@ def handle_model_switch(templates_dir: str, reply_event=None, send_status: Optio
     time.sleep(1)
     set_clipboard("continue")
     time.sleep(0.2)
-    pyautogui.hotkey('ctrl', 'v')
+    press_keys('ctrl', 'v')
     time.sleep(0.3)
-    pyautogui.press('return')
+    press_keys('return')
     logger.info("✅ continue 已提交")
 
     # 7. 发送 TG 通知
@@ -840,7 +2572,7 @@ def handle_model_switch(templates_dir: str, reply_event=None, send_status: Optio
     return f"SWITCHED:{target_name}"
 
 
-def _check_retry(templates_dir: str) -> bool:
+def _check_retry(templates_dir: str, workflow_id: Optional[str] = None) -> bool:
     """
     检查并点击 Retry 按钮（IDE 网络断开时弹出）。
     
@@ -849,96 +2581,481 @@ def _check_retry(templates_dir: str) -> bool:
     """
     templates_dir = _ensure_templates(templates_dir)
     retry_img = os.path.join(templates_dir, "Retry.png")
-    success, debug_info = find_and_click(retry_img, confidence=0.8, offset=(0, 0))
+    success, debug_info = find_and_click(retry_img, workflow_id=workflow_id)
     if success:
         logger.info(f"_check_retry: Retry 按钮已点击: {debug_info}")
         return True
     return False
 
 
+class AutomationState(str, Enum):
+    """GUI 自动化当前所处阶段，供 /status 查询。"""
+    IDLE = "idle"
+    PASTING = "pasting"
+    MONITORING = "monitoring"
+
+
+_state_lock = threading.Lock()
+_state = AutomationState.IDLE
+_state_since = time.time()
+
+
+def _set_state(state: AutomationState):
+    global _state, _state_since
+    with _state_lock:
+        if _state != state:
+            _state, _state_since = state, time.time()
+
+
+def get_automation_state() -> Tuple[AutomationState, float]:
+    """返回 (当前状态, 已处于该状态的秒数)。"""
+    with _state_lock:
+        return _state, time.time() - _state_since
+
+
+class WorkflowQueue:
+    """
+    GUI 工作流的 FIFO 队列。
+
+    所有工作流共用同一个 X 会话（剪贴板、鼠标、键盘），交错执行会互相破坏输入，
+    因此由单个工作线程按提交顺序逐个执行；调用方可以从任意线程并发提交。
+    """
+
+    def __init__(self):
+        self._jobs = queue.Queue()
+        self._lock = threading.Lock()
+        self._outstanding = 0  # 已提交但尚未结束的工作流数（含正在执行的）
+        self._worker: Optional[threading.Thread] = None
+
+    def submit(self, func: Callable, *args, **kwargs) -> Tuple[Future, int]:
+        """
+        提交工作流 func(*args, **kwargs)。
+
+        Returns:
+            (future, ahead): future.result() 为 func 的返回值；ahead 为排在前面
+            （含正在执行）的工作流数，0 表示立即开始执行
+        """
+        future = Future()
+        with self._lock:
+            ahead = self._outstanding
+            self._outstanding += 1
+            self._jobs.put((future, func, args, kwargs))
+            if self._worker is None:
+                self._worker = threading.Thread(target=self._work, name="gui-workflow", daemon=True)
+                self._worker.start()
+        return future, ahead
+
+    def pending(self) -> int:
+        """已提交但尚未结束的工作流数（含正在执行的）。"""
+        with self._lock:
+            return self._outstanding
+
+    def _work(self):
+        while True:
+            future, func, args, kwargs = self._jobs.get()
+            result, error = None, None
+            if future.set_running_or_notify_cancel():
+                try:
+                    result = func(*args, **kwargs)
+                except Exception as e:
+                    error = e
+            # 先更新计数再通知调用方，等待结果的线程随后提交时看到的排队位置是准确的
+            with self._lock:
+                self._outstanding -= 1
+            if future.cancelled():
+                continue
+            if error is not None:
+                future.set_exception(error)
+            else:
+                future.set_result(result)
+
+
+_workflow_queue = WorkflowQueue()
+
+
+def submit_workflow(func: Callable, *args, **kwargs) -> Tuple[Future, int]:
+    """把工作流放入全局 GUI 队列，返回 (future, 前面的工作流数)，见 WorkflowQueue.submit。"""
+    return _workflow_queue.submit(func, *args, **kwargs)
+
+
+# 找不到输入框时的现场截图文件名前缀，完整路径带工作流 ID（见 _save_failure_screenshot）
+FAILURE_SCREENSHOT_PREFIX = "antigravity_failure_screenshot"
+
+
+@dataclass
+class WorkflowResult:
+    """
+    一次 GUI 工作流的结构化结果，供日志、审计和统计使用。
+    
+    error_code 为 None 表示成功；否则为简短的机器可读错误码，
+    如 window_not_active / clipboard_failed / input_box_not_found / timeout / quota_exhausted / screenshot_failed。
+    """
+    success: bool = False
+    error_code: Optional[str] = None
+    found_input_box: bool = False
+    replying_appeared: bool = False
+    accept_clicks: int = 0
+    duration: float = 0.0  # 秒
+    # 各阶段耗时（秒），用于 SHOW_TIMINGS 性能诊断
+    input_box_time: float = 0.0  # 查找并点击输入框（多次点击累计）
+    paste_time: float = 0.0  # 其余准备、粘贴和提交
+    replying_wait_time: Optional[float] = None  # 提交后到 Replying 首次出现，未出现为 None
+    monitor_time: float = 0.0  # 监控阶段总时长
+    # FAILURE_SCREENSHOT=1 时，找不到输入框那一刻的屏幕截图路径
+    failure_screenshot: Optional[str] = None
+    
+    def fail(self, error_code: str) -> "WorkflowResult":
+        self.success = False
+        self.error_code = error_code
+        return self
+    
+    def timing_summary(self) -> str:
+        """单行耗时明细，如“总计 42.1s | 输入框 0.8s | 粘贴提交 1.2s | 等待 Replying 2.0s | 监控 38.0s | Accept 2 次”。"""
+        replying = f"{self.replying_wait_time:.1f}s" if self.replying_wait_time is not None else "未出现"
+        return (
+            f"总计 {self.duration:.1f}s | 输入框 {self.input_box_time:.1f}s | 粘贴提交 {self.paste_time:.1f}s | "
+            f"等待 Replying {replying} | 监控 {self.monitor_time:.1f}s | Accept {self.accept_clicks} 次"
+        )
+
+
+@dataclass
+class MonitorOptions:
+    """
+    monitor_process 的超时与轮询参数，默认值即历史硬编码值。
+
+    from_env() 从 MONITOR_* 环境变量读取，便于按机器性能和模型速度调整：
+    生成很长的回复可调大 safety_timeout，回复很快时可调小 appear_timeout。
+    """
+    safety_timeout: float = 300.0  # 总超时（秒），超过后记为 timeout
+    appear_timeout: float = 5.0  # 阶段 1 等待 Replying 出现的秒数
+    poll_interval: float = 1.0  # 阶段 2 检测 Replying 的间隔（秒）
+    heartbeat_interval: float = 10.0  # 阶段 2 心跳消息 + Accept 检测间隔（秒）
+    max_not_found: int = 3  # Replying 连续不可见多少次视为消失
+    max_capture_errors: int = 3  # 连续多少次截屏失败后放弃监控
+    max_accept_clicks: int = 5  # 每次 Accept 检测最多点击的按钮数
+
+    @classmethod
+    def from_env(cls) -> "MonitorOptions":
+        return cls(
+            safety_timeout=max(1.0, _env_float("MONITOR_SAFETY_TIMEOUT_S", cls.safety_timeout)),
+            appear_timeout=max(0.0, _env_float("MONITOR_APPEAR_TIMEOUT_S", cls.appear_timeout)),
+            poll_interval=max(0.1, _env_float("MONITOR_POLL_INTERVAL_S", cls.poll_interval)),
+            heartbeat_interval=max(1.0, _env_float("MONITOR_HEARTBEAT_INTERVAL_S", cls.heartbeat_interval)),
+            max_not_found=max(1, _env_int("MONITOR_MAX_NOT_FOUND", cls.max_not_found)),
+            max_capture_errors=max(1, _env_int("MONITOR_MAX_CAPTURE_ERRORS", cls.max_capture_errors)),
+            max_accept_clicks=max(1, _env_int("MONITOR_MAX_ACCEPT_CLICKS", cls.max_accept_clicks)),
+        )
+
+
+class _AnyEvent:
+    """把多个 threading.Event 组合为一个：任意一个被 set 即视为 set（只实现 is_set）。"""
+
+    def __init__(self, *events):
+        self._events = [event for event in events if event is not None]
+
+    def is_set(self) -> bool:
+        return any(event.is_set() for event in self._events)
+
+
+def _check_cancelled(cancel_event, send_status: Optional[Callable[[str], None]], result: WorkflowResult) -> bool:
+    """cancel_event 已被 set（用户 /cancel）时记录 cancelled 并通知用户，返回 True。"""
+    if cancel_event is None or not cancel_event.is_set():
+        return False
+    logger.info("工作流已被用户取消")
+    result.fail("cancelled")
+    if send_status:
+        send_status("🛑 已取消当前 GUI 任务")
+    return True
+
+
+def _timed_click_input_box(
+    result: WorkflowResult,
+    templates_dir: str,
+    window_title: Optional[str],
+    workflow_id: Optional[str] = None
+) -> Tuple[bool, str]:
+    """
+    click_input_box 并把耗时累计到 result.input_box_time。
+
+    IDE 获得焦点后输入框常需要片刻才渲染完成，失败时按 CLICK_RETRIES（默认 3 次）重试，
+    第 n 次重试前等待 n × CLICK_RETRY_DELAY_MS（默认 500 毫秒）；全部失败时返回每次的调试信息。
+    """
+    start = time.time()
+    attempts = max(1, _env_int("CLICK_RETRIES", 3))
+    delay = max(0, _env_int("CLICK_RETRY_DELAY_MS", 500)) / 1000.0
+    debug_infos = []
+    try:
+        for attempt in range(1, attempts + 1):
+            success, debug_info = click_input_box(templates_dir, window_title=window_title)
+            if success:
+                return success, debug_info
+            debug_infos.append(f"[{attempt}/{attempts}] {debug_info}")
+            if attempt < attempts:
+                logger.info(f"click_input_box 第 {attempt} 次失败，{delay * attempt:.1f} 秒后重试: {debug_info}")
+                time.sleep(delay * attempt)
+        _save_failure_screenshot(result, workflow_id)
+        return False, " ".join(debug_infos)
+    finally:
+        result.input_box_time += time.time() - start
+
+
+def _save_failure_screenshot(result: WorkflowResult, workflow_id: Optional[str] = None):
+    """
+    FAILURE_SCREENSHOT=1 时把当前屏幕保存到 /tmp/antigravity_failure_screenshot_<workflow_id>.png
+    并记到 result 上，由主程序发给用户确认 IDE 实际画面后删除。路径带工作流 ID，
+    并发工作流不会互相覆盖。默认关闭，因为截图可能包含敏感内容。
+    """
+    if not _env_flag("FAILURE_SCREENSHOT"):
+        return
+    path = _temp_image_path(FAILURE_SCREENSHOT_PREFIX, workflow_id)
+    ok, error = take_screenshot(path)
+    if ok:
+        result.failure_screenshot = path
+    else:
+        logger.warning(f"失败现场截图失败: {error}")
+
+
+def _timed_monitor(result: WorkflowResult, start_time: float, *args, **kwargs):
+    """记录粘贴提交耗时后运行 monitor_process，并记录监控时长。"""
+    result.paste_time = max(0.0, time.time() - start_time - result.input_box_time)
+    monitor_start = time.time()
+    try:
+        monitor_process(*args, result=result, **kwargs)
+    finally:
+        result.monitor_time = time.time() - monitor_start
+
+
+class _FreezeDetector:
+    """检测整屏像素在一段时间内完全不变（IDE 可能卡死）。"""
+
+    def __init__(self, threshold_seconds: float):
+        self.threshold_seconds = threshold_seconds
+        self._last_frame = None
+        self._unchanged_since = time.time()
+        self.reported = False
+
+    def check(self) -> Optional[float]:
+        """截一帧并与上一帧比较；画面冻结超过阈值时返回已冻结的秒数（每次冻结只返回一次）。"""
+        from PIL import ImageChops
+        try:
+            frame = _grab_screen()
+        except Exception as e:
+            logger.debug(f"_FreezeDetector: 截图失败: {e}")
+            return None
+
+        now = time.time()
+        if self._last_frame is None or self._last_frame.size != frame.size \
+                or ImageChops.difference(self._last_frame, frame).getbbox() is not None:
+            self._last_frame = frame
+            self._unchanged_since = now
+            self.reported = False
+            return None
+
+        frozen_for = now - self._unchanged_since
+        if frozen_for >= self.threshold_seconds and not self.reported:
+            self.reported = True
+            return frozen_for
+        return None
+
+
+def _wait_upload_stable(image_count: int):
+    """
+    提交前等待上传稳定。
+    
+    最长等待 UPLOAD_STABILIZE_BASE + UPLOAD_STABILIZE_PER_IMAGE × 图片数 秒（默认 1.5 + 0.5/张，
+    单张图仍为原来的 2 秒）。UPLOAD_WAIT_STABLE=1 时一旦整屏连续 1 秒无变化（上传预览已渲染完）即提前结束。
+    """
+    max_wait = max(0.0, _env_float("UPLOAD_STABILIZE_BASE", 1.5)
+                   + _env_float("UPLOAD_STABILIZE_PER_IMAGE", 0.5) * image_count)
+    logger.info(f"等待上传稳定（{image_count} 张图片，最多 {max_wait:.1f} 秒）...")
+    if not _env_flag("UPLOAD_WAIT_STABLE"):
+        time.sleep(max_wait)
+        return
+    
+    detector = _FreezeDetector(1.0)
+    deadline = time.time() + max_wait
+    while time.time() < deadline:
+        if detector.check() is not None:
+            logger.info("上传区域已稳定，提前提交")
+            return
+        time.sleep(0.2)
+
+
 def monitor_process(
     templates_dir: str,
     send_status: Optional[Callable[[str], None]] = None,
-    reply_event=None
+    reply_event=None,
+    result: Optional[WorkflowResult] = None,
+    approval_func: Optional[Callable[[str], Optional[bool]]] = None,
+    cancel_event=None,
+    options: Optional[MonitorOptions] = None,
+    workflow_id: Optional[str] = None
 ):
     """
     监控 IDE 回复过程，按三阶段模型运行：
     
-    阶段 1: 等待 Replying 出现（最多 5 秒，纯等待无监控）
-    阶段 2: Replying 可见期间（Accept + 心跳消息，每 10 秒）
-    阶段 3: Replying 消失后 3 秒缓冲，统一检测 Retry / Upgrade
+    阶段 1: 等待 Replying 出现（默认最多 5 秒，纯等待无监控）
+    阶段 2: Replying 可见期间（Accept + 心跳消息，默认每 10 秒）
+    阶段 3: Replying 消失后（默认连续 3 次不可见）统一检测 Retry / Upgrade
+    
+    各超时与间隔见 MonitorOptions，未传入 options 时从 MONITOR_* 环境变量读取。
+    
+    传入 result 时会记录 Replying 是否出现、Accept 点击次数以及超时/配额耗尽等错误码。
+    出现破坏性变更警告（destructive_warning.png）时不自动 Accept，改由 approval_func 请求人工批准。
+    AUTO_ACCEPT=0 时所有 Accept 按钮都改由 approval_func 请求人工批准。
+    cancel_event 被 set 时（用户 /cancel）尽快退出并把结果记为 cancelled。
+    workflow_id 传给点击与 OCR 回退，用于区分并发工作流的临时截图。
     """
+    if result is None:
+        result = WorkflowResult()
+    if options is None:
+        options = MonitorOptions.from_env()
     logger.info("MonitorProcess: Starting...")
-    timeout = 300  # 总超时 5 分钟
+    _set_state(AutomationState.MONITORING)
+    monitor_start = time.time()
+    timeout = options.safety_timeout
     overall_start = time.time()
     
     while time.time() - overall_start < timeout:
-        # ========== 阶段 1: 纯等待 Replying 出现（最多 5 秒） ==========
+        # ========== 阶段 1: 纯等待 Replying 出现（最多 appear_timeout 秒） ==========
         logger.info("MonitorProcess [阶段1]: 等待 Replying 出现...")
-        appeared = False
-        phase1_start = time.time()
-        
-        while time.time() - phase1_start < 5:
-            if reply_event and reply_event.is_set():
-                logger.info("MonitorProcess [阶段1]: reply_event 已 set，停止。")
-                return
-            
-            found, _ = find_replying(templates_dir)
-            if found:
-                logger.info("MonitorProcess [阶段1]: Replying 已出现！进入阶段 2。")
-                appeared = True
-                break
-            time.sleep(0.5)
+        try:
+            appeared, _ = wait_for_template(
+                templates_dir,
+                replying_frames(_ensure_templates(templates_dir)),
+                timeout=options.appear_timeout,
+                confidence=0.9,
+                region=_env_region("REPLYING_REGION"),
+                stop_event=_AnyEvent(reply_event, cancel_event),
+                max_capture_errors=options.max_capture_errors,
+            )
+        except Exception as e:
+            # 截屏失败不能当作 Replying 从未出现，否则会直接进入阶段 3 并误判为正常完成
+            logger.warning(f"MonitorProcess [阶段1]: 连续 {options.max_capture_errors} 次截屏/匹配失败: {e}")
+            if send_status:
+                send_status(f"❌ 连续 {options.max_capture_errors} 次截屏失败，停止监控: {e}\n请检查截屏工具和 DISPLAY 是否可用。")
+            result.fail("screenshot_failed")
+            return
+        if _check_cancelled(cancel_event, send_status, result):
+            return
+        if reply_event and reply_event.is_set():
+            logger.info("MonitorProcess [阶段1]: reply_event 已 set，停止。")
+            return
         
         if not appeared:
             # Replying 从未出现 → 等同于"Replying 消失"，直接进入阶段 3
-            logger.info("MonitorProcess [阶段1]: 5 秒内未见 Replying，进入阶段 3 检测。")
+            logger.info(f"MonitorProcess [阶段1]: {options.appear_timeout:g} 秒内未见 Replying，进入阶段 3 检测。")
             # 跳到阶段 3（下方）
         else:
+            logger.info("MonitorProcess [阶段1]: Replying 已出现！进入阶段 2。")
+            if result.replying_wait_time is None:
+                result.replying_wait_time = time.time() - monitor_start
+            result.replying_appeared = True
             # ========== 阶段 2: Replying 可见，IDE 正常工作中 ==========
             logger.info("MonitorProcess [阶段2]: IDE 工作中，启动 Accept + 心跳监控。")
             last_heartbeat_time = time.time()
             not_found_count = 0
+            # 截屏失败不能当作 Replying 消失，否则会误判为 IDE 已完成
+            capture_errors = 0
+            # FREEZE_DETECT_SECONDS > 0 时启用卡死检测：Replying 可见但整屏长时间无变化
+            freeze_seconds = _env_float("FREEZE_DETECT_SECONDS", 0)
+            freeze_detector = _FreezeDetector(freeze_seconds) if freeze_seconds > 0 else None
+            # 点击 Accept 后 IDE 常会开始新一轮生成，Replying 会短暂消失；
+            # 宽限期内的消失不计入完成判断
+            post_accept_grace = _env_float("POST_ACCEPT_GRACE_SECONDS", 0)
+            last_accept_time = 0.0
+            # AUTO_ACCEPT=0 时所有 Accept 都需要人工批准，默认开启以保持自动点击的行为
+            auto_accept = _env_flag("AUTO_ACCEPT", True)
+            # 同一个待批准的提示只请求一次批准，提示消失后复位
+            approval_asked = False
             
             while time.time() - overall_start < timeout:
+                if _check_cancelled(cancel_event, send_status, result):
+                    return
                 if reply_event and reply_event.is_set():
                     logger.info("MonitorProcess [阶段2]: reply_event 已 set，IDE 已回复。停止。")
                     return
                 
-                time.sleep(1)
+                time.sleep(options.poll_interval)
                 
-                found, _ = find_replying(templates_dir)
+                try:
+                    found, _ = find_replying(templates_dir, raise_errors=True)
+                except Exception as e:
+                    capture_errors += 1
+                    logger.warning(f"MonitorProcess [阶段2]: 截屏/匹配失败 ({capture_errors}/{options.max_capture_errors}): {e}")
+                    if capture_errors >= options.max_capture_errors:
+                        if send_status:
+                            send_status(f"❌ 连续 {capture_errors} 次截屏失败，停止监控: {e}\n请检查截屏工具和 DISPLAY 是否可用。")
+                        result.fail("screenshot_failed")
+                        return
+                    continue
+                capture_errors = 0
                 if found:
                     # Replying 仍然可见，复位消失计数
                     not_found_count = 0
                     
-                    # 每 10 秒：Accept 点击 + 心跳消息
-                    if time.time() - last_heartbeat_time >= 10:
+                    if freeze_detector:
+                        frozen_for = freeze_detector.check()
+                        if frozen_for is not None:
+                            logger.warning(f"MonitorProcess [阶段2]: 屏幕已 {int(frozen_for)} 秒无变化，IDE 可能卡死。")
+                            if send_status:
+                                send_status(f"⚠️ 屏幕已 {int(frozen_for)} 秒没有任何变化，IDE 可能已卡死，请检查。")
+                    
+                    # 每 heartbeat_interval 秒：Accept 点击 + 心跳消息
+                    if time.time() - last_heartbeat_time >= options.heartbeat_interval:
                         # 发送心跳消息
                         if send_status:
                             current_time = time.strftime("%H:%M:%S", time.localtime())
                             logger.info(f"MonitorProcess [阶段2]: 心跳 ({current_time})")
                             send_status(f"思考中...({current_time})")
-                        # 尝试点击 Accept 按钮
-                        success, info = click_accept_button(templates_dir)
-                        if success:
+                        # 尝试点击 Accept 按钮；破坏性变更（以及 AUTO_ACCEPT=0 时的所有修改）需要人工批准
+                        change = None
+                        if _destructive_change_visible(templates_dir):
+                            change = "破坏性变更（如删除文件）"
+                        elif not auto_accept and _accept_button_visible(templates_dir):
+                            change = "代码修改"
+                        clicks, info = 0, "无需点击"
+                        if change:
+                            info = f"{change}未批准"
+                            if not approval_asked:
+                                approval_asked = True
+                                wait_start = time.time()
+                                if _request_accept_approval(templates_dir, send_status, approval_func, change, workflow_id):
+                                    clicks, info = click_all_accept_buttons(
+                                        templates_dir, max_clicks=options.max_accept_clicks, workflow_id=workflow_id)
+                                # 等待人工批准的时间不计入总超时
+                                overall_start += time.time() - wait_start
+                        else:
+                            approval_asked = False
+                            if auto_accept:
+                                clicks, info = click_all_accept_buttons(
+                                    templates_dir, max_clicks=options.max_accept_clicks, workflow_id=workflow_id)
+                        if clicks:
                             logger.info(f"MonitorProcess [阶段2]: Accept 已点击: {info}")
+                            last_accept_time = time.time()
+                            result.accept_clicks += clicks
                         last_heartbeat_time = time.time()
                 else:
                     # Replying 不可见
+                    if post_accept_grace > 0 and time.time() - last_accept_time < post_accept_grace:
+                        logger.info("MonitorProcess [阶段2]: Replying 不可见，但仍在 Accept 后宽限期内，不计入消失。")
+                        continue
                     not_found_count += 1
-                    logger.info(f"MonitorProcess [阶段2]: Replying 不可见 ({not_found_count}/3)")
+                    logger.info(f"MonitorProcess [阶段2]: Replying 不可见 ({not_found_count}/{options.max_not_found})")
                     
-                    if not_found_count >= 3:
-                        # 消失超过 3 秒 → 进入阶段 3
-                        logger.info("MonitorProcess [阶段2]: Replying 已消失 3 秒，进入阶段 3 检测。")
+                    if not_found_count >= options.max_not_found:
+                        # 连续多次不可见 → 进入阶段 3
+                        logger.info(f"MonitorProcess [阶段2]: Replying 已连续 {not_found_count} 次不可见，进入阶段 3 检测。")
                         break
             else:
                 # 总超时退出
-                logger.warning("MonitorProcess [阶段2]: 总超时 300 秒，退出。")
+                logger.warning(f"MonitorProcess [阶段2]: 总超时 {timeout:g} 秒，退出。")
+                result.fail("timeout")
                 return
         
         # ========== 阶段 3: 关键判断点 - 统一检测 Retry / Upgrade ==========
+        if _check_cancelled(cancel_event, send_status, result):
+            return
         if reply_event and reply_event.is_set():
             logger.info("MonitorProcess [阶段3]: reply_event 已 set，停止。")
             return
@@ -946,7 +3063,7 @@ def monitor_process(
         logger.info("MonitorProcess [阶段3]: 开始检测 Retry / Upgrade...")
         
         # 3a. 检查 Retry 按钮（网络断开）
-        if _check_retry(templates_dir):
+        if _check_retry(templates_dir, workflow_id):
             logger.info("MonitorProcess [阶段3]: 发现 Retry，已点击恢复。等待 3 秒后回到阶段 1...")
             time.sleep(3)
             continue  # 回到阶段 1
@@ -971,6 +3088,7 @@ def monitor_process(
                 logger.warning("MonitorProcess [阶段3]: 切换后仍检测到 Upgrade，所有模型配额已耗尽。退出。")
                 if send_status:
                     send_status("⚠️ 所有模型配额已耗尽，停止重试。")
+                result.fail("quota_exhausted")
                 return
             else:
                 # 新模型正常工作，继续监控
@@ -987,17 +3105,76 @@ def monitor_process(
         logger.info("MonitorProcess [阶段3]: 未发现 Retry/Upgrade，IDE 正常完成工作。退出。")
         return
     
-    logger.warning("MonitorProcess: 总超时 300 秒，退出。")
+    logger.warning(f"MonitorProcess: 总超时 {timeout:g} 秒，退出。")
+    result.fail("timeout")
     
 
 
 
+def _dry_run_workflow(
+    result: WorkflowResult,
+    templates_dir: str,
+    send_status: Callable[[str], None],
+    text: str,
+    image_paths: Optional[List[str]] = None,
+    file_paths: Optional[List[str]] = None,
+    ide_mode: Optional[str] = None,
+    confidence: float = 0.8
+) -> WorkflowResult:
+    """
+    DRY_RUN=1：只做输入框模板匹配，把本应执行的点击、粘贴和提交通过 send_status 报告出来，
+    不动鼠标、键盘和剪贴板，也不激活窗口，用于安全地校准模板。
+
+    与 click_input_box 使用同一个查找路径（_locate_input_box）和置信度，
+    未找到时额外给出最佳候选的分数，便于判断是模板过期还是输入框不在屏幕上。
+    """
+    templates_dir = _ensure_templates(templates_dir)
+    lines = ["🧪 DRY_RUN：只匹配模板，不会点击、粘贴或提交"]
+    try:
+        image_path, location = _locate_input_box(templates_dir, confidence)
+    except Exception as e:
+        image_path, location = os.path.join(templates_dir, "input_box.png"), None
+        lines.append(f"输入框: 查找出错: {e}")
+    if location:
+        x, y = _input_box_click_point(image_path, location)
+        result.found_input_box = True
+        lines.append(f"输入框: 找到 @ {location}，将点击 ({x}, {y})")
+    else:
+        best = best_match_on_screen(image_path)
+        if best is None:
+            lines.append("输入框: 未找到")
+        else:
+            score, center = best
+            lines.append(
+                f"输入框: 未找到，最佳候选 {round(score * 100)}/100 @ {center}，阈值 {round(confidence * 100)}"
+            )
+    if ide_mode:
+        lines.append(f"将确认 IDE 模式为 {ide_mode}")
+    for path in image_paths or []:
+        lines.append(f"将粘贴图片 {os.path.basename(path)}")
+    for path in file_paths or []:
+        lines.append(f"将粘贴文件引用 @{path}")
+    if text:
+        lines.append(f"将粘贴 {len(text)} 个字符的文字")
+    lines.append("将按 Enter 提交" if result.found_input_box else "实际运行时会因找不到输入框而失败")
+    send_status("\n".join(lines))
+    if not result.found_input_box:
+        return result.fail("input_box_not_found")
+    result.success = True
+    return result
+
+
 def full_workflow(
     text: str,
     templates_dir: str,
     send_status: Callable[[str], None],
     confidence: float = 0.8,
-    reply_event=None
+    reply_event=None,
+    window_title: Optional[str] = None,
+    ide_mode: Optional[str] = None,
+    approval_func: Optional[Callable[[str], Optional[bool]]] = None,
+    cancel_event=None,
+    workflow_id: Optional[str] = None
 ):
     """
     执行完整的文字消息工作流:
@@ -1019,40 +3196,71 @@ def full_workflow(
         send_status: 发送状态消息的回调函数
         confidence: 图像匹配置信度
         reply_event: threading.Event, MCP 回复后 set, 停止思考中
+        window_title: 目标 IDE 窗口标题子串，指定时先激活并确认焦点
+        ide_mode: 期望的 IDE 交互模式（如 plan / act），指定时粘贴前先确认
+        approval_func: 破坏性变更的人工批准回调，返回 True/False/None（批准/拒绝/超时）
+        cancel_event: threading.Event, 用户 /cancel 时 set, 提交前取消则不提交，监控中取消则停止监控
+        workflow_id: 工作流 ID，用于区分并发工作流的临时截图文件名
+    
+    Returns:
+        WorkflowResult: 本次工作流的结构化结果
     """
     _ensure_pyautogui()
-    # 1. 复制文本到剪贴板
-    if not set_clipboard(text):
-        logger.error("Error setting clipboard")
-        send_status("错误: 无法复制到剪贴板")
-        return
-    
-    # 2. 点击输入框
-    success, debug_info = click_input_box(templates_dir)
-    if not success:
-        logger.error(f"Could not click input_box: {debug_info}")
-        send_status(f"错误: 无法点击输入框. {debug_info}")
-        return
-    
-    # 3. Ctrl+V 粘贴
-    time.sleep(0.3)
-    logger.info("粘贴文本...")
-    pyautogui.hotkey('ctrl', 'v')
-    time.sleep(0.3)
-    
-    # 4. Enter 提交
-    logger.info("提交...")
-    pyautogui.press('return')
-    
-    # 5. 监控循环
-    monitor_process(templates_dir, send_status, reply_event)
+    result = WorkflowResult()
+    start_time = time.time()
+    _set_state(AutomationState.PASTING)
+    try:
+        if _env_flag("DRY_RUN"):
+            return _dry_run_workflow(result, templates_dir, send_status, text, ide_mode=ide_mode)
+        if not _activate_target_window(window_title, send_status):
+            return result.fail("window_not_active")
+        _wait_input_ready(templates_dir)
+        ensure_ide_mode(templates_dir, ide_mode, send_status, workflow_id)
+        # 1. 复制文本到剪贴板
+        if not set_clipboard(text):
+            logger.error("Error setting clipboard")
+            send_status(f"错误: 无法复制到剪贴板。{CLIPBOARD_HINT}")
+            return result.fail("clipboard_failed")
+        
+        # 2. 点击输入框
+        success, debug_info = _timed_click_input_box(result, templates_dir, window_title, workflow_id)
+        if not success:
+            logger.error(f"Could not click input_box: {debug_info}")
+            send_status(f"错误: 无法点击输入框. {debug_info}")
+            return result.fail("input_box_not_found")
+        result.found_input_box = True
+        
+        # 3. Ctrl+V 粘贴
+        time.sleep(0.3)
+        logger.info("粘贴文本...")
+        press_keys('ctrl', 'v')
+        time.sleep(0.3)
+        if not _verify_paste(templates_dir, text, send_status, result, window_title, select_all=True,
+                             workflow_id=workflow_id):
+            return result.fail("paste_not_verified")
+        
+        # 4. Enter 提交
+        if _check_cancelled(cancel_event, send_status, result):
+            return result
+        logger.info("提交...")
+        submit_input(templates_dir)
+        
+        # 5. 监控循环
+        result.success = True
+        _timed_monitor(result, start_time, templates_dir, send_status, reply_event,
+                       approval_func=approval_func, cancel_event=cancel_event, workflow_id=workflow_id)
+        return result
+    finally:
+        result.duration = time.time() - start_time
+        _set_state(AutomationState.IDLE)
 
 
 def full_workflow_image(
     image_path: str,
     templates_dir: str,
     send_status: Callable[[str], None],
-    confidence: float = 0.8
+    confidence: float = 0.8,
+    cancel_event=None
 ):
     """
     Execute the full image workflow:
@@ -1068,6 +3276,7 @@ def full_workflow_image(
         send_status(f"Error setting clipboard image: {image_path}")
         return
     
+    _set_state(AutomationState.PASTING)
     try:
         # 2. Find Input Box
         input_box_img = os.path.join(templates_dir, "input_box.png")
@@ -1075,15 +3284,16 @@ def full_workflow_image(
         
         if success:
             # 3. Paste and Submit
-            paste_and_submit()
+            paste_and_submit(templates_dir)
             
             # 4. Monitor Process
-            monitor_process(templates_dir, send_status, reply_event=None)
+            monitor_process(templates_dir, send_status, reply_event=None, cancel_event=cancel_event)
         else:
             logger.error("Could not find input_box.png")
             send_status(f"Error [v3]: input_box.png (img flow) not found. Info: {debug_log}")
             
     finally:
+        _set_state(AutomationState.IDLE)
         # Cleanup clipboard process ALWAYS
         if clip_process:
             logger.debug("Cleaning up xclip process...")
@@ -1101,7 +3311,13 @@ def full_workflow_media_group(
     send_status: Callable[[str], None],
     confidence: float = 0.8,
     file_paths: List[str] = None,
-    reply_event=None
+    reply_event=None,
+    window_title: Optional[str] = None,
+    ide_mode: Optional[str] = None,
+    approval_func: Optional[Callable[[str], Optional[bool]]] = None,
+    cancel_event=None,
+    items: Optional[List[Tuple[str, str]]] = None,
+    workflow_id: Optional[str] = None
 ):
     """
     执行完整的多图+文字+文件消息工作流:
@@ -1131,100 +3347,150 @@ def full_workflow_media_group(
         templates_dir: 模板目录路径
         send_status: 发送状态消息的回调函数
         confidence: 图像匹配置信度
-        file_paths: 非图片文件路径列表
+        file_paths: 非图片文件路径列表（IMAGE_PASTE_MODE=file 时图片也按此方式以路径发送）
         reply_event: threading.Event, MCP 回复后 set, 停止思考中
+        window_title: 目标 IDE 窗口标题子串，指定时先激活并确认焦点
+        ide_mode: 期望的 IDE 交互模式（如 plan / act），指定时粘贴前先确认
+        approval_func: 破坏性变更的人工批准回调，返回 True/False/None（批准/拒绝/超时）
+        cancel_event: threading.Event, 用户 /cancel 时 set, 提交前取消则不提交，监控中取消则停止监控
+        items: 有序内容项 [("text" | "image" | "file", 文字或路径), ...]；给出时按此顺序粘贴
+               （保留 Telegram 中文字与图片交错的顺序），并忽略 image_paths / file_paths / text
+        workflow_id: 工作流 ID，用于区分并发工作流的临时截图文件名
+    
+    Returns:
+        WorkflowResult: 本次工作流的结构化结果
     """
     _ensure_pyautogui()
-    if file_paths is None:
-        file_paths = []
-    # 1. 处理每张图片
-    for i, img_path in enumerate(image_paths):
-        logger.info(f"处理图片 {i+1}/{len(image_paths)}: {img_path}")
-        
-        # 复制图片到剪贴板
-        success, clip_process = set_clipboard_image(img_path)
-        if not success:
-            logger.error(f"无法复制图片到剪贴板: {img_path}")
-            send_status(f"错误: 无法复制图片 {i+1}")
-            continue
+    result = WorkflowResult()
+    start_time = time.time()
+    _set_state(AutomationState.PASTING)
+    try:
+        if items is None:
+            # 默认顺序：全部图片，然后全部文件，最后文字
+            items = [("image", path) for path in image_paths]
+            items += [("file", path) for path in file_paths or []]
+            items.append(("text", text))
+        if os.getenv("IMAGE_PASTE_MODE", "clipboard").strip().lower() == "file":
+            # IDE 不接受剪贴板图片时，改用 @路径 引用图片，由能按路径读文件的 Agent 自行读取
+            logger.info("IMAGE_PASTE_MODE=file: 图片改为以文件路径发送")
+            items = [("file" if kind == "image" else kind, content) for kind, content in items]
+        image_paths = [content for kind, content in items if kind == "image"]
+        file_paths = [content for kind, content in items if kind == "file"]
+        text = "".join(content for kind, content in items if kind == "text")
+        image_count, file_count = len(image_paths), len(file_paths)
+        image_index = file_index = 0
+        if _env_flag("DRY_RUN"):
+            return _dry_run_workflow(
+                result, templates_dir, send_status, text,
+                image_paths=image_paths, file_paths=file_paths, ide_mode=ide_mode
+            )
+        if not _activate_target_window(window_title, send_status):
+            return result.fail("window_not_active")
+        _wait_input_ready(templates_dir)
+        ensure_ide_mode(templates_dir, ide_mode, send_status, workflow_id)
+        # 1-4. 按顺序粘贴图片、文件引用（@路径）和文字
+        for kind, content in items:
+            if kind == "image":
+                image_index += 1
+                logger.info(f"处理图片 {image_index}/{image_count}: {content}")
             
-        try:
-            # 点击输入框
-            success, debug_info = click_input_box(templates_dir)
-            if not success:
-                logger.error(f"无法点击输入框: {debug_info}")
-                send_status(f"错误: 无法点击输入框. {debug_info}")
-                return
+                # 复制图片到剪贴板
+                success, clip_process = set_clipboard_image(content)
+                if not success:
+                    logger.error(f"无法复制图片到剪贴板: {content}")
+                    send_status(f"错误: 无法复制图片 {image_index}")
+                    continue
+                
+                try:
+                    # 点击输入框
+                    success, debug_info = _timed_click_input_box(result, templates_dir, window_title, workflow_id)
+                    if not success:
+                        logger.error(f"无法点击输入框: {debug_info}")
+                        send_status(f"错误: 无法点击输入框. {debug_info}")
+                        return result.fail("input_box_not_found")
+                    result.found_input_box = True
+                
+                    # Ctrl+V 粘贴
+                    time.sleep(0.3)
+                    logger.info("粘贴图片...")
+                    press_keys('ctrl', 'v')
+                    time.sleep(0.5)
+                
+                finally:
+                    # Cleanup clipboard process ALWAYS
+                    if clip_process:
+                        try:
+                            clip_process.terminate()
+                            clip_process.wait(timeout=1)
+                        except:
+                            pass
             
-            # Ctrl+V 粘贴
-            time.sleep(0.3)
-            logger.info("粘贴图片...")
-            pyautogui.hotkey('ctrl', 'v')
-            time.sleep(0.5)
+            elif kind == "file":
+                file_index += 1
+                logger.info(f"处理文件 {file_index}/{file_count}: {content}")
             
-        finally:
-            # Cleanup clipboard process ALWAYS
-            if clip_process:
-                try:
-                    clip_process.terminate()
-                    clip_process.wait(timeout=1)
-                except:
-                    pass
-    
-    # 2. 处理每个非图片文件（使用 @路径 格式）
-    for i, file_path in enumerate(file_paths):
-        logger.info(f"处理文件 {i+1}/{len(file_paths)}: {file_path}")
-        
-        # 获取绝对路径并构造 @路径 格式
-        abs_path = os.path.abspath(file_path)
-        file_ref = f"@{abs_path}"
-        
-        # 复制 @路径 到剪贴板
-        if not set_clipboard(file_ref):
-            logger.error(f"无法复制文件路径到剪贴板: {file_ref}")
-            send_status(f"错误: 无法复制文件 {i+1}")
-            continue
-        
-        # 点击输入框
-        success, debug_info = click_input_box(templates_dir)
-        if not success:
-            logger.error(f"无法点击输入框: {debug_info}")
-            send_status(f"错误: 无法点击输入框. {debug_info}")
-            return
-        
-        # Ctrl+V 粘贴
-        time.sleep(0.3)
-        logger.info(f"粘贴文件路径: {file_ref}")
-        pyautogui.hotkey('ctrl', 'v')
-        time.sleep(0.5)
-    
-    # 3-5. 处理文字
-    if text:
-        logger.info("处理文字内容")
-        
-        # 复制文字到剪贴板
-        if not set_clipboard(text):
-            logger.error("无法复制文字到剪贴板")
-            send_status("错误: 无法复制文字")
-        else:
-            # 点击输入框
-            success, debug_info = click_input_box(templates_dir)
-            if not success:
-                logger.error(f"无法点击输入框: {debug_info}")
-                send_status(f"错误: 无法点击输入框. {debug_info}")
-                return
+                # 获取绝对路径并构造 @路径 格式
+                abs_path = os.path.abspath(content)
+                file_ref = f"@{abs_path}"
             
-            # Ctrl+V 粘贴
-            time.sleep(0.3)
-            logger.info("粘贴文字...")
-            pyautogui.hotkey('ctrl', 'v')
-            time.sleep(0.3)
-    
-    # 5. Enter 提交
-    logger.info("等待上传稳定...")
-    time.sleep(2)
-    logger.info("提交...")
-    pyautogui.press('return')
-    
-    # 6. 监控循环
-    monitor_process(templates_dir, send_status, reply_event)
+                # 复制 @路径 到剪贴板
+                if not set_clipboard(file_ref):
+                    logger.error(f"无法复制文件路径到剪贴板: {file_ref}")
+                    send_status(f"错误: 无法复制文件 {file_index}。{CLIPBOARD_HINT}")
+                    continue
+            
+                # 点击输入框
+                success, debug_info = _timed_click_input_box(result, templates_dir, window_title, workflow_id)
+                if not success:
+                    logger.error(f"无法点击输入框: {debug_info}")
+                    send_status(f"错误: 无法点击输入框. {debug_info}")
+                    return result.fail("input_box_not_found")
+                result.found_input_box = True
+            
+                # Ctrl+V 粘贴
+                time.sleep(0.3)
+                logger.info(f"粘贴文件路径: {file_ref}")
+                press_keys('ctrl', 'v')
+                time.sleep(0.5)
+            
+            elif content:
+                logger.info("处理文字内容")
+            
+                # 复制文字到剪贴板
+                if not set_clipboard(content):
+                    logger.error("无法复制文字到剪贴板")
+                    send_status(f"错误: 无法复制文字。{CLIPBOARD_HINT}")
+                    continue
+                
+                # 点击输入框
+                success, debug_info = _timed_click_input_box(result, templates_dir, window_title, workflow_id)
+                if not success:
+                    logger.error(f"无法点击输入框: {debug_info}")
+                    send_status(f"错误: 无法点击输入框. {debug_info}")
+                    return result.fail("input_box_not_found")
+                result.found_input_box = True
+            
+                # Ctrl+V 粘贴
+                time.sleep(0.3)
+                logger.info("粘贴文字...")
+                press_keys('ctrl', 'v')
+                time.sleep(0.3)
+                if not _verify_paste(templates_dir, content, send_status, result, window_title, select_all=False,
+                                     workflow_id=workflow_id):
+                    return result.fail("paste_not_verified")
+    
+        # 5. Enter 提交
+        _wait_upload_stable(len(image_paths))
+        if _check_cancelled(cancel_event, send_status, result):
+            return result
+        logger.info("提交...")
+        submit_input(templates_dir)
+    
+        # 6. 监控循环
+        result.success = True
+        _timed_monitor(result, start_time, templates_dir, send_status, reply_event,
+                       approval_func=approval_func, cancel_event=cancel_event, workflow_id=workflow_id)
+        return result
+    finally:
+        result.duration = time.time() - start_time
+        _set_state(AutomationState.IDLE)
@@ -14,24 +14,34 @@ import sys
 _original_stdout = sys.stdout  # Save for MCP use
 sys.stdout = sys.stderr  # Redirect stdout to stderr to prevent pollution
 
+import glob
+import json
 import logging
 import os
+import re
+import shlex
+import subprocess
+import tempfile
 import threading
 import time
-from collections import defaultdict
+import uuid
+from collections import deque
+from datetime import datetime, timedelta
 from dataclasses import dataclass, field
 from pathlib import Path
-from typing import Dict, List, Optional
+from typing import Any, Callable, Dict, List, Optional, Tuple
 
 
 try:
     from dotenv import load_dotenv
 except ImportError:
     load_dotenv = None
-from telegram import Bot, Message, Update
+from PIL import Image
+from telegram import Bot, InlineKeyboardButton, InlineKeyboardMarkup, Message, Update
 from telegram.utils.helpers import escape_markdown
 from telegram.ext import (
     CallbackContext,
+    CallbackQueryHandler,
     CommandHandler,
     Filters,
     MessageHandler,
@@ -39,9 +49,21 @@ from telegram.ext import (
 )
 
 from automation.gui_automation import (
+    annotate_boxes,
     backup_templates,
+    _PERSISTENT_DIR_PATH,
+    capture_origin,
+    check_dependencies,
+    find_edge_regions,
     full_workflow,
     full_workflow_media_group,
+    AutomationState,
+    get_automation_state,
+    get_chat_templates_dir,
+    match_score_heatmap,
+    save_chat_template,
+    submit_workflow,
+    take_screenshot,
 )
 from automation.cli_automation import CLIBridge
 from mcp.server import MCPServer
@@ -49,9 +71,10 @@ from mcp.server import MCPServer
 
 # Configure logging to file (stdout reserved for MCP)
 log_file = '/tmp/gravity_main_debug.log'
+LOG_TEXT_FORMAT = '%(asctime)s - %(name)s - %(levelname)s - %(message)s'
 logging.basicConfig(
     level=logging.DEBUG,
-    format='%(asctime)s - %(name)s - %(levelname)s - %(message)s',
+    format=LOG_TEXT_FORMAT,
     handlers=[
         logging.FileHandler(log_file),
         logging.StreamHandler(sys.stderr),
@@ -62,47 +85,522 @@ logging.basicConfig(
 logger = logging.getLogger(__name__)
 
 
+class JsonLogFormatter(logging.Formatter):
+    """LOG_FORMAT=json 时使用：每行一个 JSON 对象，MCP、自动化和主程序的日志交错时也能按 component 过滤。"""
+    
+    COMPONENTS = ('automation', 'mcp')
+    
+    def format(self, record: logging.LogRecord) -> str:
+        top = record.name.split('.')[0]
+        entry = {
+            'timestamp': datetime.fromtimestamp(record.created).isoformat(timespec='milliseconds'),
+            'level': record.levelname,
+            'component': top if top in self.COMPONENTS else 'main',
+            'logger': record.name,
+            'thread': record.threadName,
+            'message': record.getMessage(),
+        }
+        if record.exc_info:
+            entry['exception'] = self.formatException(record.exc_info)
+        return json.dumps(entry, ensure_ascii=False)
+
+
+def configure_log_format():
+    """按 LOG_FORMAT（text|json，默认 text）设置所有日志 handler 的格式；.env 加载后需再调用一次。"""
+    use_json = os.getenv('LOG_FORMAT', '').strip().lower() == 'json'
+    formatter = JsonLogFormatter() if use_json else logging.Formatter(LOG_TEXT_FORMAT)
+    for handler in logging.getLogger().handlers:
+        handler.setFormatter(formatter)
+
+
+configure_log_format()
+
+
 @dataclass
 class MessageBuffer:
     """Aggregates messages for a specific chat."""
     messages: List[Message] = field(default_factory=list)
     timer: Optional[threading.Timer] = None
+    held: bool = False  # /hold 期间不自动 flush，直到 /go
+
+
+class MessageBatcher:
+    """
+    Per-chat quiescence buffer, independent of the Telegram handler.
+    
+    Every add() restarts the chat's timer; once no new message arrives for
+    `quiescence` seconds the whole batch is removed from the buffer and passed
+    to flush_callback(chat_id, messages) on the timer thread.
+    
+    hold(chat_id) suspends the timer so a multi-part prompt can be composed
+    deliberately; release(chat_id) flushes everything collected meanwhile.
+    
+    Telegram may redeliver an update after a reconnect; add() skips a message
+    whose message_id is already buffered or was among the chat's recently
+    flushed messages, without touching the timer.
+    
+    When journal_path is set, every change to the buffers is written there as
+    JSON so messages still waiting for their timer survive a crash or restart
+    (see load_journal).
+    """
+    
+    # 每个 chat 记住多少个最近处理过的 message_id
+    RECENT_IDS_PER_CHAT = 100
+    
+    def __init__(self, flush_callback: Callable[[int, List[Message]], None], quiescence: float = 4.0):
+        self.flush_callback = flush_callback
+        self.quiescence = quiescence
+        self.journal_path: Optional[str] = None
+        self._buffers: Dict[int, MessageBuffer] = {}
+        # 每个 chat 最近已交给 flush_callback 的 message_id，用于识别重复投递
+        self._recent_ids: Dict[int, deque] = {}
+        self._lock = threading.Lock()
+    
+    def add(self, chat_id: int, message: Message, quiescence: Optional[float] = None, edited: bool = False) -> Optional[int]:
+        """
+        Buffer a message and (re)start the chat's flush timer. Returns the buffered
+        count, or None if the message was a duplicate delivery and was skipped.
+        
+        An edited message whose message_id is already buffered replaces the
+        buffered version, so only its final state is processed; edits of
+        already flushed messages are buffered again. `quiescence` overrides the
+        default wait for this restart.
+        """
+        with self._lock:
+            if not edited and message.message_id in self._recent_ids.get(chat_id, ()):
+                return None
+            buf = self._buffers.setdefault(chat_id, MessageBuffer())
+            for idx, existing in enumerate(buf.messages):
+                if existing.message_id == message.message_id:
+                    if not edited:
+                        return None
+                    buf.messages[idx] = message
+                    break
+            else:
+                buf.messages.append(message)
+            if not buf.held:
+                self._restart_timer(chat_id, buf, self.quiescence if quiescence is None else quiescence)
+            self._write_journal()
+            return len(buf.messages)
+    
+    def replace(self, chat_id: int, message: Message) -> bool:
+        """
+        Replace a buffered message with the same message_id (an edit) without
+        restarting the timer. Returns False if it is no longer buffered.
+        """
+        with self._lock:
+            buf = self._buffers.get(chat_id)
+            if not buf:
+                return False
+            for idx, existing in enumerate(buf.messages):
+                if existing.message_id == message.message_id:
+                    buf.messages[idx] = message
+                    self._write_journal()
+                    return True
+            return False
+    
+    def hold(self, chat_id: int) -> int:
+        """Stop auto-flushing the chat until release(). Returns the buffered count."""
+        with self._lock:
+            buf = self._buffers.setdefault(chat_id, MessageBuffer())
+            buf.held = True
+            if buf.timer:
+                buf.timer.cancel()
+                buf.timer = None
+            return len(buf.messages)
+    
+    def release(self, chat_id: int) -> Optional[int]:
+        """End a hold and flush immediately. Returns the flushed count, or None if not held."""
+        with self._lock:
+            buf = self._buffers.get(chat_id)
+            if not buf or not buf.held:
+                return None
+            buf.held = False
+            count = len(buf.messages)
+            if not count:
+                del self._buffers[chat_id]
+                self._write_journal()
+                return 0
+            self._restart_timer(chat_id, buf, 0)
+            return count
+    
+    def is_held(self, chat_id: int) -> bool:
+        with self._lock:
+            buf = self._buffers.get(chat_id)
+            return bool(buf and buf.held)
+    
+    def _restart_timer(self, chat_id: int, buf: MessageBuffer, delay: float):
+        # Caller holds self._lock
+        if buf.timer:
+            buf.timer.cancel()
+        buf.timer = threading.Timer(delay, self._flush, args=(chat_id,))
+        buf.timer.daemon = True
+        buf.timer.start()
+    
+    def pending(self, chat_id: int) -> int:
+        """Number of messages currently buffered for a chat."""
+        with self._lock:
+            buf = self._buffers.get(chat_id)
+            return len(buf.messages) if buf else 0
+    
+    def was_flushed(self, chat_id: int, message_id: int) -> bool:
+        """Whether message_id was among the chat's recently flushed messages."""
+        with self._lock:
+            return message_id in self._recent_ids.get(chat_id, ())
+    
+    def _flush(self, chat_id: int):
+        with self._lock:
+            buf = self._buffers.get(chat_id)
+            # A timer that was cancelled after it already fired must not flush
+            # the newer messages; only the chat's current timer may flush.
+            if not buf or buf.held or buf.timer is not threading.current_thread():
+                return
+            del self._buffers[chat_id]
+            recent = self._recent_ids.setdefault(chat_id, deque(maxlen=self.RECENT_IDS_PER_CHAT))
+            recent.extend(message.message_id for message in buf.messages)
+        
+        if buf.messages:
+            self.flush_callback(chat_id, buf.messages)
+        # 批次交给 flush_callback 之后才从日志中移除，回调期间崩溃重启后仍可重放
+        self.save_journal()
+    
+    def save_journal(self):
+        """Rewrite the journal from the current buffers (removes it when empty)."""
+        with self._lock:
+            self._write_journal()
+    
+    def _write_journal(self):
+        # Caller holds self._lock
+        if not self.journal_path:
+            return
+        snapshot = {
+            str(chat_id): [message.to_dict() for message in buf.messages]
+            for chat_id, buf in self._buffers.items()
+            if buf.messages
+        }
+        try:
+            if not snapshot:
+                if os.path.exists(self.journal_path):
+                    os.remove(self.journal_path)
+                return
+            tmp_path = f"{self.journal_path}.tmp"
+            with open(tmp_path, 'w', encoding='utf-8') as f:
+                json.dump(snapshot, f, ensure_ascii=False)
+            os.replace(tmp_path, self.journal_path)
+        except (OSError, TypeError, ValueError) as e:
+            logger.error(f"Error writing buffer journal {self.journal_path}: {e}")
+    
+    @staticmethod
+    def load_journal(path: str) -> Dict[int, List[Dict[str, Any]]]:
+        """读取上次运行留下的缓冲日志，返回 {chat_id: [message dict, ...]}；没有或损坏时返回空。"""
+        try:
+            with open(path, 'r', encoding='utf-8') as f:
+                data = json.load(f)
+            return {int(chat_id): list(messages) for chat_id, messages in data.items()}
+        except FileNotFoundError:
+            return {}
+        except (OSError, ValueError, AttributeError, TypeError) as e:
+            logger.error(f"Error reading buffer journal {path}: {e}")
+            return {}
+
+
+DEFAULT_CHAT_SETTINGS_FILE = os.path.join(os.path.expanduser("~"), ".antigravity-bridge", "chat_settings.json")
+# BUFFER_JOURNAL=1 时缓冲中的消息写入此文件，进程崩溃或重启后重放
+BUFFER_JOURNAL_FILE = os.path.join(tempfile.gettempdir(), "antigravity_buffer_journal.json")
+# /pauseall 的持久化标记文件：存在即表示全局暂停，内容为暂停原因
+PAUSE_STATE_FILE = os.path.join(os.path.expanduser("~"), ".antigravity-bridge", "paused")
+# Telegram 长轮询意外退出后的重启退避（秒）：从 INITIAL 开始每次翻倍，最多 MAX；
+# 连续运行 STABLE 秒视为恢复并重置退避，断线超过 OUTAGE_WARN 秒记录告警
+POLL_BACKOFF_INITIAL_S = 2
+POLL_BACKOFF_MAX_S = 300
+POLL_STABLE_S = 60
+POLL_OUTAGE_WARN_S = 600
+# 附件下载和截图等临时文件，正常流程会删除，崩溃或异常路径下可能残留，由定期清理线程回收
+TEMP_FILE_PATTERNS = (
+    "tg_batch_*",
+    "tg_template_*",
+    "telegram_screenshot_*",
+    "telegram_regions*",
+    "telegram_heatmap*",
+    "mcp_screenshot_*",
+    "smart_find_screenshot_*",
+    "ocr_screen_*",
+    "ocr_region_*",
+    "antigravity_failure_screenshot_*",
+    "antigravity_grab_*",
+    "screen*.png",
+    "monitor_*.png",
+)
+
+
+def _env_int(name: str, default: int) -> int:
+    """读取整数环境变量，未设置时返回默认值；格式错误时记录警告并返回默认值，而不是让启动崩溃。"""
+    raw = os.getenv(name, '').strip()
+    if not raw:
+        return default
+    try:
+        return int(raw)
+    except ValueError:
+        logger.warning(f"{name}={raw!r} is not an integer, using default {default}")
+        return default
+
+
+def _env_float(name: str, default: float) -> float:
+    """读取浮点数环境变量，未设置时返回默认值；格式错误时记录警告并返回默认值。"""
+    raw = os.getenv(name, '').strip()
+    if not raw:
+        return default
+    try:
+        return float(raw)
+    except ValueError:
+        logger.warning(f"{name}={raw!r} is not a number, using default {default}")
+        return default
+
+
+def parse_active_hours(spec: str) -> Optional[Tuple[int, int]]:
+    """解析 ACTIVE_HOURS（如 "09:00-18:00"，可跨午夜如 "22:00-06:00"），返回 (开始, 结束) 的当天分钟数。"""
+    match = re.fullmatch(r'\s*(\d{1,2}):(\d{2})\s*-\s*(\d{1,2}):(\d{2})\s*', spec or '')
+    if not match:
+        return None
+    start_h, start_m, end_h, end_m = (int(g) for g in match.groups())
+    if start_h > 23 or end_h > 24 or start_m > 59 or end_m > 59:
+        return None
+    # 24 只能写作 24:00（表示当天结束）
+    if end_h == 24 and end_m != 0:
+        return None
+    # 开始等于结束的窗口长度为 0，永远不在工作时间内，批次会一直排队；全天可用应写 00:00-24:00
+    if start_h * 60 + start_m == end_h * 60 + end_m:
+        return None
+    return start_h * 60 + start_m, end_h * 60 + end_m
+
+
+def _temp_files() -> List[str]:
+    paths = set()
+    for pattern in TEMP_FILE_PATTERNS:
+        paths.update(glob.glob(os.path.join("/tmp", pattern)))
+    return sorted(paths)
+
+
+def temp_file_stats() -> Tuple[int, int]:
+    """返回 Bridge 临时文件的 (数量, 总字节数)。"""
+    count, total = 0, 0
+    for path in _temp_files():
+        try:
+            total += os.path.getsize(path)
+            count += 1
+        except OSError:
+            pass
+    return count, total
+
+
+def cleanup_temp_files(max_age_seconds: float) -> int:
+    """删除修改时间早于 max_age_seconds 的 Bridge 临时文件，返回删除数量。"""
+    cutoff = time.time() - max_age_seconds
+    removed = 0
+    for path in _temp_files():
+        try:
+            if os.path.isfile(path) and os.path.getmtime(path) < cutoff:
+                os.remove(path)
+                removed += 1
+        except OSError as e:
+            logger.warning(f"Failed to remove stale temp file {path}: {e}")
+    return removed
+
+
+class ChatSettings:
+    """
+    Per-chat settings persisted as a JSON file: {"<chat_id>": {"key": value}}.
+    
+    Used for options that differ between chats, e.g. which IDE window a
+    chat drives. Writes go through a temp file so a crash never leaves a
+    half-written file behind.
+    """
+    
+    def __init__(self, path: str):
+        self.path = path
+        self._lock = threading.Lock()
+        self._data: Dict[str, Dict[str, Any]] = {}
+        try:
+            with open(path, 'r', encoding='utf-8') as f:
+                loaded = json.load(f)
+            if isinstance(loaded, dict):
+                self._data = {k: v for k, v in loaded.items() if isinstance(v, dict)}
+        except FileNotFoundError:
+            pass
+        except Exception as e:
+            logger.error(f"Failed to load chat settings from {path}: {e}")
+    
+    def get(self, chat_id: int, key: str, default: Any = None) -> Any:
+        with self._lock:
+            return self._data.get(str(chat_id), {}).get(key, default)
+    
+    def set(self, chat_id: int, key: str, value: Any):
+        """Set a value; None removes the key."""
+        with self._lock:
+            chat = self._data.setdefault(str(chat_id), {})
+            if value is None:
+                chat.pop(key, None)
+                if not chat:
+                    del self._data[str(chat_id)]
+            else:
+                chat[key] = value
+            self._save()
+    
+    def _save(self):
+        try:
+            os.makedirs(os.path.dirname(self.path) or '.', exist_ok=True)
+            tmp_path = f"{self.path}.tmp"
+            with open(tmp_path, 'w', encoding='utf-8') as f:
+                json.dump(self._data, f, ensure_ascii=False, indent=2)
+            os.replace(tmp_path, self.path)
+        except Exception as e:
+            logger.error(f"Failed to save chat settings to {self.path}: {e}")
 
 
 class AntigravityBridge:
     """Main application class for Antigravity-Bridge."""
     
     def __init__(self):
-        self.buffer_map: Dict[int, MessageBuffer] = defaultdict(MessageBuffer)
-        self.buffer_lock = threading.Lock()
+        # Wait 4 seconds quiescence before processing (多图消息需要更长时间到达)，setup() 中按 BUFFER_QUIESCENCE_MS 覆盖
+        self.batcher = MessageBatcher(self._process_batch, quiescence=4.0)
         self.bot: Optional[Bot] = None
         self.templates_dir: str = ""
+        self.active_template_set: Optional[str] = None  # /usetemplates 选择的 templates/<name> 子目录
         self.mcp_server: Optional[MCPServer] = None  # MCP Server 引用，用于设置 last_chat_id
         self.ALLOWED_CHAT_IDS: list = []  # 从 .env 读取
+        self._allow_all_chats = False  # TELEGRAM_CHAT_ID / ALLOWED_CHAT_IDS 都未设置时允许所有聊天
+        self._unauthorized_reply = False  # UNAUTHORIZED_REPLY，是否回复未授权提示
+        self._notified_unauthorized: set = set()  # 已回复过未授权提示的 chat，每个只提示一次
+        
+        self.max_prompt_chars = 0  # MAX_PROMPT_CHARS，0 表示不限制
+        # SCREENSHOT_MAX_DIM / SCREENSHOT_JPEG_QUALITY，发送截图前缩小、转 JPEG；0 表示不处理
+        self._screenshot_max_dim = 0
+        self._screenshot_jpeg_quality = 0
+        self.error_notify_chat_id: Optional[int] = None  # ERROR_NOTIFY_CHAT，运维告警通道
+        self.ADMIN_CHAT_IDS: list = []  # ADMIN_CHAT_IDS，可使用 /pauseall /resumeall 的管理员
+        # ACTIVE_HOURS 之外收到、等待工作时间开始后处理的批次
+        self._offhours_queue: List[Tuple[int, List[Message]]] = []
+        self._offhours_lock = threading.Lock()
+        self._offhours_timer: Optional[threading.Timer] = None
+        # 每个 chat 进行中（含排队中）的 GUI 工作流的取消事件，供 /cancel 使用
+        self._gui_cancel_events: Dict[int, List[threading.Event]] = {}
+        # 同上，按 workflow_id 索引 (所属 chat_id, 取消事件)，供“处理中”消息上的“取消”按钮使用（与上面共用锁）
+        self._gui_task_events: Dict[str, Tuple[int, threading.Event]] = {}
+        self._gui_cancel_lock = threading.Lock()
+        # 等待用户点击内联按钮的批准请求: approval_id -> {'event', 'approved', 'chat_id'}
+        self._pending_approvals: Dict[str, Dict[str, Any]] = {}
+        self._approvals_lock = threading.Lock()
+        self.last_trigger_message_ids: Dict[int, int] = {}  # 每个 chat 最近一次触发 IDE 的消息 ID
+        self._last_prompt_times: Dict[int, float] = {}  # 每个 chat 上一次发给 IDE 的时间，用于判断新会话
+        # 每个 chat 最近 24 小时内的批次时间戳，用于 CHAT_QUOTA_PER_HOUR / CHAT_QUOTA_PER_DAY
+        self._chat_usage: Dict[int, deque] = {}
+        self._chat_usage_lock = threading.Lock()
+        # RATE_LIMIT_PER_MIN 令牌桶: chat_id -> (剩余令牌, 上次更新时间)；桶回满后即删除
+        self._rate_buckets: Dict[int, Tuple[float, float]] = {}
+        self._rate_lock = threading.Lock()
+        self.chat_settings = ChatSettings(DEFAULT_CHAT_SETTINGS_FILE)  # 每个 chat 的持久化设置
+        self._process_edits = False  # PROCESS_EDITS，是否把编辑过的消息重新发送给 IDE
+        self._edit_debounce_seconds = 8.0  # EDIT_DEBOUNCE_SECONDS，编辑消息的静默窗口
         
         self.current_mode = "GUI"
         self.cli_bridge: Optional[CLIBridge] = None
         self._shutting_down = False
+        self._mcp_http_started = False
         
+    def _load_allowed_chat_ids(self):
+        """
+        从环境变量读取 TELEGRAM_CHAT_ID / ALLOWED_CHAT_IDS（两者合并），支持逗号分隔多个 ID。
+
+        都未设置（或为空）时允许所有聊天，保持加白名单之前的行为；设置了但没有一个有效 ID 时
+        不会退化为允许所有聊天。
+        """
+        chat_id_str = ','.join(
+            value for value in (os.getenv('TELEGRAM_CHAT_ID', ''), os.getenv('ALLOWED_CHAT_IDS', '')) if value.strip()
+        )
+        self.ALLOWED_CHAT_IDS = []
+        self._allow_all_chats = not chat_id_str
+        if self._allow_all_chats:
+            logger.warning("TELEGRAM_CHAT_ID / ALLOWED_CHAT_IDS not set, accepting messages from all chats")
+            return
+        for cid in chat_id_str.split(','):
+            cid = cid.strip()
+            if not cid:
+                continue
+            try:
+                chat_id = int(cid)
+            except ValueError:
+                logger.error(f"Invalid chat ID in allowlist: {cid!r}")
+                continue
+            if chat_id not in self.ALLOWED_CHAT_IDS:
+                self.ALLOWED_CHAT_IDS.append(chat_id)
+        logger.info(f"Allowed chat IDs: {self.ALLOWED_CHAT_IDS}")
+    
+    def _load_screenshot_settings(self):
+        """读取 SCREENSHOT_MAX_DIM / SCREENSHOT_JPEG_QUALITY；JPEG 质量限制在 1-95（PIL 超过 95 收益很小、文件反而变大）。"""
+        self._screenshot_max_dim = max(0, _env_int('SCREENSHOT_MAX_DIM', 0))
+        quality = _env_int('SCREENSHOT_JPEG_QUALITY', 0)
+        if quality > 95:
+            logger.warning(f"SCREENSHOT_JPEG_QUALITY={quality} is above 95, using 95")
+        self._screenshot_jpeg_quality = min(quality, 95) if quality > 0 else 0
+    
+    def is_chat_allowed(self, chat_id: int) -> bool:
+        """聊天是否在白名单中；未配置白名单时允许所有聊天。"""
+        return self._allow_all_chats or chat_id in self.ALLOWED_CHAT_IDS
+    
     def setup(self) -> bool:
         """Initialize the application."""
         # 优先从环境变量读取（MCP mcp_config.json 会自动注入）
         # 如果环境变量不存在，才尝试从 .env 文件加载（兼容 daemon 模式）
         if not os.getenv('TELEGRAM_BOT_TOKEN') and load_dotenv:
             load_dotenv()
+            configure_log_format()
         
         token = os.getenv('TELEGRAM_BOT_TOKEN')
         if not token:
             logger.error("TELEGRAM_BOT_TOKEN not set")
             return False
         
-        # 从环境变量读取 TELEGRAM_CHAT_ID，支持逗号分隔多个 ID
-        chat_id_str = os.getenv('TELEGRAM_CHAT_ID', '')
-        if chat_id_str:
-            self.ALLOWED_CHAT_IDS = [int(cid.strip()) for cid in chat_id_str.split(',') if cid.strip()]
-            logger.info(f"Allowed chat IDs: {self.ALLOWED_CHAT_IDS}")
-        else:
-            logger.warning("TELEGRAM_CHAT_ID not set, no chat IDs allowed")
+        self._load_allowed_chat_ids()
+        self._unauthorized_reply = os.getenv('UNAUTHORIZED_REPLY', '').strip().lower() in ('1', 'true', 'yes', 'on')
+        
+        self.max_prompt_chars = max(0, _env_int('MAX_PROMPT_CHARS', 0))
+        self._load_screenshot_settings()
+        
+        self._process_edits = os.getenv('PROCESS_EDITS', '').strip().lower() in ('1', 'true', 'yes', 'on')
+        self._edit_debounce_seconds = max(0.0, _env_float('EDIT_DEBOUNCE_SECONDS', 8.0))
+        self.batcher.quiescence = max(0, _env_int('BUFFER_QUIESCENCE_MS', 4000)) / 1000.0
+        logger.info(f"Buffer quiescence: {self.batcher.quiescence}s")
+        if os.getenv('BUFFER_JOURNAL', '').strip().lower() in ('1', 'true', 'yes', 'on'):
+            self.batcher.journal_path = os.getenv('BUFFER_JOURNAL_FILE', '').strip() or BUFFER_JOURNAL_FILE
+            logger.info(f"Buffer journal: {self.batcher.journal_path}")
+        
+        # 所有工作流共用同一个 DISPLAY 的剪贴板、焦点和鼠标，按 DISPLAY 分别路由之前只能逐个执行
+        max_workflows = os.getenv('MAX_CONCURRENT_WORKFLOWS', '').strip()
+        if _env_int('MAX_CONCURRENT_WORKFLOWS', 1) != 1:
+            logger.warning(
+                f"MAX_CONCURRENT_WORKFLOWS={max_workflows!r} is ignored: GUI workflows share one "
+                f"display (clipboard, focus, mouse) and always run one at a time."
+            )
+        
+        settings_file = os.getenv('CHAT_SETTINGS_FILE', '').strip()
+        if settings_file:
+            self.chat_settings = ChatSettings(os.path.expanduser(settings_file))
+        
+        admin_str = os.getenv('ADMIN_CHAT_IDS', '')
+        try:
+            self.ADMIN_CHAT_IDS = [int(cid.strip()) for cid in admin_str.split(',') if cid.strip()]
+        except ValueError:
+            logger.error(f"ADMIN_CHAT_IDS={admin_str!r} is not a valid chat ID list, ignored")
+        if self._paused_reason() is not None:
+            logger.warning(f"Automation is paused ({PAUSE_STATE_FILE} exists), use /resumeall to resume")
+        
+        notify_chat = os.getenv('ERROR_NOTIFY_CHAT', '').strip()
+        if notify_chat:
+            try:
+                self.error_notify_chat_id = int(notify_chat)
+                logger.info(f"Error notifications go to chat {self.error_notify_chat_id}")
+            except ValueError:
+                logger.warning(f"ERROR_NOTIFY_CHAT={notify_chat!r} is not a valid chat ID, ignored")
         
         # Determine templates directory
         # PyInstaller: sys._MEIPASS | Dev: script_dir
@@ -117,8 +615,11 @@ class AntigravityBridge:
         
         # PyInstaller 二进制模式下，将模板备份到持久化目录
         # 防止 _MEI* 临时目录被系统清理或多实例竞争时丢失
+        # 二进制所在目录下的 templates/ 中的同名文件可覆盖内置模板，此时改用合并后的持久化目录
         if hasattr(sys, '_MEIPASS'):
-            backup_templates(self.templates_dir)
+            override_dir = os.path.join(os.path.dirname(os.path.abspath(sys.executable)), "templates")
+            if backup_templates(self.templates_dir, override_dir) and os.path.isdir(override_dir):
+                self.templates_dir = _PERSISTENT_DIR_PATH
         # Initialize Telegram bot
         self.updater = Updater(token=token, use_context=True)
         self.bot = self.updater.bot
@@ -149,7 +650,22 @@ class AntigravityBridge:
         # 命令处理器
         dp.add_handler(CommandHandler('start', self.handle_help_command))
         dp.add_handler(CommandHandler('help', self.handle_help_command))
+        dp.add_handler(CommandHandler('id', self.handle_id_command))
         dp.add_handler(CommandHandler('screen', self.handle_screen_command))
+        dp.add_handler(CommandHandler('regions', self.handle_regions_command))
+        dp.add_handler(CommandHandler('heatmap', self.handle_heatmap_command))
+        dp.add_handler(CommandHandler('settemplate', self.handle_settemplate_command))
+        dp.add_handler(CommandHandler('window', self.handle_window_command))
+        dp.add_handler(CommandHandler('instructions', self.handle_instructions_command))
+        dp.add_handler(CommandHandler('policy', self.handle_policy_command))
+        dp.add_handler(CommandHandler('idemode', self.handle_idemode_command))
+        dp.add_handler(CommandHandler('quiescence', self.handle_quiescence_command))
+        dp.add_handler(CommandHandler('pauseall', self.handle_pauseall_command))
+        dp.add_handler(CommandHandler('resumeall', self.handle_resumeall_command))
+        dp.add_handler(CommandHandler('usetemplates', self.handle_usetemplates_command))
+        dp.add_handler(CommandHandler('log', self.handle_log_command))
+        dp.add_handler(CommandHandler('hold', self.handle_hold_command))
+        dp.add_handler(CommandHandler('go', self.handle_go_command))
         dp.add_handler(CommandHandler('mode', self.handle_mode_command))
         dp.add_handler(CommandHandler('cd', self.handle_cd_command))
         dp.add_handler(CommandHandler('status', self.handle_status_command))
@@ -177,9 +693,14 @@ class AntigravityBridge:
         dp.add_handler(CommandHandler('history', self.handle_history_command))
         dp.add_handler(CommandHandler('model', self.handle_model_command))
         
+        # 内联按钮回调（人工批准）
+        dp.add_handler(CallbackQueryHandler(self.handle_approval_callback, pattern=r'^approve:'))
+        # 内联按钮回调（“处理中”消息上的取消 / 状态）
+        dp.add_handler(CallbackQueryHandler(self.handle_task_callback, pattern=r'^task:'))
+        
         # 消息处理器
         dp.add_handler(MessageHandler(
-            Filters.text | Filters.photo | Filters.document,
+            Filters.text | Filters.photo | Filters.document | Filters.caption | Filters.voice,
             self.handle_message
         ))
         
@@ -188,11 +709,12 @@ class AntigravityBridge:
             from telegram import BotCommand
             commands = [
                 BotCommand("help", "📖 帮助说明"),
+                BotCommand("id", "🆔 查看聊天 ID 和用户 ID"),
                 BotCommand("mode", "🔄 切换模式 (gui/cli)"),
                 BotCommand("cd", "📂 切换 CLI 工作目录"),
-                BotCommand("status", "📊 查看 CLI 状态"),
+                BotCommand("status", "📊 查看 CLI / GUI 状态"),
                 BotCommand("quota", "💳 查询当前 Codex 配额"),
-                BotCommand("cancel", "🛑 终止当前 CLI 任务"),
+                BotCommand("cancel", "🛑 取消当前 GUI / CLI 任务"),
                 BotCommand("exit", "🛑 退出当前任务"),
                 BotCommand("sessions", "🗂️ 查看最近会话"),
                 BotCommand("resume", "🔁 绑定会话继续"),
@@ -215,6 +737,20 @@ class AntigravityBridge:
                 BotCommand("history", "🕘 查看提示词历史"),
                 BotCommand("model", "🤖 设置 CLI 模型"),
                 BotCommand("screen", "📸 截取屏幕"),
+                BotCommand("regions", "🔲 标注候选模板区域"),
+                BotCommand("heatmap", "🌡️ 查看模板匹配分数热力图"),
+                BotCommand("settemplate", "🧩 上传图片设置本聊天的模板"),
+                BotCommand("window", "🪟 设置本聊天操作的 IDE 窗口"),
+                BotCommand("instructions", "📝 设置本聊天每个会话开头的指令"),
+                BotCommand("policy", "🚦 设置哪些消息不发送给 IDE"),
+                BotCommand("idemode", "🎛️ 设置发送前的 IDE 模式"),
+                BotCommand("quiescence", "⏱️ 设置消息合并等待时间"),
+                BotCommand("pauseall", "⏸️ 全局暂停自动化（管理员）"),
+                BotCommand("resumeall", "▶️ 恢复全局自动化（管理员）"),
+                BotCommand("usetemplates", "🎨 切换模板套装（主题/布局）"),
+                BotCommand("log", "🪵 查看调试日志末尾"),
+                BotCommand("hold", "✋ 暂停发送，继续输入多段消息"),
+                BotCommand("go", "▶️ 发送 /hold 之后收集的消息"),
             ]
             self.bot.set_my_commands(commands)
             logger.info("Bot commands menu registered.")
@@ -231,10 +767,24 @@ class AntigravityBridge:
             disable_web_page_preview=True,
         )
     
+    def handle_id_command(self, update: Update, context: CallbackContext):
+        """处理 /id 命令：回复聊天 ID 和发送者 ID。不受白名单限制，方便新用户查到自己的 ID 申请授权"""
+        chat = update.effective_chat
+        user = update.effective_user
+        lines = [f"🆔 Chat ID: {chat.id}"]
+        if user:
+            lines.append(f"👤 User ID: {user.id}")
+        if chat.type in ("group", "supergroup"):
+            lines.append(f"👥 Group ID: {chat.id}（{chat.title or '未命名群组'}）")
+        if not self.is_chat_allowed(chat.id):
+            lines.append("⚠️ 该聊天不在 ALLOWED_CHAT_IDS 中，请把 Chat ID 发给管理员添加")
+        logger.info(f"/id requested from chat {chat.id} (user {user.id if user else 'N/A'})")
+        self.bot.send_message(chat_id=chat.id, text="\n".join(lines))
+    
     def handle_help_command(self, update: Update, context: CallbackContext):
         """处理 /help 和 /start 命令：显示帮助说明"""
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS:
+        if not self.is_chat_allowed(chat_id):
             return
         
         cwd = self.cli_bridge.cwd if self.cli_bridge else "N/A"
@@ -250,13 +800,14 @@ class AntigravityBridge:
             "适用于：代码分析、修复、终端操作等开发任务。\n\n"
             "可用命令\n"
             "/help - 显示本帮助信息\n"
+            "/id - 查看聊天 ID、用户 ID（用于配置 ALLOWED_CHAT_IDS）\n"
             "/mode - 查看当前模式\n"
             "/mode gui - 切换到 GUI 模式\n"
             "/mode cli - 切换到 CLI 模式\n"
             "/cd <路径> - 切换 CLI 工作目录\n"
-            "/status - 查看 CLI 当前状态\n"
+            "/status - 查看 CLI 当前状态和 GUI 自动化状态\n"
             "/quota - 查询当前 Codex 账号配额\n"
-            "/cancel - 终止当前 CLI 任务\n"
+            "/cancel - 取消当前 GUI 任务或终止当前 CLI 任务\n"
             "/exit - 终止当前 CLI 任务\n"
             "/sessions - 查看最近会话\n"
             "/resume <session_id|last> - 绑定会话继续\n"
@@ -280,7 +831,20 @@ class AntigravityBridge:
             "/history - 查看最近提示词历史\n"
             "/model <name> - 设置 CLI 模型\n"
             "/model default - 恢复默认模型\n"
-            "/screen - 截取并发送桌面截图\n\n"
+            "/screen [png] - 截取并发送桌面截图（png 发送未压缩原图）\n"
+            "/regions - 标注截图中的候选模板区域\n"
+            "/heatmap <模板名> - 查看模板在屏幕上的匹配分数热力图\n"
+            "/settemplate <名称> - 作为图片说明发送，设置本聊天的 GUI 模板\n"
+            "/window [标题|default] - 查看或设置本聊天操作的 IDE 窗口\n"
+            "/instructions [内容|clear] - 设置每个会话开头附带的指令\n"
+            "/policy [minchars N|ignore 正则|clear] - 设置不发送给 IDE 的琐碎消息\n"
+            "/idemode [模式|off] - 设置发送前要确保的 IDE 模式（如 plan / act）\n"
+            "/quiescence [毫秒|default] - 设置本聊天的消息合并等待时间\n"
+            "/pauseall [原因] / /resumeall - 全局暂停/恢复自动化（仅管理员）\n"
+            "/usetemplates [名称|default] - 切换 templates/ 下的模板套装\n"
+            "/log [行数] - 查看调试日志末尾（默认 50 行）\n"
+            "/hold - 暂停发送，继续输入多段消息\n"
+            "/go - 把 /hold 之后收集的消息一起发送\n\n"
             f"当前模式: {self.current_mode}\n"
             f"工作目录: {cwd}"
         )
@@ -290,30 +854,150 @@ class AntigravityBridge:
             parse_mode="MarkdownV2"
         )
     
+    def handle_hold_command(self, update: Update, context: CallbackContext):
+        """处理 /hold 命令：暂停本聊天的消息缓冲 flush，直到 /go"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        count = self.batcher.hold(chat_id)
+        self.bot.send_message(
+            chat_id=chat_id,
+            text=f"✋ 已暂停发送（当前已缓冲 {count} 条）。继续输入，完成后发送 /go。",
+        )
+    
+    def handle_go_command(self, update: Update, context: CallbackContext):
+        """处理 /go 命令：结束 /hold，立即发送收集到的消息"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        count = self.batcher.release(chat_id)
+        if count is None:
+            self.bot.send_message(chat_id=chat_id, text="ℹ️ 当前没有暂停，消息会自动发送。")
+        elif count == 0:
+            self.bot.send_message(chat_id=chat_id, text="ℹ️ 已恢复自动发送（没有缓冲的消息）。")
+        else:
+            self.bot.send_message(chat_id=chat_id, text=f"▶️ 正在发送 {count} 条消息...")
+    
+    def handle_log_command(self, update: Update, context: CallbackContext):
+        """处理 /log [N] 命令：发送调试日志最后 N 行（隐去 Bot Token）"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        
+        count = 50
+        if context.args:
+            try:
+                count = int(context.args[0])
+            except ValueError:
+                self.bot.send_message(chat_id=chat_id, text="用法: /log [行数]，例如 /log 100")
+                return
+        count = max(1, min(count, 1000))
+        
+        try:
+            with open(log_file, 'r', encoding='utf-8', errors='replace') as f:
+                lines = deque(f, maxlen=count)
+        except OSError as e:
+            self.bot.send_message(chat_id=chat_id, text=f"❌ 无法读取日志 {log_file}: {e}")
+            return
+        
+        text = "".join(lines).strip()
+        if not text:
+            self.bot.send_message(chat_id=chat_id, text=f"ℹ️ 日志为空: {log_file}")
+            return
+        
+        token = os.getenv('TELEGRAM_BOT_TOKEN', '')
+        if token:
+            text = text.replace(token, "<TOKEN>")
+        text = re.sub(r'\b\d{6,}:[A-Za-z0-9_-]{30,}\b', "<TOKEN>", text)
+        
+        for chunk in self._split_text(text):
+            self.bot.send_message(chat_id=chat_id, text=chunk)
+    
+    @staticmethod
+    def _split_text(text: str, max_len: int = 4000, keep_fences: bool = False) -> List[str]:
+        """
+        优先按段落（空行）、其次按换行切分为不超过 Telegram 单条长度的片段。
+        
+        keep_fences=True（Markdown 消息）时，在代码块中间切开的片段末尾补上 ```，
+        下一片段开头重新打开同样的代码块（保留语言标记），每段都能单独正确渲染。
+        """
+        budget = max_len - 32 if keep_fences else max_len  # 为补全的代码块标记预留空间
+        chunks = []
+        fence = None  # 当前片段开始时仍未关闭的代码块起始行（如 ```python）
+        while text:
+            prefix = f"{fence}\n" if fence else ""
+            if len(prefix) + len(text) <= max_len:
+                piece, text = text, ""
+            else:
+                limit = budget - len(prefix)
+                split_pos = text.rfind("\n\n", 0, limit)
+                if split_pos < limit // 2:  # 段落太靠前时按行切，避免产生很短的片段
+                    split_pos = text.rfind("\n", 0, limit)
+                if split_pos <= 0:
+                    split_pos = limit
+                piece, text = text[:split_pos], text[split_pos:].lstrip("\n")
+            chunk = prefix + piece
+            if keep_fences:
+                for line in piece.split("\n"):
+                    if line.strip().startswith("```"):
+                        fence = None if fence else line.strip()
+                if fence and text:
+                    chunk += "\n```"
+            chunks.append(chunk)
+        return chunks
+    
+    def _send_screenshot(self, chat_id: int, path: str, caption: Optional[str] = None, raw: bool = False):
+        """
+        发送截图。按 SCREENSHOT_MAX_DIM 缩小、按 SCREENSHOT_JPEG_QUALITY 转 JPEG 后以图片发送，
+        高分屏上明显更快；raw=True 时以文件形式发送原始 PNG。
+        """
+        if raw:
+            with open(path, 'rb') as f:
+                self.bot.send_document(chat_id=chat_id, document=f, filename=os.path.basename(path), caption=caption)
+            return
+        
+        max_dim = self._screenshot_max_dim
+        quality = self._screenshot_jpeg_quality
+        send_path = path
+        if max_dim > 0 or quality > 0:
+            try:
+                with Image.open(path) as img:
+                    img = img.convert('RGB')
+                    if max_dim > 0:
+                        img.thumbnail((max_dim, max_dim))
+                    if quality > 0:
+                        send_path = os.path.splitext(path)[0] + '_send.jpg'
+                        img.save(send_path, format='JPEG', quality=quality, optimize=True)
+                    else:
+                        send_path = os.path.splitext(path)[0] + '_send.png'
+                        img.save(send_path, format='PNG', optimize=True)
+            except Exception as e:
+                logger.warning(f"Screenshot compression failed, sending original: {e}")
+                send_path = path
+        try:
+            with open(send_path, 'rb') as photo:
+                self.bot.send_photo(chat_id=chat_id, photo=photo, caption=caption)
+        finally:
+            if send_path != path:
+                try:
+                    os.remove(send_path)
+                except OSError:
+                    pass
+    
     def handle_screen_command(self, update: Update, context: CallbackContext):
         """处理 /screen 命令：截取屏幕并发送图片"""
         chat_id = update.effective_chat.id
         logger.info(f"Received /screen command from {chat_id}")
         
+        screenshot_path = f'/tmp/telegram_screenshot_{uuid.uuid4().hex[:8]}.png'
         try:
-            import subprocess
-            
             # 截取屏幕
-            screenshot_path = '/tmp/telegram_screenshot.png'
-            result = subprocess.run(
-                ['scrot', screenshot_path],
-                capture_output=True,
-                timeout=10
-            )
-            
-            if result.returncode == 0:
-                # 发送图片到 Telegram
-                with open(screenshot_path, 'rb') as photo:
-                    self.bot.send_photo(
-                        chat_id=chat_id,
-                        photo=photo,
-                        caption="📸 当前屏幕截图"
-                    )
+            ok, _ = take_screenshot(screenshot_path)
+
+            if ok:
+                # 发送图片到 Telegram；/screen png 发送未压缩原图，便于像素级调试
+                raw = bool(context.args) and context.args[0].lower() == "png"
+                self._send_screenshot(chat_id, screenshot_path, caption="📸 当前屏幕截图", raw=raw)
                 logger.info(f"Screenshot sent to {chat_id}")
             else:
                 self.bot.send_message(
@@ -326,120 +1010,534 @@ class AntigravityBridge:
                 chat_id=chat_id,
                 text=f"❌ 截屏失败: {e}"
             )
+        finally:
+            try:
+                os.remove(screenshot_path)
+            except OSError:
+                pass
 
-    def handle_mode_command(self, update: Update, context: CallbackContext):
+    def handle_regions_command(self, update: Update, context: CallbackContext):
+        """处理 /regions 命令：按边缘密度标注候选模板区域，辅助裁剪模板"""
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS:
-            return
-            
-        args = context.args
-        if not args:
-            cwd_info = f"\n📂 工作目录: {self.cli_bridge.cwd}" if self.cli_bridge else ""
-            self.bot.send_message(chat_id=chat_id, text=f"当前模式: {self.current_mode}{cwd_info}\n使用 /mode gui 或 /mode cli 切换。\n使用 /cd <路径> 切换工作目录。")
+        if not self.is_chat_allowed(chat_id):
             return
-            
-        new_mode = args[0].upper()
-        if new_mode == "GUI":
-            self.current_mode = "GUI"
-            self.bot.send_message(chat_id=chat_id, text="🔄 已切换到 Antigravity GUI 模式")
-        elif new_mode == "CLI":
-            self.current_mode = "CLI"
-            if self.cli_bridge and not self.cli_bridge.running:
-                self.cli_bridge.start()
-            cwd_info = f"\n📂 工作目录: {self.cli_bridge.cwd}" if self.cli_bridge else ""
-            self.bot.send_message(chat_id=chat_id, text=f"🔄 已挂载 Codex CLI 模式{cwd_info}")
-        else:
-            self.bot.send_message(chat_id=chat_id, text="❌ 未知模式。支持: gui, cli")
-    
-    def handle_cd_command(self, update: Update, context: CallbackContext):
-        """处理 /cd 命令：切换 CLI 工作目录"""
+        logger.info(f"Received /regions command from {chat_id}")
+
+        run_id = uuid.uuid4().hex[:8]
+        screenshot_path = f'/tmp/telegram_regions_src_{run_id}.png'
+        annotated_path = f'/tmp/telegram_regions_{run_id}.png'
+        try:
+            ok, error = take_screenshot(screenshot_path)
+            if not ok:
+                self.bot.send_message(chat_id=chat_id, text=f"❌ 截屏失败: {error}")
+                return
+
+            regions = find_edge_regions(screenshot_path)
+            if not regions:
+                self.bot.send_message(chat_id=chat_id, text="ℹ️ 未找到边缘密集的候选区域。")
+                return
+
+            annotate_boxes(screenshot_path, regions, annotated_path)
+            # 截图只包含 CAPTURE_GEOMETRY 区域，列出的坐标换算为桌面绝对坐标，可直接用于 REPLYING_REGION 等设置
+            origin_x, origin_y = capture_origin()
+            lines = [f"🔲 候选区域 {len(regions)} 个 (x, y, w, h):"]
+            for idx, (x, y, w, h) in enumerate(regions, start=1):
+                lines.append(f"{idx}. {origin_x + x}, {origin_y + y}, {w}, {h}")
+            self._send_screenshot(chat_id, annotated_path)
+            self.bot.send_message(chat_id=chat_id, text="\n".join(lines))
+        except Exception as e:
+            logger.error(f"/regions error: {e}")
+            self.bot.send_message(chat_id=chat_id, text=f"❌ 区域分析失败: {e}")
+        finally:
+            for path in (screenshot_path, annotated_path):
+                try:
+                    os.remove(path)
+                except OSError:
+                    pass
+
+    def handle_heatmap_command(self, update: Update, context: CallbackContext):
+        """处理 /heatmap 命令：输出模板在当前屏幕上的匹配分数热力图，诊断匹配失败原因"""
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS:
+        if not self.is_chat_allowed(chat_id):
             return
-            
+
         args = context.args
         if not args:
-            cwd = self.cli_bridge.cwd if self.cli_bridge else "未初始化"
-            self.bot.send_message(chat_id=chat_id, text=f"📂 当前工作目录: {cwd}\n使用 /cd <路径> 切换。")
+            self.bot.send_message(chat_id=chat_id, text="用法: /heatmap <模板名>，例如 /heatmap input_box")
             return
-        
-        path = ' '.join(args)  # Support paths with spaces
-        if self.cli_bridge:
-            result = self.cli_bridge.set_cwd(path)
-            self.bot.send_message(chat_id=chat_id, text=result)
-        else:
-            self.bot.send_message(chat_id=chat_id, text="❌ CLI Bridge 未初始化。")
 
-    def handle_status_command(self, update: Update, context: CallbackContext):
-        chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        name = args[0]
+        if not name.lower().endswith(".png"):
+            name += ".png"
+        templates_dir = self._templates_dir_for(chat_id)
+        template_path = os.path.join(templates_dir, os.path.basename(name))
+        if not os.path.exists(template_path):
+            self.bot.send_message(chat_id=chat_id, text=f"❌ 模板不存在: {os.path.basename(name)}")
             return
-        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.get_status(chat_id))
+        logger.info(f"Received /heatmap {name} from {chat_id}")
 
-    def handle_quota_command(self, update: Update, context: CallbackContext):
-        chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
-            return
-        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.get_codex_quota())
+        run_id = uuid.uuid4().hex[:8]
+        screenshot_path = f'/tmp/telegram_heatmap_src_{run_id}.png'
+        heatmap_path = f'/tmp/telegram_heatmap_{run_id}.png'
+        try:
+            ok, error = take_screenshot(screenshot_path)
+            if not ok:
+                self.bot.send_message(chat_id=chat_id, text=f"❌ 截屏失败: {error}")
+                return
 
-    def handle_cancel_command(self, update: Update, context: CallbackContext):
-        chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
-            return
-        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.cancel_active())
+            ok, detail = match_score_heatmap(screenshot_path, template_path, heatmap_path)
+            if not ok:
+                self.bot.send_message(chat_id=chat_id, text=f"❌ 热力图生成失败: {detail}")
+                return
 
-    def handle_exit_command(self, update: Update, context: CallbackContext):
-        chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
-            return
-        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.cancel_active())
+            self._send_screenshot(chat_id, heatmap_path, caption=f"🌡️ {os.path.basename(name)}: {detail}")
+        except Exception as e:
+            logger.error(f"/heatmap error: {e}")
+            self.bot.send_message(chat_id=chat_id, text=f"❌ 热力图生成失败: {e}")
+        finally:
+            for path in (screenshot_path, heatmap_path):
+                try:
+                    os.remove(path)
+                except OSError:
+                    pass
 
-    def handle_sessions_command(self, update: Update, context: CallbackContext):
+    def handle_settemplate_command(self, update: Update, context: CallbackContext):
+        """纯文字的 /settemplate：提示用法（模板需要随图片一起发送）"""
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id):
             return
-        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.format_sessions(chat_id))
+        self.bot.send_message(
+            chat_id=chat_id,
+            text="用法: 以文件形式发送 PNG 截图，并在说明中填写 /settemplate <模板名>\n例如: /settemplate input_box",
+        )
 
-    def handle_new_command(self, update: Update, context: CallbackContext):
-        chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+    def _handle_settemplate_upload(self, message: Message):
+        """处理说明为 /settemplate <名称> 的图片上传，保存为本 chat 的模板覆盖。"""
+        chat_id = message.chat_id
+        parts = (message.caption or "").split()
+        if len(parts) < 2:
+            self.bot.send_message(chat_id=chat_id, text="用法: /settemplate <模板名>，例如 /settemplate input_box")
             return
-        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.clear_session(chat_id))
 
-    def handle_session_command(self, update: Update, context: CallbackContext):
-        chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
-            return
-        self._send_html_message(chat_id, self.cli_bridge.get_session_info(chat_id))
+        name = parts[1]
+        file_id = message.document.file_id if message.document else message.photo[-1].file_id
+        local_path = f"/tmp/tg_template_{chat_id}_{message.message_id}"
+        try:
+            self.bot.get_file(file_id).download(local_path)
+            ok, detail = save_chat_template(self.templates_dir, chat_id, name, local_path)
+        except Exception as e:
+            logger.error(f"/settemplate download error: {e}")
+            ok, detail = False, f"下载失败: {e}"
+        finally:
+            try:
+                os.remove(local_path)
+            except OSError:
+                pass
 
-    def handle_save_command(self, update: Update, context: CallbackContext):
-        chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
-            return
-        self._send_html_message(chat_id, self.cli_bridge.get_save_status(chat_id))
+        if ok:
+            text = f"✅ 已设置本聊天模板: {detail}"
+            if message.photo and not message.document:
+                text += "\n⚠️ 以图片形式发送会被 Telegram 压缩，建议以文件形式发送原图。"
+        else:
+            text = f"❌ 设置模板失败: {detail}"
+        self.bot.send_message(chat_id=chat_id, text=text)
 
-    def handle_pwd_command(self, update: Update, context: CallbackContext):
+    def handle_window_command(self, update: Update, context: CallbackContext):
+        """处理 /window 命令：设置本聊天驱动的 IDE 窗口（按标题子串匹配）"""
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id):
             return
-        self._send_html_message(chat_id, self.cli_bridge.get_pwd_info(chat_id))
-
-    def handle_files_command(self, update: Update, context: CallbackContext):
-        chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        
+        args = context.args
+        if not args:
+            title = self._window_title_for(chat_id)
+            current = f"当前窗口标题: {title}" if title else "当前未指定窗口，操作前台的 antigravity 窗口"
+            self.bot.send_message(
+                chat_id=chat_id,
+                text=f"🪟 {current}\n使用 /window <标题> 设置，/window default 恢复默认。",
+            )
             return
-        self._send_html_message(chat_id, self.cli_bridge.format_recent_uploads(chat_id))
-
-    def handle_ls_command(self, update: Update, context: CallbackContext):
+        
+        title = " ".join(args).strip()
+        if title.lower() in ("default", "clear", "none"):
+            self.chat_settings.set(chat_id, 'window_title', None)
+            self.bot.send_message(chat_id=chat_id, text="🪟 已恢复默认窗口")
+            return
+        
+        self.chat_settings.set(chat_id, 'window_title', title)
+        self.bot.send_message(chat_id=chat_id, text=f"🪟 本聊天将操作标题包含 \"{title}\" 的窗口")
+    
+    def handle_instructions_command(self, update: Update, context: CallbackContext):
+        """处理 /instructions 命令：设置本聊天的会话指令（每个会话的第一条消息前附带一次）"""
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id):
+            return
+        
+        # 保留换行：直接取命令之后的原文，而不是 context.args
+        parts = (update.message.text or "").split(maxsplit=1)
+        text = parts[1].strip() if len(parts) > 1 else ""
+        if not text:
+            current = self.chat_settings.get(chat_id, 'instructions')
+            self.bot.send_message(
+                chat_id=chat_id,
+                text=(f"📝 当前会话指令:\n{current}" if current else "📝 当前未设置会话指令")
+                + "\n\n使用 /instructions <内容> 设置，/instructions clear 清除。",
+            )
+            return
+        
+        if text.lower() in ("clear", "none", "default"):
+            self.chat_settings.set(chat_id, 'instructions', None)
+            self.bot.send_message(chat_id=chat_id, text="📝 已清除会话指令")
+            return
+        
+        self.chat_settings.set(chat_id, 'instructions', text)
+        # 让下一条消息按新会话处理，立即带上新指令
+        self._last_prompt_times.pop(chat_id, None)
+        self.bot.send_message(chat_id=chat_id, text="📝 已设置会话指令，将在每个会话的第一条消息前附带")
+    
+    def handle_policy_command(self, update: Update, context: CallbackContext):
+        """处理 /policy 命令：设置本聊天的内容策略（过短或匹配忽略正则的纯文字消息不发送给 IDE）"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        
+        args = context.args or []
+        usage = "用法: /policy minchars <N> | /policy ignore <正则> | /policy clear"
+        if not args:
+            min_chars, pattern = self._content_policy(chat_id)
+            self.bot.send_message(
+                chat_id=chat_id,
+                text=f"🚦 最少字符数: {min_chars or '不限'}\n🚦 忽略正则: {pattern or '无'}\n{usage}",
+            )
+            return
+        
+        action = args[0].lower()
+        if action == "clear":
+            self.chat_settings.set(chat_id, 'min_content_chars', None)
+            self.chat_settings.set(chat_id, 'ignore_pattern', None)
+            self.bot.send_message(chat_id=chat_id, text="🚦 已恢复默认内容策略")
+        elif action == "minchars" and len(args) == 2 and args[1].isdigit():
+            self.chat_settings.set(chat_id, 'min_content_chars', int(args[1]))
+            self.bot.send_message(chat_id=chat_id, text=f"🚦 少于 {args[1]} 个字符的纯文字消息将不发送给 IDE")
+        elif action == "ignore" and len(args) >= 2:
+            pattern = " ".join(args[1:])
+            try:
+                re.compile(pattern)
+            except re.error as e:
+                self.bot.send_message(chat_id=chat_id, text=f"❌ 正则无效: {e}")
+                return
+            self.chat_settings.set(chat_id, 'ignore_pattern', pattern)
+            self.bot.send_message(chat_id=chat_id, text=f"🚦 完全匹配 {pattern} 的纯文字消息将不发送给 IDE")
+        else:
+            self.bot.send_message(chat_id=chat_id, text=usage)
+    
+    def _content_policy(self, chat_id: int) -> Tuple[int, str]:
+        """本聊天的 (最少字符数, 忽略正则)：/policy 设置优先，其次 MIN_CONTENT_CHARS / IGNORE_PATTERN。"""
+        min_chars = self.chat_settings.get(chat_id, 'min_content_chars')
+        if min_chars is None:
+            try:
+                min_chars = int(os.getenv('MIN_CONTENT_CHARS', '0') or 0)
+            except ValueError:
+                min_chars = 0
+        pattern = self.chat_settings.get(chat_id, 'ignore_pattern')
+        if pattern is None:
+            pattern = os.getenv('IGNORE_PATTERN', '')
+        return min_chars, pattern
+    
+    def _is_trivial_text(self, chat_id: int, text: str) -> bool:
+        """纯文字消息是否按内容策略视为琐碎内容（如 "ok"、"谢谢"），不值得驱动一次 IDE。"""
+        min_chars, pattern = self._content_policy(chat_id)
+        stripped = text.strip()
+        if min_chars and len(stripped) < min_chars:
+            return True
+        if pattern:
+            try:
+                return re.fullmatch(pattern, stripped, re.IGNORECASE) is not None
+            except re.error as e:
+                logger.warning(f"Invalid ignore pattern for chat {chat_id}: {e}")
+        return False
+    
+    def _session_instructions(self, chat_id: int) -> Optional[str]:
+        """
+        新会话（首次或距上一条超过 SESSION_IDLE_MINUTES，默认 30 分钟）时返回本聊天的会话指令，
+        同一会话后续消息返回 None，避免每条都重复附带。
+        """
+        now = time.time()
+        last = self._last_prompt_times.get(chat_id)
+        self._last_prompt_times[chat_id] = now
+        instructions = self.chat_settings.get(chat_id, 'instructions')
+        if not instructions:
+            return None
+        try:
+            idle_seconds = float(os.getenv('SESSION_IDLE_MINUTES', '30') or 30) * 60
+        except ValueError:
+            idle_seconds = 30 * 60
+        if last is not None and now - last < idle_seconds:
+            return None
+        logger.info(f"New session for chat {chat_id}, prepending instructions")
+        return instructions
+    
+    def handle_idemode_command(self, update: Update, context: CallbackContext):
+        """处理 /idemode 命令：设置本聊天发送前要确保的 IDE 交互模式（如 plan / act）"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        
+        args = context.args
+        if not args:
+            mode = self._ide_mode_for(chat_id)
+            current = f"当前模式: {mode}" if mode else "当前不检查模式，按 IDE 上次选择的模式发送"
+            self.bot.send_message(
+                chat_id=chat_id,
+                text=f"🎛️ {current}\n使用 /idemode <模式> 设置（需要 mode_<模式>.png 和 mode_toggle.png 模板），/idemode off 关闭。",
+            )
+            return
+        
+        mode = args[0].strip().lower()
+        if mode in ("off", "default", "none"):
+            self.chat_settings.set(chat_id, 'ide_mode', None)
+            self.bot.send_message(chat_id=chat_id, text="🎛️ 已恢复默认（IDE_MODE）")
+            return
+        if not re.fullmatch(r'[a-z0-9_-]+', mode):
+            self.bot.send_message(chat_id=chat_id, text="❌ 模式名只能包含字母、数字、下划线和连字符")
+            return
+        
+        self.chat_settings.set(chat_id, 'ide_mode', mode)
+        self.bot.send_message(chat_id=chat_id, text=f"🎛️ 本聊天发送前将确保 IDE 处于 {mode} 模式")
+    
+    def _ide_mode_for(self, chat_id: int) -> Optional[str]:
+        """本聊天期望的 IDE 交互模式：/idemode 设置优先，其次 IDE_MODE。"""
+        return self.chat_settings.get(chat_id, 'ide_mode') or os.getenv('IDE_MODE', '').strip().lower() or None
+    
+    def _window_title_for(self, chat_id: int) -> Optional[str]:
+        """本聊天的目标窗口标题：/window 设置优先，其次 IDE_WINDOW_TITLE。"""
+        return self.chat_settings.get(chat_id, 'window_title') or os.getenv('IDE_WINDOW_TITLE', '').strip() or None
+
+    def handle_usetemplates_command(self, update: Update, context: CallbackContext):
+        """处理 /usetemplates 命令：运行时切换 templates/<名称> 模板套装（如切换主题后）"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        
+        available = self._template_sets()
+        if not context.args:
+            current = self.active_template_set or "default"
+            options = ", ".join(["default"] + available)
+            self.bot.send_message(
+                chat_id=chat_id,
+                text=f"🎨 当前模板套装: {current}\n可用: {options}\n使用 /usetemplates <名称> 切换。",
+            )
+            return
+        
+        name = context.args[0].strip()
+        if name.lower() == "default":
+            self.active_template_set = None
+            self.bot.send_message(chat_id=chat_id, text="🎨 已切换回默认模板")
+            return
+        if name not in available:
+            self.bot.send_message(
+                chat_id=chat_id,
+                text=f"❌ 模板套装不存在或缺少 input_box.png: {name}\n可用: {', '.join(available) or '无'}",
+            )
+            return
+        
+        self.active_template_set = name
+        logger.info(f"Active template set switched to {name} by {chat_id}")
+        self.bot.send_message(chat_id=chat_id, text=f"🎨 已切换到模板套装: {name}（之后的任务生效）")
+    
+    def _template_sets(self) -> List[str]:
+        """templates/ 下包含 input_box.png 的子目录名，即可用的模板套装。"""
+        try:
+            entries = sorted(os.listdir(self.templates_dir))
+        except OSError:
+            return []
+        return [
+            name for name in entries
+            if os.path.isfile(os.path.join(self.templates_dir, name, "input_box.png"))
+        ]
+
+    def _templates_dir_for(self, chat_id: int) -> str:
+        """优先使用该 chat 通过 /settemplate 设置的模板目录，其次 /usetemplates 选择的套装。"""
+        chat_dir = get_chat_templates_dir(chat_id)
+        if chat_dir:
+            return chat_dir
+        if self.active_template_set:
+            return os.path.join(self.templates_dir, self.active_template_set)
+        return self.templates_dir
+
+    def handle_mode_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+            
+        args = context.args
+        if not args:
+            cwd_info = f"\n📂 工作目录: {self.cli_bridge.cwd}" if self.cli_bridge else ""
+            self.bot.send_message(chat_id=chat_id, text=f"当前模式: {self.current_mode}{cwd_info}\n使用 /mode gui 或 /mode cli 切换。\n使用 /cd <路径> 切换工作目录。")
+            return
+            
+        new_mode = args[0].upper()
+        if new_mode == "GUI":
+            self.current_mode = "GUI"
+            self.bot.send_message(chat_id=chat_id, text="🔄 已切换到 Antigravity GUI 模式")
+        elif new_mode == "CLI":
+            self.current_mode = "CLI"
+            if self.cli_bridge and not self.cli_bridge.running:
+                self.cli_bridge.start()
+            cwd_info = f"\n📂 工作目录: {self.cli_bridge.cwd}" if self.cli_bridge else ""
+            self.bot.send_message(chat_id=chat_id, text=f"🔄 已挂载 Codex CLI 模式{cwd_info}")
+        else:
+            self.bot.send_message(chat_id=chat_id, text="❌ 未知模式。支持: gui, cli")
+    
+    def handle_cd_command(self, update: Update, context: CallbackContext):
+        """处理 /cd 命令：切换 CLI 工作目录"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+            
+        args = context.args
+        if not args:
+            cwd = self.cli_bridge.cwd if self.cli_bridge else "未初始化"
+            self.bot.send_message(chat_id=chat_id, text=f"📂 当前工作目录: {cwd}\n使用 /cd <路径> 切换。")
+            return
+        
+        path = ' '.join(args)  # Support paths with spaces
+        if self.cli_bridge:
+            result = self.cli_bridge.set_cwd(path)
+            self.bot.send_message(chat_id=chat_id, text=result)
+        else:
+            self.bot.send_message(chat_id=chat_id, text="❌ CLI Bridge 未初始化。")
+
+    def handle_status_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        self._send_status_report(chat_id)
+
+    def _send_status_report(self, chat_id: int):
+        state, elapsed = get_automation_state()
+        labels = {
+            AutomationState.IDLE: "空闲",
+            AutomationState.PASTING: "正在粘贴提示词",
+            AutomationState.MONITORING: "等待 IDE 回复",
+        }
+        gui_status = f"🖥️ GUI 状态: {labels[state]}（已 {int(elapsed)} 秒）"
+        if self.batcher.pending(chat_id):
+            gui_status += f"\n📥 待发送消息: {self.batcher.pending(chat_id)} 条"
+        temp_count, temp_size = temp_file_stats()
+        gui_status += f"\n🗑️ 临时文件: {temp_count} 个，{temp_size / 1024 / 1024:.1f} MB"
+        for item in check_dependencies():
+            gui_status += f"\n⚠️ 缺少依赖: {item}"
+        if not self.cli_bridge:
+            self.bot.send_message(chat_id=chat_id, text=gui_status)
+            return
+        self.bot.send_message(chat_id=chat_id, text=f"{self.cli_bridge.get_status(chat_id)}\n\n{gui_status}")
+
+    def handle_quota_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
+            return
+        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.get_codex_quota())
+
+    def handle_cancel_command(self, update: Update, context: CallbackContext):
+        """处理 /cancel 命令：取消本聊天进行中或排队中的 GUI 任务，没有时终止当前 CLI 任务"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        with self._gui_cancel_lock:
+            pending = [event for event in self._gui_cancel_events.get(chat_id, []) if not event.is_set()]
+            for event in pending:
+                event.set()
+        if pending:
+            logger.info(f"Cancelling {len(pending)} GUI workflow(s) for chat {chat_id}")
+            self.bot.send_message(chat_id=chat_id, text=f"🛑 正在取消 {len(pending)} 个 GUI 任务...")
+            return
+        if not self.cli_bridge:
+            self.bot.send_message(chat_id=chat_id, text="ℹ️ 当前没有进行中的任务")
+            return
+        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.cancel_active())
+
+    def handle_task_callback(self, update: Update, context: CallbackContext):
+        """处理“处理中”消息上的内联按钮（callback_data: task:cancel:<workflow_id> | task:status）"""
+        query = update.callback_query
+        chat_id = query.message.chat.id if query.message else None
+        if not self.is_chat_allowed(chat_id):
+            query.answer()
+            return
+        
+        parts = (query.data or '').split(':')
+        action = parts[1] if len(parts) > 1 else ''
+        if action == 'status':
+            query.answer()
+            self._send_status_report(chat_id)
+            return
+        if action != 'cancel':
+            query.answer()
+            return
+        
+        workflow_id = parts[2] if len(parts) > 2 else ''
+        with self._gui_cancel_lock:
+            owner_chat_id, event = self._gui_task_events.get(workflow_id, (None, None))
+        # 只允许取消按钮所在 chat 自己的工作流，伪造的 workflow_id 不能取消别的 chat 的任务
+        if event is None or owner_chat_id != chat_id or event.is_set():
+            query.answer("该任务已结束或已取消")
+            return
+        logger.info(f"Cancelling GUI workflow {workflow_id} for chat {chat_id} via inline button")
+        event.set()
+        query.answer("🛑 正在取消...")
+
+    def handle_exit_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
+            return
+        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.cancel_active())
+
+    def handle_sessions_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
+            return
+        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.format_sessions(chat_id))
+
+    def handle_new_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
+            return
+        self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.clear_session(chat_id))
+
+    def handle_session_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
+            return
+        self._send_html_message(chat_id, self.cli_bridge.get_session_info(chat_id))
+
+    def handle_save_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
+            return
+        self._send_html_message(chat_id, self.cli_bridge.get_save_status(chat_id))
+
+    def handle_pwd_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
+            return
+        self._send_html_message(chat_id, self.cli_bridge.get_pwd_info(chat_id))
+
+    def handle_files_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
+            return
+        self._send_html_message(chat_id, self.cli_bridge.format_recent_uploads(chat_id))
+
+    def handle_ls_command(self, update: Update, context: CallbackContext):
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         path = " ".join(context.args).strip() if context.args else "."
         self._send_html_message(chat_id, self.cli_bridge.list_directory(path))
 
     def handle_cat_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         if not context.args:
             self.bot.send_message(chat_id=chat_id, text="用法: /cat <文件路径>")
@@ -449,7 +1547,7 @@ class AntigravityBridge:
 
     def handle_repeat_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         last_prompt = self.cli_bridge.get_last_prompt(chat_id)
         if not last_prompt:
@@ -460,7 +1558,7 @@ class AntigravityBridge:
 
     def handle_search_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         if not context.args:
             self.bot.send_message(chat_id=chat_id, text="用法: /search <pattern> [路径]")
@@ -472,7 +1570,7 @@ class AntigravityBridge:
 
     def handle_tail_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         if not context.args:
             self.bot.send_message(chat_id=chat_id, text="用法: /tail <文件路径>")
@@ -482,7 +1580,7 @@ class AntigravityBridge:
 
     def handle_run_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         if not context.args:
             self.bot.send_message(chat_id=chat_id, text="用法: /run <shell command>")
@@ -492,21 +1590,21 @@ class AntigravityBridge:
 
     def handle_diff_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         path = " ".join(context.args).strip() if context.args else None
         self._send_html_message(chat_id, self.cli_bridge.diff_workspace(path))
 
     def handle_tree_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         path = " ".join(context.args).strip() if context.args else "."
         self._send_html_message(chat_id, self.cli_bridge.tree_directory(path))
 
     def handle_open_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         if not context.args:
             self.bot.send_message(chat_id=chat_id, text="用法: /open <路径>")
@@ -516,20 +1614,20 @@ class AntigravityBridge:
 
     def handle_gitstatus_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         path = " ".join(context.args).strip() if context.args else None
         self._send_html_message(chat_id, self.cli_bridge.git_status(path))
 
     def handle_history_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         self._send_html_message(chat_id, self.cli_bridge.get_prompt_history(chat_id))
 
     def handle_resume_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
 
         args = context.args
@@ -549,13 +1647,13 @@ class AntigravityBridge:
 
     def handle_last_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
         self.bot.send_message(chat_id=chat_id, text=self.cli_bridge.resume_session(chat_id, "last"))
 
     def handle_model_command(self, update: Update, context: CallbackContext):
         chat_id = update.effective_chat.id
-        if chat_id not in self.ALLOWED_CHAT_IDS or not self.cli_bridge:
+        if not self.is_chat_allowed(chat_id) or not self.cli_bridge:
             return
 
         args = context.args
@@ -577,59 +1675,403 @@ class AntigravityBridge:
         except Exception as e:
             logger.error(f"Error logging update: {e}")
 
-        if not update.message:
+        # 编辑过的消息：PROCESS_EDITS=1 时按更长的静默窗口去抖后处理，
+        # 否则只在原消息仍在缓冲区时替换为修改后的内容（见下方）
+        edited = update.edited_message is not None and update.message is None
+        
+        message = update.message or update.edited_message
+        if not message:
             return
-            
-        message = update.message
         chat_id = message.chat_id
         
         # 检查 chat_id 是否在白名单中
-        if chat_id not in self.ALLOWED_CHAT_IDS:
+        if not self.is_chat_allowed(chat_id):
             logger.warning(f"Ignored message from unauthorized chat_id: {chat_id}")
+            if self._unauthorized_reply and chat_id not in self._notified_unauthorized:
+                self._notified_unauthorized.add(chat_id)
+                try:
+                    self.bot.send_message(
+                        chat_id=chat_id,
+                        text=f"🚫 抱歉，该聊天未获授权使用此 Bot。\n如需使用，请把 Chat ID {chat_id} 发给管理员添加到白名单。",
+                    )
+                except Exception as e:
+                    logger.error(f"Error sending unauthorized notice: {e}")
+            return
+        
+        # 说明为 /settemplate 的图片是模板上传，不进入消息缓冲
+        caption_words = (message.caption or "").split()
+        caption_command = caption_words[0].split('@')[0] if caption_words else ""
+        if caption_command == '/settemplate' and (message.photo or message.document):
+            self._handle_settemplate_upload(message)
+            return
+        
+        accepted, stripped = self._accept_trigger(message)
+        if not accepted:
+            logger.debug(f"Ignored message {message.message_id} from {chat_id}: no TRIGGER_PREFIX")
+            return
+        if stripped is not None:
+            # 去掉前缀后的副本进入缓冲，不修改 Telegram 传入的原消息
+            attr = 'text' if message.text else 'caption'
+            message = Message.de_json(dict(message.to_dict(), **{attr: stripped}), self.bot)
+        
+        cooldown = self._quota_cooldown(chat_id)
+        if cooldown is not None and not self.batcher.pending(chat_id):
+            minutes = max(1, int(cooldown // 60) + (1 if cooldown % 60 else 0))
+            logger.info(f"Chat {chat_id} over quota, cooldown {int(cooldown)}s")
+            self.bot.send_message(
+                chat_id=chat_id,
+                text=f"⏳ 已达到使用配额，约 {minutes} 分钟后可再次发送。",
+            )
             return
         
         # 更新 MCP Server 的 last_chat_id，用于自动回复
         if self.mcp_server:
             self.mcp_server.set_last_chat_id(str(chat_id))
         
-        with self.buffer_lock:
-            buf = self.buffer_map[chat_id]
-            buf.messages.append(message)
-            
-            logger.info(f"Buffered message from {chat_id}. Total: {len(buf.messages)}")
-            
-            # Reset/Start Timer
-            if buf.timer:
-                buf.timer.cancel()
-            
-            # Wait 4 seconds quiescence before processing (多图消息需要更长时间到达)
-            buf.timer = threading.Timer(
-                4.0,
-                self._process_batch,
-                args=(chat_id,)
-            )
-            buf.timer.start()
-    
-    def _process_batch(self, chat_id: int):
-        """Process a batch of buffered messages."""
-        with self.buffer_lock:
-            if chat_id not in self.buffer_map:
+        if edited and not self._process_edits:
+            if self.batcher.replace(chat_id, message):
+                logger.info(f"Replaced buffered message {message.message_id} from {chat_id} with its edit")
                 return
-            buf = self.buffer_map.pop(chat_id)
-            messages = buf.messages
+            if not self.batcher.was_flushed(chat_id, message.message_id):
+                # 从未发送过的消息（被配额、暂停、前缀等过滤掉，或是很早的历史消息），静默忽略
+                logger.debug(f"Ignored edit of unsent message {message.message_id} from {chat_id}")
+                return
+            logger.info(f"Ignored edit of already sent message {message.message_id} from {chat_id}")
+            try:
+                self.bot.send_message(
+                    chat_id=chat_id,
+                    text="✏️ 这条消息已经发送给 IDE，修改不会生效。请把更正内容作为新消息发送（或设置 PROCESS_EDITS=1 自动重发编辑后的消息）。",
+                    reply_to_message_id=message.message_id,
+                )
+            except Exception as e:
+                logger.error(f"Error sending edit notice: {e}")
+            return
+        if edited:
+            total = self.batcher.add(chat_id, message, quiescence=self._edit_debounce_seconds, edited=True)
+            logger.info(f"Buffered edited message {message.message_id} from {chat_id}. Total: {total}")
+        else:
+            total = self.batcher.add(chat_id, message, quiescence=self._quiescence_for(chat_id))
+            if total is None:
+                logger.info(f"Skipped duplicate delivery of message {message.message_id} from {chat_id}")
+            else:
+                logger.info(f"Buffered message from {chat_id}. Total: {total}")
+    
+    def _accept_trigger(self, message: Message) -> Tuple[bool, Optional[str]]:
+        """
+        TRIGGER_PREFIX（如 !ai）设置后，群聊中只有以该前缀或 @Bot 用户名开头的消息才发送给 IDE，
+        前缀在粘贴前去掉；私聊中前缀可有可无。未设置时所有消息都会发送（原有行为）。
+        
+        不带文字的图片、文件、语音跟在已触发、仍在缓冲中的消息后面时一并发送。
         
-        if not messages:
+        Returns:
+            (accepted, stripped)：accepted 为 False 表示该消息是普通聊天，应忽略；
+            stripped 为去掉前缀后的文字（或说明），不需要改写时为 None
+        """
+        prefix = os.getenv('TRIGGER_PREFIX', '').strip()
+        if not prefix:
+            return True, None
+        attr = 'text' if message.text else 'caption' if message.caption else None
+        if attr is None:
+            return message.chat.type == 'private' or bool(self.batcher.pending(message.chat_id)), None
+        
+        triggers = [prefix]
+        try:
+            if self.bot.username:
+                triggers.append(f"@{self.bot.username}")
+        except Exception as e:
+            logger.debug(f"Could not get bot username for trigger matching: {e}")
+        content = getattr(message, attr)
+        matched = False
+        # 依次去掉前缀和 @Bot 用户名，兼容 /prompt@BotName 这样的写法
+        for trigger in triggers:
+            if not content.lower().startswith(trigger.lower()):
+                continue
+            rest = content[len(trigger):]
+            # 前缀后必须是结尾、空白或标点，避免 !ai 误匹配 !aiko、@Bot 误匹配 @BotFan
+            if rest and self._is_word_char(trigger[-1]) and self._is_word_char(rest[0]):
+                continue
+            content = rest.lstrip(" \t\n:：,，")
+            matched = True
+        if matched:
+            return True, content
+        return message.chat.type == 'private', None
+    
+    @staticmethod
+    def _is_word_char(char: str) -> bool:
+        return char.isalnum() or char == '_'
+    
+    def _seconds_until_active(self) -> float:
+        """
+        距离 ACTIVE_HOURS 开始还有多少秒；未配置或当前在工作时间内返回 0。
+        
+        按 ACTIVE_HOURS_TZ（如 Asia/Shanghai）计算，未设置时使用本机时区。
+        """
+        spec = os.getenv('ACTIVE_HOURS', '').strip()
+        if not spec:
+            return 0
+        window = parse_active_hours(spec)
+        if window is None:
+            logger.warning(f"ACTIVE_HOURS={spec!r} is invalid (expected HH:MM-HH:MM with start != end), ignored")
+            return 0
+        
+        tz_name = os.getenv('ACTIVE_HOURS_TZ', '').strip()
+        now = datetime.now()
+        if tz_name:
+            try:
+                from zoneinfo import ZoneInfo
+                now = datetime.now(ZoneInfo(tz_name))
+            except Exception as e:
+                logger.warning(f"ACTIVE_HOURS_TZ={tz_name!r} is invalid, using local time: {e}")
+        
+        start, end = window
+        minute = now.hour * 60 + now.minute
+        active = start <= minute < end if start <= end else (minute >= start or minute < end)
+        if active:
+            return 0
+        opens = now.replace(hour=start // 60, minute=start % 60, second=0, microsecond=0)
+        if opens <= now:
+            opens += timedelta(days=1)
+        return (opens - now).total_seconds()
+    
+    def _defer_offhours_batch(self, chat_id: int, messages: List[Message], wait_seconds: float):
+        """
+        工作时间外的批次：ACTIVE_HOURS_POLICY=queue（默认）排队到工作时间开始后处理，
+        reject 直接拒绝。两种情况都会告知用户。
+        """
+        opens_at = os.getenv('ACTIVE_HOURS', '').split('-')[0].strip()
+        if os.getenv('ACTIVE_HOURS_POLICY', 'queue').strip().lower() == 'reject':
+            logger.info(f"Outside active hours, rejecting batch for chat {chat_id}")
+            text = f"🌙 当前不在工作时间，消息未处理，请在 {opens_at} 之后重新发送。"
+        else:
+            with self._offhours_lock:
+                self._offhours_queue.append((chat_id, messages))
+                if self._offhours_timer is None:
+                    # 多留几秒，避免计时误差导致刚好还差一点进入工作时间
+                    self._offhours_timer = threading.Timer(wait_seconds + 5, self._flush_offhours_queue)
+                    self._offhours_timer.daemon = True
+                    self._offhours_timer.start()
+            logger.info(f"Outside active hours, queued batch for chat {chat_id} until {opens_at}")
+            text = f"🌙 当前不在工作时间，消息已排队，将在 {opens_at} 之后自动处理。"
+        try:
+            self.bot.send_message(chat_id=chat_id, text=text)
+        except Exception as e:
+            logger.error(f"Error sending off-hours notice: {e}")
+    
+    def _flush_offhours_queue(self):
+        """工作时间开始后依次处理排队的批次（仍在工作时间外时会再次排队）。"""
+        with self._offhours_lock:
+            queued, self._offhours_queue = self._offhours_queue, []
+            self._offhours_timer = None
+        logger.info(f"Active hours started, processing {len(queued)} queued batches")
+        for chat_id, messages in queued:
+            self._process_batch(chat_id, messages)
+    
+    def _paused_reason(self) -> Optional[str]:
+        """全局暂停时返回暂停原因（可能为空字符串），未暂停返回 None。"""
+        try:
+            with open(PAUSE_STATE_FILE, 'r', encoding='utf-8') as f:
+                return f.read().strip()
+        except FileNotFoundError:
+            return None
+        except Exception as e:
+            logger.error(f"Failed to read pause state {PAUSE_STATE_FILE}: {e}")
+            return ""
+    
+    def _is_admin(self, update: Update) -> bool:
+        user = update.effective_user
+        return update.effective_chat.id in self.ADMIN_CHAT_IDS or bool(user and user.id in self.ADMIN_CHAT_IDS)
+    
+    def handle_pauseall_command(self, update: Update, context: CallbackContext):
+        """处理 /pauseall 命令：管理员全局暂停所有聊天的自动化（重启后仍保持）"""
+        chat_id = update.effective_chat.id
+        if not self._is_admin(update):
+            logger.warning(f"Ignored /pauseall from non-admin chat_id: {chat_id}")
             return
-            
+        
+        reason = " ".join(context.args or []).strip()
+        try:
+            os.makedirs(os.path.dirname(PAUSE_STATE_FILE), exist_ok=True)
+            with open(PAUSE_STATE_FILE, 'w', encoding='utf-8') as f:
+                f.write(reason)
+        except Exception as e:
+            self.bot.send_message(chat_id=chat_id, text=f"❌ 无法保存暂停状态: {e}")
+            return
+        logger.warning(f"Automation paused by chat {chat_id}: {reason}")
+        self.bot.send_message(
+            chat_id=chat_id,
+            text="⏸️ 已暂停所有聊天的自动化，新消息会收到维护提示。使用 /resumeall 恢复。",
+        )
+    
+    def handle_resumeall_command(self, update: Update, context: CallbackContext):
+        """处理 /resumeall 命令：管理员恢复全局自动化"""
+        chat_id = update.effective_chat.id
+        if not self._is_admin(update):
+            logger.warning(f"Ignored /resumeall from non-admin chat_id: {chat_id}")
+            return
+        
+        try:
+            os.remove(PAUSE_STATE_FILE)
+        except FileNotFoundError:
+            self.bot.send_message(chat_id=chat_id, text="ℹ️ 当前未暂停")
+            return
+        except Exception as e:
+            self.bot.send_message(chat_id=chat_id, text=f"❌ 无法清除暂停状态: {e}")
+            return
+        logger.warning(f"Automation resumed by chat {chat_id}")
+        self.bot.send_message(chat_id=chat_id, text="▶️ 已恢复所有聊天的自动化")
+    
+    def _quiescence_for(self, chat_id: int) -> Optional[float]:
+        """本聊天的缓冲静默窗口（秒）：/quiescence 设置优先，None 表示使用 BUFFER_QUIESCENCE_MS。"""
+        ms = self.chat_settings.get(chat_id, 'buffer_quiescence_ms')
+        return ms / 1000.0 if ms is not None else None
+    
+    def handle_quiescence_command(self, update: Update, context: CallbackContext):
+        """处理 /quiescence 命令：设置本聊天的消息合并等待时间（毫秒）"""
+        chat_id = update.effective_chat.id
+        if not self.is_chat_allowed(chat_id):
+            return
+        
+        args = context.args
+        if not args:
+            current = self._quiescence_for(chat_id)
+            seconds = self.batcher.quiescence if current is None else current
+            self.bot.send_message(
+                chat_id=chat_id,
+                text=(
+                    f"⏱️ 最后一条消息后等待 {int(seconds * 1000)} ms 再合并发送"
+                    f"{'（默认）' if current is None else ''}\n"
+                    "使用 /quiescence <毫秒> 设置，/quiescence default 恢复默认。"
+                ),
+            )
+            return
+        
+        value = args[0].strip().lower()
+        if value in ("default", "clear", "none"):
+            self.chat_settings.set(chat_id, 'buffer_quiescence_ms', None)
+            self.bot.send_message(chat_id=chat_id, text="⏱️ 已恢复默认等待时间")
+            return
+        if not value.isdigit() or not 0 < int(value) <= 60000:
+            self.bot.send_message(chat_id=chat_id, text="❌ 请输入 1-60000 之间的毫秒数")
+            return
+        
+        self.chat_settings.set(chat_id, 'buffer_quiescence_ms', int(value))
+        self.bot.send_message(chat_id=chat_id, text=f"⏱️ 本聊天将在最后一条消息后等待 {value} ms 再合并发送")
+    
+    def _quota_cooldown(self, chat_id: int) -> Optional[float]:
+        """
+        按滑动窗口检查 chat 的批次配额，超出时返回还需等待的秒数，否则返回 None。
+        
+        CHAT_QUOTA_PER_HOUR / CHAT_QUOTA_PER_DAY 为 0 或未设置时不限制。
+        """
+        limits = []
+        for env_name, window in (('CHAT_QUOTA_PER_HOUR', 3600), ('CHAT_QUOTA_PER_DAY', 86400)):
+            try:
+                limit = int(os.getenv(env_name, '0') or 0)
+            except ValueError:
+                limit = 0
+            if limit > 0:
+                limits.append((limit, window))
+        if not limits:
+            return None
+        
+        now = time.time()
+        with self._chat_usage_lock:
+            usage = self._chat_usage.get(chat_id)
+            if not usage:
+                return None
+            while usage and now - usage[0] >= 86400:
+                usage.popleft()
+            cooldown = None
+            for limit, window in limits:
+                recent = [ts for ts in usage if now - ts < window]
+                if len(recent) >= limit:
+                    # 窗口内第 (len - limit + 1) 早的记录过期后才能再发
+                    wait = recent[len(recent) - limit] + window - now
+                    cooldown = max(cooldown or 0, wait)
+            return cooldown
+    
+    def _rate_limit_wait(self, chat_id: int) -> Optional[float]:
+        """
+        每分钟最多 RATE_LIMIT_PER_MIN 个批次的令牌桶（允许突发到 N 个）。
+        
+        有令牌时消耗一个并返回 None，否则返回还需等待的秒数。未设置或为 0 时不限制。
+        已回满的桶等同于没有桶，顺带清理掉，安静下来的 chat 不会一直占用内存。
+        """
+        try:
+            limit = int(os.getenv('RATE_LIMIT_PER_MIN', '0') or 0)
+        except ValueError:
+            limit = 0
+        if limit <= 0:
+            return None
+        
+        rate = limit / 60.0
+        now = time.time()
+        with self._rate_lock:
+            for other_id, (tokens, updated) in list(self._rate_buckets.items()):
+                if tokens + (now - updated) * rate >= limit:
+                    del self._rate_buckets[other_id]
+            tokens, updated = self._rate_buckets.get(chat_id, (float(limit), now))
+            tokens = min(float(limit), tokens + (now - updated) * rate)
+            if tokens < 1:
+                self._rate_buckets[chat_id] = (tokens, now)
+                return (1 - tokens) / rate
+            self._rate_buckets[chat_id] = (tokens - 1, now)
+            return None
+    
+    def _record_usage(self, chat_id: int):
+        with self._chat_usage_lock:
+            self._chat_usage.setdefault(chat_id, deque()).append(time.time())
+    
+    def _process_batch(self, chat_id: int, messages: List[Message]):
+        """Process a batch of buffered messages."""
         logger.info(f"Processing Batch for Chat {chat_id} with {len(messages)} messages")
+        paused_reason = self._paused_reason()
+        if paused_reason is not None:
+            logger.info(f"Automation paused, rejecting batch for chat {chat_id}")
+            try:
+                self.bot.send_message(
+                    chat_id=chat_id,
+                    text=f"🛠️ 系统维护中，暂停处理消息，请稍后重新发送。{paused_reason}".strip(),
+                )
+            except Exception as e:
+                logger.error(f"Error sending maintenance notice: {e}")
+            return
+        wait_seconds = self._seconds_until_active() if self.current_mode == "GUI" else 0
+        if wait_seconds > 0:
+            self._defer_offhours_batch(chat_id, messages, wait_seconds)
+            return
+        rate_wait = self._rate_limit_wait(chat_id)
+        if rate_wait is not None:
+            logger.info(f"Chat {chat_id} rate limited, rejecting batch of {len(messages)} message(s)")
+            try:
+                self.bot.send_message(
+                    chat_id=chat_id,
+                    text=(
+                        f"🐢 发送太频繁了，请慢一点：每分钟最多处理 {os.getenv('RATE_LIMIT_PER_MIN')} 个任务。"
+                        f"本次消息未发送给 IDE，请约 {max(1, int(rate_wait + 0.999))} 秒后重新发送。"
+                    ),
+                )
+            except Exception as e:
+                logger.error(f"Error sending rate limit notice: {e}")
+            return
+        self._record_usage(chat_id)
         
         # Sort by message ID
+        # 编辑不会改变 message_id，批次中被替换的编辑版仍排在原消息的位置
         messages.sort(key=lambda m: m.message_id)
+        self.last_trigger_message_ids[chat_id] = messages[-1].message_id
+        # 每个批次唯一的工作流 ID，用于临时文件名，避免同一 chat 的两个批次互相覆盖/删除附件
+        workflow_id = uuid.uuid4().hex[:8]
+        logger.info(f"Batch for chat {chat_id} assigned workflow {workflow_id}")
         
         # Collect content
         image_paths: List[str] = []  # 图片文件（png, jpg, gif 等）
         file_paths: List[str] = []   # 非图片文件（txt, pdf 等）
         text_parts: List[str] = []
+        photo_paths: List[str] = []  # 以 Photo（压缩版）形式收到的图片，用于和 Document 原图去重
+        bad_downloads: List[str] = []  # 下载失败或文件损坏的附件说明
+        unsupported_media: List[str] = []  # 带说明但无法转发的媒体类型（视频、语音等）
+        content_items: List[Tuple[int, str, str]] = []  # (消息序号, "text" | "image" | "file", 内容)
         
         # 图片扩展名列表
         IMAGE_EXTENSIONS = {'.png', '.jpg', '.jpeg', '.gif', '.webp', '.bmp'}
@@ -638,8 +2080,10 @@ class AntigravityBridge:
             # Text
             if msg.text:
                 text_parts.append(msg.text)
+                content_items.append((i, "text", msg.text))
             elif msg.caption:
                 text_parts.append(msg.caption)
+                content_items.append((i, "text", msg.caption))
             
             # Media
             file_id = None
@@ -650,6 +2094,22 @@ class AntigravityBridge:
             logger.info(f"Message {i}: text={bool(msg.text)}, caption={bool(msg.caption)}, "
                        f"photo={bool(msg.photo)}, document={bool(msg.document)}")
             
+            if msg.voice and os.getenv('WHISPER_CMD', '').strip():
+                transcript, problem = self._transcribe_voice(msg.voice.file_id, chat_id, workflow_id, i)
+                if transcript:
+                    text_parts.append(transcript)
+                    content_items.append((i, "text", transcript))
+                else:
+                    bad_downloads.append(f"第 {i + 1} 条语音消息: 转写失败 ({problem})")
+            elif not msg.photo and not msg.document:
+                kind = next(
+                    (k for k in ('video', 'video_note', 'animation', 'voice', 'audio', 'sticker') if getattr(msg, k, None)),
+                    None,
+                )
+                if kind:
+                    logger.info(f"Message {i}: unsupported media type {kind}, forwarding text only")
+                    unsupported_media.append(kind)
+            
             if msg.photo:
                 # Photo 类型一定是图片
                 file_id = msg.photo[-1].file_id
@@ -669,23 +2129,68 @@ class AntigravityBridge:
                 try:
                     # Download file
                     file = self.bot.get_file(file_id)
-                    local_path = f"/tmp/tg_batch_{chat_id}_{i}{file_ext}"
+                    local_path = f"/tmp/tg_batch_{chat_id}_{workflow_id}_{i}{file_ext}"
                     file.download(local_path)
                     
+                    problem = self._check_download(local_path, file.file_size, is_image)
+                    if problem:
+                        logger.error(f"Skipping bad download {local_path}: {problem}")
+                        bad_downloads.append(f"第 {i + 1} 条消息的附件: {problem}")
+                        try:
+                            os.remove(local_path)
+                        except OSError:
+                            pass
+                        continue
+                    
+                    content_items.append((i, "image" if is_image else "file", local_path))
                     if is_image:
                         image_paths.append(local_path)
+                        if msg.photo:
+                            photo_paths.append(local_path)
                         logger.info(f"Downloaded image to: {local_path}")
                     else:
                         file_paths.append(local_path)
                         logger.info(f"Downloaded file to: {local_path}")
                 except Exception as e:
                     logger.error(f"Error downloading item: {e}")
+                    bad_downloads.append(f"第 {i + 1} 条消息的附件: 下载失败 ({e})")
+        
+        if unsupported_media:
+            bad_downloads.append(f"不支持的媒体类型: {', '.join(sorted(set(unsupported_media)))}（仅转发文字说明）")
+        
+        if bad_downloads:
+            try:
+                self.bot.send_message(
+                    chat_id=chat_id,
+                    text="⚠️ 以下附件已跳过:\n" + "\n".join(bad_downloads),
+                )
+            except Exception as e:
+                logger.error(f"Error sending bad download notice: {e}")
         
+        if photo_paths and len(photo_paths) < len(image_paths):
+            image_paths = self._dedupe_photo_documents(image_paths, photo_paths)
+            content_items = [
+                (index, kind, content) for index, kind, content in content_items
+                if kind != "image" or content in image_paths
+            ]
+
         full_text = "\n".join(text_parts)
         
         # 统计日志
         logger.info(f"收集完成: {len(image_paths)} 张图片, {len(file_paths)} 个文件, 文字长度={len(full_text)}")
         
+        if not (full_text or image_paths or file_paths):
+            logger.info(f"Batch for chat {chat_id} has nothing to forward")
+            return
+        
+        if not (image_paths or file_paths) and self._is_trivial_text(chat_id, full_text):
+            logger.info(f"Batch for chat {chat_id} is trivial ({full_text[:50]!r}), not forwarding")
+            try:
+                self.bot.send_message(chat_id=chat_id, text="👌 已收到（内容过短或被过滤，未发送给 IDE）")
+            except Exception as e:
+                logger.error(f"Error sending trivial-content ack: {e}")
+            return
+        
         if self.current_mode == "CLI":
             if full_text or image_paths or file_paths:
                 self.cli_bridge.send_input(
@@ -702,6 +2207,20 @@ class AntigravityBridge:
                     pass
             return
         
+        truncated = False
+        if self.max_prompt_chars and len(full_text) > self.max_prompt_chars:
+            truncated = True
+            original_len = len(full_text)
+            full_text = self._truncate_middle(full_text, self.max_prompt_chars)
+            logger.warning(f"Prompt for chat {chat_id} truncated: {original_len} -> {len(full_text)} chars")
+            try:
+                self.bot.send_message(
+                    chat_id=chat_id,
+                    text=f"✂️ 消息过长 ({original_len} 字符)，已保留开头和结尾截断为 {self.max_prompt_chars} 字符后发送。",
+                )
+            except Exception as e:
+                logger.error(f"Error sending truncation notice: {e}")
+
         if full_text:
             content_with_context = f"From Telegram: {full_text}\n⬆️ Please always use MCP Tools: antigravity-bridge to reply to this message."
             if image_paths or file_paths:
@@ -710,39 +2229,129 @@ class AntigravityBridge:
             # 如果没有文字，则不发送任何文本上下文，只处理媒体文件
             content_with_context = ""
         
+        instructions = self._session_instructions(chat_id)
+        if instructions:
+            content_with_context = f"[Instructions for this conversation]\n{instructions}\n\n{content_with_context}".rstrip()
+        
+        # 文字和附件交错发送时（例如 文字-图片-文字），按原顺序逐项粘贴；
+        # 截断后的文字无法再对应回各条消息，此时退回“先附件后文字”的默认顺序
+        ordered_items = None if truncated else self._interleaved_order(content_items)
+        if ordered_items:
+            ordered_items = self._decorate_ordered_items(ordered_items, instructions)
+            logger.info(f"Batch for chat {chat_id} interleaves text and attachments, keeping message order")
+        
+        cancel_event = threading.Event()
+        with self._gui_cancel_lock:
+            self._gui_cancel_events.setdefault(chat_id, []).append(cancel_event)
+            self._gui_task_events[workflow_id] = (chat_id, cancel_event)
+        
         # Process in background thread
         def process():
+            reply_event = None
+            controls_message = None
             try:
                 sender = messages[0].from_user
                 
                 def send_status(status: str):
+                    # 真正的回复已经通过 MCP 送达，不再发送滞后的“思考中...”心跳
+                    if reply_event is not None and reply_event.is_set() and status.startswith("思考中"):
+                        logger.debug(f"Suppressed heartbeat for chat {chat_id}: reply already delivered")
+                        return
                     try:
                         self.bot.send_message(chat_id=sender.id, text=status)
                     except Exception as e:
                         logger.error(f"Error sending status: {e}")
+                    if status.startswith(("错误", "Error", "⚠️", "❌")):
+                        self.notify_operator(f"chat {chat_id} 自动化异常: {status}", exclude_chat_id=sender.id)
                 
-                # Create reply_event to stop "思考中..." when MCP sends reply
-                reply_event = None
-                if self.mcp_server:
-                    reply_event = self.mcp_server.create_reply_event()
+                controls_message = self._send_task_controls(sender.id, workflow_id)
                 
-                if image_paths or file_paths:
-                    full_workflow_media_group(
-                        image_paths,
-                        content_with_context,
-                        self.templates_dir,
-                        send_status,
-                        file_paths=file_paths,
-                        reply_event=reply_event,
-                    )
-                else:
-                    full_workflow(
-                        content_with_context,
-                        self.templates_dir,
-                        send_status,
-                        reply_event=reply_event,
-                    )
+                templates_dir = self._templates_dir_for(chat_id)
+                window_title = self._window_title_for(chat_id)
+                ide_mode = self._ide_mode_for(chat_id)
+                
+                def run_gui():
+                    # 在 GUI 工作线程中执行：屏幕（键鼠、剪贴板）同一时间只能被一个工作流使用
+                    nonlocal reply_event
+                    if cancel_event.is_set():
+                        send_status("🛑 已取消排队中的 GUI 任务")
+                        return None
+                    
+                    # Create reply_event to stop "思考中..." when MCP replies to this chat
+                    if self.mcp_server:
+                        reply_event = self.mcp_server.create_reply_event(str(chat_id))
+                    
+                    if image_paths or file_paths:
+                        return full_workflow_media_group(
+                            image_paths,
+                            content_with_context,
+                            templates_dir,
+                            send_status,
+                            file_paths=file_paths,
+                            reply_event=reply_event,
+                            window_title=window_title,
+                            ide_mode=ide_mode,
+                            approval_func=lambda prompt: self.request_approval(chat_id, prompt, cancel_event),
+                            cancel_event=cancel_event,
+                            workflow_id=workflow_id,
+                            items=ordered_items,
+                        )
+                    else:
+                        return full_workflow(
+                            content_with_context,
+                            templates_dir,
+                            send_status,
+                            reply_event=reply_event,
+                            window_title=window_title,
+                            ide_mode=ide_mode,
+                            approval_func=lambda prompt: self.request_approval(chat_id, prompt, cancel_event),
+                            cancel_event=cancel_event,
+                            workflow_id=workflow_id,
+                        )
+                
+                future, ahead = submit_workflow(run_gui)
+                if ahead:
+                    send_status(f"⏳ 另一个任务正在操作 IDE，已排队（前面还有 {ahead} 个任务），稍后自动发送...")
+                result = future.result()
+                if result is None:
+                    return
+                logger.info(f"Workflow {workflow_id} for chat {chat_id} finished: {result}")
+                if result and result.error_code in ('timeout', 'cancelled'):
+                    self._send_partial_screenshot(chat_id, result.error_code)
+                if result and result.failure_screenshot:
+                    try:
+                        self._send_screenshot(
+                            chat_id, result.failure_screenshot,
+                            caption=f"[failure, {result.error_code}] 找不到输入框时的屏幕画面",
+                        )
+                    except Exception as e:
+                        logger.error(f"Error sending failure screenshot: {e}")
+                    finally:
+                        try:
+                            os.remove(result.failure_screenshot)
+                        except OSError:
+                            pass
+                if result and os.getenv('SHOW_TIMINGS', '').strip().lower() in ('1', 'true', 'yes', 'on'):
+                    send_status(f"⏱️ {result.timing_summary()}")
+            except Exception as e:
+                logger.error(f"GUI workflow error for chat {chat_id}: {e}")
+                self.notify_operator(f"chat {chat_id} GUI 工作流异常退出: {e}")
             finally:
+                with self._gui_cancel_lock:
+                    events = self._gui_cancel_events.get(chat_id, [])
+                    if cancel_event in events:
+                        events.remove(cancel_event)
+                    if not events:
+                        self._gui_cancel_events.pop(chat_id, None)
+                    self._gui_task_events.pop(workflow_id, None)
+                if reply_event is not None and self.mcp_server:
+                    self.mcp_server.remove_reply_event(str(chat_id), reply_event)
+                # 任务结束后移除“取消 / 状态”按钮
+                if controls_message is not None:
+                    try:
+                        controls_message.edit_reply_markup(reply_markup=None)
+                    except Exception as e:
+                        logger.debug(f"Error removing task controls: {e}")
                 # Cleanup downloaded files
                 for path in image_paths + file_paths:
                     try:
@@ -753,11 +2362,258 @@ class AntigravityBridge:
         thread = threading.Thread(target=process, daemon=True)
         thread.start()
     
-    def send_telegram(self, chat_id_str: str, text: str) -> Optional[Exception]:
+    def _send_task_controls(self, chat_id: int, workflow_id: str) -> Optional[Message]:
+        """发送带“取消 / 状态”内联按钮的“处理中”消息，免去在手机上输入 /cancel、/status。"""
+        keyboard = InlineKeyboardMarkup([[
+            InlineKeyboardButton("🛑 取消", callback_data=f"task:cancel:{workflow_id}"),
+            InlineKeyboardButton("📊 状态", callback_data="task:status"),
+        ]])
+        try:
+            return self.bot.send_message(chat_id=chat_id, text="📨 已收到，正在发送给 IDE...", reply_markup=keyboard)
+        except Exception as e:
+            logger.error(f"Error sending task controls: {e}")
+            return None
+    
+    def _send_partial_screenshot(self, chat_id: int, reason: str):
+        """工作流超时或被取消时，把 IDE 当前画面发给用户，保留 Agent 已经输出的部分结果。"""
+        screenshot_path = f'/tmp/telegram_screenshot_{uuid.uuid4().hex[:8]}.png'
+        label = "已取消" if reason == 'cancelled' else "已超时"
+        try:
+            ok, error = take_screenshot(screenshot_path)
+            if not ok:
+                logger.error(f"Partial result screenshot failed: {error}")
+                return
+            self._send_screenshot(chat_id, screenshot_path, caption=f"[partial, {reason}] 工作流{label}，这是 IDE 当前画面中的部分结果")
+        except Exception as e:
+            logger.error(f"Error sending partial result screenshot: {e}")
+        finally:
+            try:
+                os.remove(screenshot_path)
+            except OSError:
+                pass
+    
+    def _transcribe_voice(self, file_id: str, chat_id: int, workflow_id: str, index: int) -> Tuple[str, str]:
+        """
+        下载语音消息并用 WHISPER_CMD 转写，返回 (文字, 失败原因)。
+        
+        WHISPER_CMD 中的 {file} 替换为音频路径，没有 {file} 时把路径追加为最后一个参数；
+        命令的标准输出即转写结果。WHISPER_TIMEOUT 为超时秒数，默认 120。
+        """
+        try:
+            command = shlex.split(os.getenv('WHISPER_CMD', ''))
+        except ValueError as e:
+            # 引号不配对等写错的命令不要让整个批次失败，作为失败原因告诉用户
+            logger.error(f"Invalid WHISPER_CMD: {e}")
+            return "", f"WHISPER_CMD 格式错误: {e}"
+        
+        local_path = f"/tmp/tg_batch_{chat_id}_{workflow_id}_{index}.oga"
+        try:
+            self.bot.get_file(file_id).download(local_path)
+        except Exception as e:
+            logger.error(f"Error downloading voice message: {e}")
+            return "", f"下载失败: {e}"
+        
+        if any('{file}' in arg for arg in command):
+            command = [arg.replace('{file}', local_path) for arg in command]
+        else:
+            command.append(local_path)
+        try:
+            timeout = float(os.getenv('WHISPER_TIMEOUT', '120') or 120)
+        except ValueError:
+            timeout = 120.0
+        
+        try:
+            logger.info(f"Transcribing voice message: {command}")
+            result = subprocess.run(command, capture_output=True, text=True, timeout=timeout)
+        except subprocess.TimeoutExpired:
+            return "", f"超过 {int(timeout)} 秒未完成"
+        except Exception as e:
+            logger.error(f"Error running WHISPER_CMD: {e}")
+            return "", str(e)
+        finally:
+            try:
+                os.remove(local_path)
+            except OSError:
+                pass
+        
+        if result.returncode != 0:
+            logger.error(f"WHISPER_CMD failed ({result.returncode}): {result.stderr.strip()[:500]}")
+            return "", f"退出码 {result.returncode}: {result.stderr.strip()[:200]}"
+        transcript = result.stdout.strip()
+        if not transcript:
+            return "", "没有识别出文字"
+        logger.info(f"Voice transcript ({len(transcript)} chars): {transcript[:100]}")
+        return transcript, ""
+    
+    @staticmethod
+    def _check_download(path: str, expected_size: Optional[int], is_image: bool) -> Optional[str]:
+        """检查下载的文件是否完整，返回问题描述；文件正常时返回 None。"""
+        try:
+            size = os.path.getsize(path)
+        except OSError as e:
+            return f"文件不存在 ({e})"
+        if size == 0:
+            return "文件为空 (0 字节)"
+        if expected_size and size != expected_size:
+            return f"文件不完整 ({size}/{expected_size} 字节)"
+        if is_image:
+            try:
+                with Image.open(path) as img:
+                    img.load()
+            except Exception as e:
+                return f"图片无法解码 ({e})"
+        return None
+
+    @staticmethod
+    def _truncate_middle(text: str, limit: int) -> str:
+        """保留开头和结尾，中间用 [truncated] 标记替换，结果长度不超过 limit。"""
+        marker = "\n...[truncated]...\n"
+        if limit <= len(marker):
+            return text[:limit]
+        budget = limit - len(marker)
+        head = budget * 2 // 3
+        tail = budget - head
+        return text[:head] + marker + (text[-tail:] if tail else "")
+
+    @staticmethod
+    def _image_fingerprint(path: str) -> Optional[Tuple[float, int]]:
+        """返回 (宽高比, 8x8 均值哈希)，用于判断两张图是否为同一图片的不同分辨率版本。"""
+        try:
+            with Image.open(path) as img:
+                ratio = img.width / float(img.height)
+                pixels = list(img.convert('L').resize((8, 8)).getdata())
+        except Exception as e:
+            logger.warning(f"Failed to fingerprint image {path}: {e}")
+            return None
+        avg = sum(pixels) / len(pixels)
+        bits = 0
+        for value in pixels:
+            bits = (bits << 1) | (1 if value >= avg else 0)
+        return ratio, bits
+
+    @staticmethod
+    def _interleaved_order(content_items: List[Tuple[int, str, str]]) -> Optional[List[Tuple[str, str]]]:
+        """
+        批次中文字和附件真正交错时，返回按消息顺序排列的 [(kind, content), ...]；
+        否则返回 None，使用“先粘贴全部附件、最后粘贴文字”的默认顺序。
+        
+        图片/文件的说明（caption）属于它自己的附件，排在该附件之后，所以单张带说明的图片
+        不算交错；只有某条文字之后还有来自另一条消息的附件时才算（如 文字-图片、图片+说明-图片）。
+        """
+        ordered = sorted(content_items, key=lambda item: (item[0], item[1] == "text"))
+        for pos, (index, kind, _) in enumerate(ordered):
+            if kind == "text" and any(
+                later_index != index and later_kind != "text"
+                for later_index, later_kind, _ in ordered[pos + 1:]
+            ):
+                return [(kind, content) for _, kind, content in ordered]
+        return None
+    
+    @staticmethod
+    def _decorate_ordered_items(items: List[Tuple[str, str]], instructions: str) -> List[Tuple[str, str]]:
+        """给按顺序粘贴的内容加上与默认顺序相同的上下文：第一段文字前加说明和来源，最后一段文字后加回复提示。"""
+        items = list(items)
+        text_indices = [i for i, (kind, _) in enumerate(items) if kind == "text"]
+        first, last = text_indices[0], text_indices[-1]
+        items[first] = ("text", f"From Telegram: {items[first][1]}")
+        if instructions:
+            items[first] = ("text", f"[Instructions for this conversation]\n{instructions}\n\n{items[first][1]}")
+        items[last] = (
+            "text",
+            f"{items[last][1]} (Group/Attachments)\n⬆️ Please always use MCP Tools: antigravity-bridge to reply to this message.",
+        )
+        return [
+            (kind, f"{content}\n" if kind == "text" and i != last else content)
+            for i, (kind, content) in enumerate(items)
+        ]
+    
+    def _dedupe_photo_documents(self, image_paths: List[str], photo_paths: List[str]) -> List[str]:
+        """同一批次里同时收到 Photo（压缩版）和 Document（原图）时，丢弃压缩版 Photo。"""
+        document_prints = []
+        for path in image_paths:
+            if path not in photo_paths:
+                fingerprint = self._image_fingerprint(path)
+                if fingerprint:
+                    document_prints.append(fingerprint)
+
+        kept: List[str] = []
+        for path in image_paths:
+            if path in photo_paths:
+                fingerprint = self._image_fingerprint(path)
+                if fingerprint and any(
+                    abs(fingerprint[0] - ratio) / ratio <= 0.02 and bin(fingerprint[1] ^ bits).count('1') <= 6
+                    for ratio, bits in document_prints
+                ):
+                    logger.info(f"Dropping compressed photo {path}: original document is in the same batch")
+                    try:
+                        os.remove(path)
+                    except OSError:
+                        pass
+                    continue
+            kept.append(path)
+        return kept
+
+    def _replay_buffer_journal(self):
+        """把上次运行时还在缓冲中、未来得及处理的消息重新放回缓冲区，并告知发送者。"""
+        if not self.batcher.journal_path:
+            return
+        pending = MessageBatcher.load_journal(self.batcher.journal_path)
+        for chat_id, records in pending.items():
+            if not self.is_chat_allowed(chat_id):
+                logger.warning(f"Dropping journaled messages for unauthorized chat {chat_id}")
+                continue
+            restored = 0
+            for record in records:
+                try:
+                    message = Message.de_json(record, self.bot)
+                except Exception as e:
+                    logger.error(f"Error restoring journaled message for chat {chat_id}: {e}")
+                    continue
+                if message:
+                    self.batcher.add(chat_id, message, quiescence=self._quiescence_for(chat_id))
+                    restored += 1
+            if not restored:
+                continue
+            logger.info(f"Replayed {restored} journaled message(s) for chat {chat_id}")
+            try:
+                self.bot.send_message(
+                    chat_id=chat_id,
+                    text=f"♻️ Bridge 重启前有 {restored} 条消息尚未发送给 IDE，已恢复，稍后自动发送。",
+                )
+            except Exception as e:
+                logger.error(f"Error sending replay notice: {e}")
+        if not pending:
+            return
+        # 全部被跳过时 add() 不会重写日志，这里清理掉旧文件
+        self.batcher.save_journal()
+
+    def _check_gui_dependencies(self):
+        """启动时检查一次 GUI 模式依赖的外部命令，缺失时记录日志并通知运维。"""
+        missing = check_dependencies()
+        if not missing:
+            return
+        for item in missing:
+            logger.error(f"缺少 GUI 依赖: {item}")
+        self.notify_operator("⚠️ GUI 模式缺少依赖，截屏/点击/粘贴将会失败:\n" + "\n".join(f"- {item}" for item in missing))
+
+    def notify_operator(self, text: str, exclude_chat_id: Optional[int] = None):
+        """把失败信息发送到 ERROR_NOTIFY_CHAT，方便人工介入（未配置时只记录日志）。"""
+        if not self.error_notify_chat_id or self.error_notify_chat_id == exclude_chat_id:
+            return
+        if not self.bot:
+            logger.error(f"Cannot notify operator, bot not initialized: {text}")
+            return
+        try:
+            self.bot.send_message(chat_id=self.error_notify_chat_id, text=text[:4000])
+        except Exception as e:
+            logger.error(f"Error notifying operator: {e}")
+
+    def send_telegram(self, chat_id_str: str, text: str, parse_mode: Optional[str] = None) -> Optional[Exception]:
         """
         Send a message to Telegram.
         
-        Used by MCP server to send replies.
+        Used by MCP server to send replies. parse_mode (Markdown / MarkdownV2 / HTML)
+        is passed through to Telegram; None sends plain text.
         """
         try:
             if not self.bot:
@@ -765,25 +2621,294 @@ class AntigravityBridge:
             chat_id = int(chat_id_str)
             # Handle escaped newlines
             safe_text = text.replace("\\n", "\n")
-            self.bot.send_message(chat_id=chat_id, text=safe_text)
+            # REPLY_MODE=thread 时回复到触发本轮对话的消息下，默认 standalone 发送独立消息
+            reply_to = None
+            if os.getenv('REPLY_MODE', 'standalone').strip().lower() == 'thread':
+                reply_to = self.last_trigger_message_ids.get(chat_id)
+            # 超过 Telegram 单条长度的回复拆成多条按顺序发送，只有第一条作为线程回复
+            chunks = self._split_text(safe_text, keep_fences=parse_mode in ('Markdown', 'MarkdownV2'))
+            for index, chunk in enumerate(chunks):
+                try:
+                    self.bot.send_message(
+                        chat_id=chat_id,
+                        text=chunk,
+                        parse_mode=parse_mode,
+                        reply_to_message_id=reply_to if index == 0 else None,
+                        allow_sending_without_reply=True,
+                    )
+                except Exception as e:
+                    if index == 0:
+                        raise
+                    logger.error(f"Error sending part {index + 1}/{len(chunks)} to Telegram: {e}")
+                    return Exception(f"长消息只发送了前 {index}/{len(chunks)} 段，第 {index + 1} 段发送失败: {e}")
             return None
         except Exception as e:
             logger.error(f"Error sending to Telegram: {e}")
             return e
     
     
+    def send_telegram_photo(self, chat_id_str: str, file_path: str, caption: Optional[str] = None) -> Optional[Exception]:
+        """
+        Send a local image to Telegram.
+        
+        Used by the MCP send_photo_to_telegram tool.
+        """
+        try:
+            if not self.bot:
+                return Exception("Telegram Bot not initialized yet")
+            chat_id = int(chat_id_str)
+            reply_to = None
+            if os.getenv('REPLY_MODE', 'standalone').strip().lower() == 'thread':
+                reply_to = self.last_trigger_message_ids.get(chat_id)
+            with open(file_path, 'rb') as photo:
+                self.bot.send_photo(
+                    chat_id=chat_id,
+                    photo=photo,
+                    caption=caption,
+                    reply_to_message_id=reply_to,
+                    allow_sending_without_reply=True,
+                )
+            return None
+        except Exception as e:
+            logger.error(f"Error sending photo to Telegram: {e}")
+            return e
+    
+    def request_approval(self, chat_id: int, prompt: str,
+                         cancel_event: Optional[threading.Event] = None) -> Optional[bool]:
+        """
+        附当前截图发送带“批准 / 拒绝”内联按钮的消息，阻塞等待用户选择。
+        
+        cancel_event 为所属工作流的取消事件，等待期间用户 /cancel 时立即返回 None。
+        
+        Returns:
+            True 批准、False 拒绝、None 超时（APPROVAL_TIMEOUT 秒，默认 300）、已取消或发送失败
+        """
+        approval_id = uuid.uuid4().hex[:8]
+        event = threading.Event()
+        with self._approvals_lock:
+            self._pending_approvals[approval_id] = {'event': event, 'approved': None, 'chat_id': chat_id}
+        
+        keyboard = InlineKeyboardMarkup([[
+            InlineKeyboardButton("✅ 批准", callback_data=f"approve:{approval_id}:yes"),
+            InlineKeyboardButton("❌ 拒绝", callback_data=f"approve:{approval_id}:no"),
+        ]])
+        screenshot_path = f'/tmp/telegram_screenshot_{approval_id}.png'
+        try:
+            ok, _ = take_screenshot(screenshot_path)
+            if ok:
+                self._send_screenshot(chat_id, screenshot_path)
+            self.bot.send_message(chat_id=chat_id, text=prompt, reply_markup=keyboard)
+        except Exception as e:
+            logger.error(f"Error sending approval request: {e}")
+            with self._approvals_lock:
+                self._pending_approvals.pop(approval_id, None)
+            return None
+        finally:
+            try:
+                os.remove(screenshot_path)
+            except OSError:
+                pass
+        
+        timeout = _env_float('APPROVAL_TIMEOUT', 300.0)
+        logger.info(f"Waiting up to {int(timeout)}s for approval {approval_id} in chat {chat_id}")
+        deadline = time.monotonic() + timeout
+        answered = False
+        while not answered:
+            remaining = deadline - time.monotonic()
+            if remaining <= 0:
+                break
+            if cancel_event is not None and cancel_event.is_set():
+                logger.info(f"Approval {approval_id} abandoned: workflow cancelled")
+                break
+            # 分段等待，以便及时发现取消
+            answered = event.wait(min(remaining, 0.5))
+        with self._approvals_lock:
+            entry = self._pending_approvals.pop(approval_id, None)
+        if not answered or entry is None:
+            return None
+        return entry['approved']
+    
+    def handle_approval_callback(self, update: Update, context: CallbackContext):
+        """处理批准请求的内联按钮点击（callback_data: approve:<id>:yes|no）"""
+        query = update.callback_query
+        chat_id = query.message.chat.id if query.message else None
+        if not self.is_chat_allowed(chat_id):
+            query.answer()
+            return
+        
+        parts = (query.data or '').split(':')
+        approval_id = parts[1] if len(parts) > 1 else ''
+        approved = len(parts) > 2 and parts[2] == 'yes'
+        with self._approvals_lock:
+            entry = self._pending_approvals.get(approval_id)
+            if entry and entry['chat_id'] == chat_id and not entry['event'].is_set():
+                entry['approved'] = approved
+                entry['event'].set()
+            else:
+                entry = None
+        
+        if entry is None:
+            query.answer("该请求已过期或已处理")
+            try:
+                query.edit_message_reply_markup(reply_markup=None)
+            except Exception:
+                pass
+            return
+        
+        logger.info(f"Approval {approval_id} in chat {chat_id}: {'approved' if approved else 'rejected'}")
+        query.answer()
+        try:
+            query.edit_message_text(f"{query.message.text}\n\n{'✅ 已批准' if approved else '❌ 已拒绝'}")
+        except Exception as e:
+            logger.error(f"Error updating approval message: {e}")
+    
+    def capture_screen_png(self) -> Optional[bytes]:
+        """截取当前屏幕并返回 PNG 字节，供 MCP 工具结果附带截图。"""
+        screenshot_path = f'/tmp/mcp_screenshot_{uuid.uuid4().hex[:8]}.png'
+        ok, error = take_screenshot(screenshot_path)
+        if not ok:
+            logger.error(f"MCP screenshot failed: {error}")
+            return None
+        try:
+            with open(screenshot_path, 'rb') as f:
+                return f.read()
+        finally:
+            try:
+                os.remove(screenshot_path)
+            except OSError:
+                pass
+    
+    def _start_temp_janitor(self):
+        """TEMP_MAX_AGE_MINUTES > 0（默认 60）时，后台定期删除超过该时长的残留临时文件。"""
+        try:
+            max_age = float(os.getenv('TEMP_MAX_AGE_MINUTES', '60') or 60) * 60
+        except ValueError:
+            max_age = 3600.0
+        if max_age <= 0:
+            return
+        interval = min(max_age, 600)
+        
+        def janitor():
+            while not self._shutting_down:
+                removed = cleanup_temp_files(max_age)
+                if removed:
+                    count, size = temp_file_stats()
+                    logger.info(f"Temp janitor removed {removed} stale files, {count} remain ({size / 1024 / 1024:.1f} MB)")
+                time.sleep(interval)
+        
+        threading.Thread(target=janitor, daemon=True, name="temp-janitor").start()
+        logger.info(f"Temp janitor started, max age {int(max_age / 60)} minutes")
+    
+    @staticmethod
+    def _polling_alive() -> bool:
+        """python-telegram-bot 的长轮询线程（名称以 ':updater' 结尾）是否仍在运行。"""
+        return any(t.name.endswith(':updater') and t.is_alive() for t in threading.enumerate())
+    
+    def _start_polling_supervisor(self):
+        """
+        在后台线程中启动 Telegram 长轮询，轮询线程意外退出时以指数退避重启。
+        
+        MCP Server 运行在自己的线程中，Telegram 断线期间仍然响应 IDE 请求。
+        """
+        def supervise():
+            delay = POLL_BACKOFF_INITIAL_S
+            down_since = None
+            while not self._shutting_down:
+                try:
+                    self.updater.start_polling()
+                    started = time.time()
+                    time.sleep(1)
+                    while not self._shutting_down and self._polling_alive():
+                        if delay != POLL_BACKOFF_INITIAL_S and time.time() - started >= POLL_STABLE_S:
+                            if down_since is not None:
+                                logger.info(f"Telegram polling recovered after {int(time.time() - down_since)}s outage")
+                            delay = POLL_BACKOFF_INITIAL_S
+                            down_since = None
+                        time.sleep(1)
+                    if self._shutting_down:
+                        return
+                    error = "polling thread exited"
+                except Exception as e:
+                    error = str(e)
+                    if "Unauthorized" in error or "InvalidToken" in error:
+                        logger.critical(f"Failed to start polling: {e}")
+                        logger.critical("FATAL: The provided Telegram Token is invalid. Please check your .env file.")
+                        return
+                
+                if down_since is None:
+                    down_since = time.time()
+                outage = time.time() - down_since
+                logger.error(f"Telegram polling stopped ({error}), restarting in {delay}s")
+                if outage >= POLL_OUTAGE_WARN_S:
+                    logger.warning(
+                        f"Telegram polling down for {int(outage)}s; MCP server is still running"
+                    )
+                try:
+                    self.updater.stop()
+                except Exception as e:
+                    logger.debug(f"Error stopping updater before restart: {e}")
+                time.sleep(delay)
+                delay = min(delay * 2, POLL_BACKOFF_MAX_S)
+        
+        threading.Thread(target=supervise, daemon=True, name="polling-supervisor").start()
+    
+    @staticmethod
+    def _mcp_transport() -> str:
+        """MCP_TRANSPORT：stdio（默认，由 IDE 以子进程方式启动）或 http（HTTP + SSE，供远程客户端连接）。"""
+        return os.getenv('MCP_TRANSPORT', 'stdio').strip().lower()
+    
+    def _start_mcp_http(self):
+        """在后台线程启动 MCP 的 HTTP + SSE 监听，地址取自 MCP_HTTP_ADDR（默认 127.0.0.1:8765）。"""
+        addr = os.getenv('MCP_HTTP_ADDR', '127.0.0.1:8765').strip() or '127.0.0.1:8765'
+        host, _, port_str = addr.rpartition(':')
+        try:
+            port = int(port_str)
+        except ValueError:
+            logger.error(f"Invalid MCP_HTTP_ADDR: {addr}")
+            return
+        token = os.getenv('MCP_HTTP_TOKEN', '').strip() or None
+        if host not in ('127.0.0.1', 'localhost', '::1') and not token:
+            logger.warning(f"MCP HTTP listening on {addr} without MCP_HTTP_TOKEN: anyone who can reach it can send Telegram messages")
+        self._mcp_http_started = True
+        
+        def serve():
+            try:
+                self.mcp_server.start_http(host or '127.0.0.1', port, token)
+            except OSError as e:
+                logger.error(f"MCP HTTP server failed on {addr}: {e}")
+                self.notify_operator(f"⚠️ MCP HTTP 服务启动失败 ({addr}): {e}")
+        
+        threading.Thread(target=serve, daemon=True).start()
+    
     def run(self):
         """Start the bot and MCP server."""
         # 优先启动 MCP Server（在单独线程中监听 stdin）
         # 这样 IDE 可以立即获取工具列表，无需等待 Telegram 初始化
         # 使用保存的原始 stdout，避免被重定向影响
-        self.mcp_server = MCPServer(self.send_telegram, stdout_stream=_original_stdout)
-        mcp_thread = threading.Thread(target=self.mcp_server.start, daemon=True)
-        mcp_thread.start()
-        logger.info("MCP Server started first, listening on stdin")
+        self.mcp_server = MCPServer(
+            self.send_telegram,
+            stdout_stream=_original_stdout,
+            error_notify_func=self.notify_operator,
+            screenshot_func=self.capture_screen_png,
+            photo_func=self.send_telegram_photo,
+            templates_dir_func=lambda chat_id: self._templates_dir_for(int(chat_id)) if chat_id else self.templates_dir,
+        )
+        mcp_thread = None
+        if self._mcp_transport() == 'http':
+            self._start_mcp_http()
+        else:
+            mcp_thread = threading.Thread(target=self.mcp_server.start, daemon=True)
+            mcp_thread.start()
+            logger.info("MCP Server started first, listening on stdin")
         
         # 然后初始化 Telegram Bot
-        if not self.setup():
+        setup_ok = self.setup()
+        # MCP_TRANSPORT 也可以写在 .env 中，setup() 加载之后再检查一次
+        if self._mcp_transport() == 'http' and not self._mcp_http_started:
+            self._start_mcp_http()
+        # .env 在 setup() 中加载，ENABLED_TOOLS 可能刚刚生效，通知客户端刷新工具列表
+        self.mcp_server.check_tools_changed()
+        if not setup_ok:
             # 即使 Telegram 初始化失败，MCP Server 仍然可以响应基本请求
             logger.error("Telegram setup failed, but MCP Server is running")
             # 保持进程存活，MCP 仍可工作（只是发送消息功能不可用）
@@ -795,6 +2920,9 @@ class AntigravityBridge:
             return
         
         logger.info("Antigravity Bridge Bot & MCP Server Starting...")
+        self._start_temp_janitor()
+        self._check_gui_dependencies()
+        self._replay_buffer_journal()
         
         import stat
         is_mcp = False
@@ -837,19 +2965,14 @@ class AntigravityBridge:
             except Exception as e:
                 logger.error(f"PID 文件处理出错: {e}")
             # Start bot in background (Service Binary w/ Polling)
-            try:
-                self.updater.start_polling()
-            except Exception as e:
-                logger.critical(f"Failed to start polling: {e}")
-                if "Unauthorized" in str(e) or "InvalidToken" in str(e):
-                    logger.critical("FATAL: The provided Telegram Token is invalid. Please check your .env file.")
+            self._start_polling_supervisor()
         else:
             logger.info("Running under MCP: Disabled Telegram polling and GUI monitors to prevent conflicts.")
 
         # Keep main thread alive
         try:
             while True:
-                if is_mcp and not mcp_thread.is_alive():
+                if is_mcp and mcp_thread and not mcp_thread.is_alive():
                     logger.info("MCP thread ended (IDE disconnected pipe). Shutting down main process.")
                     break
                 time.sleep(1)
@@ -1,16 +1,25 @@
 """
 MCP (Model Context Protocol) Server for Antigravity-Bridge
 
-Implements a JSON-RPC 2.0 server over stdio for tool communication.
+Implements a JSON-RPC 2.0 server over stdio (default) or HTTP + SSE for tool communication.
 Supports: initialize, tools/list, tools/call methods.
 """
 
+import base64
+import codecs
+import hmac
 import json
 import logging
 import os
+import queue
 import sys
+import tempfile
 import threading
-from typing import Any, Callable, Dict, Optional
+import time
+import uuid
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from typing import Any, Callable, Dict, List, Optional
+from urllib.parse import parse_qs, urlparse
 
 # Configure logging to stderr (stdout is for MCP protocol)
 logging.basicConfig(
@@ -31,24 +40,147 @@ class MCPServer:
     # 使用文件共享 last_chat_id（解决进程间通信问题）
     LAST_CHAT_ID_FILE = "/tmp/antigravity_last_chat_id"
     
-    def __init__(self, telegram_func: Optional[Callable[[str, str], Optional[Exception]]] = None,
-                 stdout_stream=None):
+    # stdin 读取块大小，以及未解析数据的上限（防止垃圾输入无限堆积）
+    READ_CHUNK_SIZE = 65536
+    MAX_PENDING_CHARS = 16 * 1024 * 1024
+    
+    # HTTP + SSE 传输：SSE 空闲时发送注释行保活的间隔（秒），以及单个 POST 的大小上限
+    SSE_KEEPALIVE_SECONDS = 15
+    MAX_HTTP_BODY = 16 * 1024 * 1024
+    
+    # 单条 Telegram 消息的分段长度（与 send_telegram 拆分长回复时一致，已扣除补全代码块的预留）
+    TELEGRAM_CHUNK_LEN = 4000 - 32
+    
+    # 全部工具定义；ENABLED_TOOLS 可以只开放其中一部分。
+    # annotations.readOnlyHint 为真的工具可并发执行，其余（会发消息或驱动 GUI 的）串行执行
+    TOOL_DEFINITIONS = [
+        {
+            'name': 'reply_to_telegram',
+            'description': 'Send a message reply to a Telegram Chat ID',
+            'inputSchema': {
+                'type': 'object',
+                'properties': {
+                    'chat_id': {
+                        'type': 'string',
+                        'description': 'The Telegram Chat ID to reply to, or a comma-separated list to send to several chats (optional, uses last message sender if not provided)',
+                    },
+                    'text': {
+                        'type': 'string',
+                        'description': 'The content of the message',
+                    },
+                    'include_screenshot': {
+                        'type': 'boolean',
+                        'description': 'Attach a screenshot of the IDE taken after sending, to visually verify the result',
+                    },
+                    'parse_mode': {
+                        'type': 'string',
+                        'enum': ['Markdown', 'MarkdownV2', 'HTML'],
+                        'description': 'Telegram formatting for the text (optional, plain text if omitted)',
+                    },
+                },
+                'required': ['text'],
+            },
+            'annotations': {
+                'readOnlyHint': False,
+            },
+        },
+        {
+            'name': 'send_photo_to_telegram',
+            'description': 'Send an image (e.g. a diagram or screenshot) to a Telegram Chat ID',
+            'inputSchema': {
+                'type': 'object',
+                'properties': {
+                    'chat_id': {
+                        'type': 'string',
+                        'description': 'The Telegram Chat ID to send to (optional, uses last message sender if not provided)',
+                    },
+                    'file_path': {
+                        'type': 'string',
+                        'description': 'Absolute path of a local image file',
+                    },
+                    'data': {
+                        'type': 'string',
+                        'description': 'Base64-encoded image data, used when file_path is not given',
+                    },
+                    'caption': {
+                        'type': 'string',
+                        'description': 'Optional caption for the photo',
+                    },
+                },
+            },
+            'annotations': {
+                'readOnlyHint': False,
+            },
+        },
+        {
+            'name': 'list_templates',
+            'description': 'List the GUI template images (e.g. input_box.png, Replying.png) with their pixel size and whether they decode. Templates are read from disk on every match, so fixed files take effect immediately',
+            'inputSchema': {
+                'type': 'object',
+                'properties': {
+                    'chat_id': {
+                        'type': 'string',
+                        'description': 'List the templates used for this Telegram Chat ID (optional, default templates if not provided)',
+                    },
+                },
+            },
+            'annotations': {
+                'readOnlyHint': True,
+            },
+        },
+    ]
+    
+    # reply_to_telegram 接受的 Telegram parse_mode
+    PARSE_MODES = ('Markdown', 'MarkdownV2', 'HTML')
+    
+    # list_templates 认为尺寸可疑的阈值（像素）：过小容易误匹配，过大通常是截错了整块区域
+    TEMPLATE_MIN_SIDE = 8
+    TEMPLATE_MAX_SIDE = 1000
+    
+    def __init__(self, telegram_func: Optional[Callable[[str, str, Optional[str]], Optional[Exception]]] = None,
+                 stdout_stream=None,
+                 error_notify_func: Optional[Callable[[str], None]] = None,
+                 screenshot_func: Optional[Callable[[], Optional[bytes]]] = None,
+                 photo_func: Optional[Callable[[str, str, Optional[str]], Optional[Exception]]] = None,
+                 templates_dir_func: Optional[Callable[[Optional[str]], str]] = None):
         """
         Initialize the MCP server.
         
         Args:
             telegram_func: Callback function to send Telegram messages.
-                          Signature: (chat_id: str, text: str) -> Optional[Exception]
+                          Signature: (chat_id: str, text: str, parse_mode: Optional[str]) -> Optional[Exception]
             stdout_stream: The stdout stream to use for MCP output.
                           If None, uses sys.stdout.
+            error_notify_func: Optional callback to report tool failures to a human operator.
+                          Signature: (text: str) -> None
+            screenshot_func: Optional callback returning the current screen as PNG bytes
+                          (None on failure), used by include_screenshot.
+            photo_func: Callback to send a photo, used by send_photo_to_telegram.
+                          Signature: (chat_id: str, file_path: str, caption: Optional[str]) -> Optional[Exception]
+            templates_dir_func: Callback returning the GUI templates directory for a chat
+                          (None for the default), used by list_templates.
         """
         self.telegram_func = telegram_func
+        self.error_notify_func = error_notify_func
+        self.screenshot_func = screenshot_func
+        self.photo_func = photo_func
+        self.templates_dir_func = templates_dir_func
         self._output_lock = threading.Lock()
         # Use provided stdout or fall back to sys.stdout
         self._stdout = stdout_stream if stdout_stream is not None else sys.stdout
-        # Reply event: set when reply_to_telegram succeeds, used to stop "思考中..." loop
-        self._reply_event: Optional[threading.Event] = None
+        # Reply events: set when a reply reaches a chat, used to stop "思考中..." heartbeats.
+        # 按 chat_id 分别记录，多个 chat 同时运行工作流时互不影响；None 为不区分 chat 的旧用法
+        self._reply_events: Dict[Optional[str], List[threading.Event]] = {}
         self._reply_event_lock = threading.Lock()
+        # 非只读工具调用串行执行，避免多个请求同时操作 Telegram / GUI
+        self._mutating_tool_lock = threading.Lock()
+        # 最近一次通过 tools/list 告知客户端的工具集合，用于发送 list_changed 通知
+        self._advertised_tools: Optional[List[str]] = None
+        self._advertised_lock = threading.Lock()
+        # HTTP + SSE 传输的会话: session_id -> 待推送消息队列；为 None 表示未启用 HTTP
+        self._sse_sessions: Optional[Dict[str, queue.Queue]] = None
+        self._sse_lock = threading.Lock()
+        self._stdio_started = False
     
     def set_last_chat_id(self, chat_id: str):
         """设置最后收到消息的 chat_id，写入文件供其他进程读取。"""
@@ -69,41 +201,283 @@ class MCPServer:
             logger.error(f"MCP: Error reading last_chat_id: {e}")
         return None
     
-    def create_reply_event(self) -> threading.Event:
-        """创建新的 reply_event，供监控循环使用。当 MCP 发送回复后会 set() 此 event。"""
+    def get_enabled_tools(self) -> List[str]:
+        """
+        返回当前开放的工具名列表。
+        
+        ENABLED_TOOLS 为逗号分隔的工具名，未设置时开放全部工具。
+        每次调用时读取，因为 .env 可能在 MCP Server 启动之后才加载。
+        """
+        all_tools = [tool['name'] for tool in self.TOOL_DEFINITIONS]
+        raw = os.getenv('ENABLED_TOOLS', '').strip()
+        if not raw:
+            return all_tools
+        wanted = {name.strip() for name in raw.split(',') if name.strip()}
+        unknown = wanted - set(all_tools)
+        if unknown:
+            logger.warning(f"MCP: ENABLED_TOOLS contains unknown tools: {sorted(unknown)}")
+        return [name for name in all_tools if name in wanted]
+    
+    def check_tools_changed(self) -> bool:
+        """
+        开放的工具集合与上次 tools/list 返回的不同时，发送 notifications/tools/list_changed。
+        
+        ENABLED_TOOLS 可能在启动后才生效（例如 .env 晚于 MCP Server 加载），
+        客户端收到通知后会重新拉取工具列表。尚未调用过 tools/list 时不发送。
+        
+        Returns:
+            True if a notification was sent.
+        """
+        enabled = self.get_enabled_tools()
+        with self._advertised_lock:
+            if self._advertised_tools is None or self._advertised_tools == enabled:
+                return False
+            self._advertised_tools = enabled
+        logger.info(f"MCP: Tool set changed to {enabled}, notifying client")
+        self._write_output(json.dumps({
+            'jsonrpc': '2.0',
+            'method': 'notifications/tools/list_changed',
+        }))
+        return True
+    
+    def is_read_only_tool(self, tool_name: str) -> bool:
+        """工具定义中 annotations.readOnlyHint 为真时视为只读；未知工具按非只读处理。"""
+        for tool in self.TOOL_DEFINITIONS:
+            if tool['name'] == tool_name:
+                return bool(tool.get('annotations', {}).get('readOnlyHint'))
+        return False
+    
+    def create_reply_event(self, chat_id: Optional[str] = None) -> threading.Event:
+        """
+        创建新的 reply_event，供监控循环使用。
+
+        MCP 向 chat_id 发送回复（文字或图片）后会 set() 此 event，监控循环随即停止心跳。
+        不传 chat_id 时任意回复都会 set。
+        """
+        key = str(chat_id) if chat_id is not None else None
+        event = threading.Event()
+        with self._reply_event_lock:
+            self._reply_events.setdefault(key, []).append(event)
+        return event
+    
+    def remove_reply_event(self, chat_id: Optional[str], event: threading.Event):
+        """工作流结束后移除未被 set 的 reply_event（超时、失败或没有回复），避免 _reply_events 无限增长。"""
+        key = str(chat_id) if chat_id is not None else None
         with self._reply_event_lock:
-            self._reply_event = threading.Event()
-            return self._reply_event
+            events = self._reply_events.get(key, [])
+            if event in events:
+                events.remove(event)
+            if not events:
+                self._reply_events.pop(key, None)
     
-    def start(self):
+    def start(self, input_stream=None):
         """
         Start the stdio listener.
         
         NOTE: This blocks, so run in a thread or as main loop.
         All logs MUST go to stderr because stdout is used for protocol.
+        
+        Input is read in raw chunks and decoded as a stream of JSON values, so a
+        message split across several writes, or one whose trailing newline has
+        not arrived yet, is dispatched as soon as it is complete.
+        
+        Args:
+            input_stream: Binary stream to read from (defaults to sys.stdin.buffer).
         """
         logger.info("MCP Server starting on stdio...")
+        self._stdio_started = True
         
-        for line in sys.stdin:
-            line = line.strip()
-            if not line:
-                continue
-                
+        stream = input_stream if input_stream is not None else sys.stdin.buffer
+        read_chunk = stream.read1 if hasattr(stream, 'read1') else stream.read
+        text_decoder = codecs.getincrementaldecoder('utf-8')(errors='replace')
+        pending = ''
+        
+        while True:
+            chunk = read_chunk(self.READ_CHUNK_SIZE)
+            if not chunk:
+                break
+            pending = self._dispatch_complete(pending + text_decoder.decode(chunk))
+        
+        pending = self._dispatch_complete(pending + text_decoder.decode(b'', final=True))
+        if pending.strip():
+            logger.error(f"MCP: Discarding incomplete JSON at EOF: {pending[:200]!r}")
+    
+    def _dispatch_complete(self, pending: str) -> str:
+        """Dispatch every complete JSON request in pending and return the unconsumed tail."""
+        decoder = json.JSONDecoder()
+        while True:
+            pending = pending.lstrip()
+            if not pending:
+                return ''
+            
             try:
-                request = json.loads(line)
-                # Handle request in a thread
-                thread = threading.Thread(
-                    target=self._handle_request,
-                    args=(request,),
-                    daemon=True
-                )
-                thread.start()
+                request, end = decoder.raw_decode(pending)
             except json.JSONDecodeError as e:
-                logger.error(f"MCP: Error parsing JSON: {e}")
+                # Either the message is still incomplete (wait for more data), or the
+                # current line is garbage. MCP stdio messages never contain raw
+                # newlines, so a bad line followed by the start of another value is
+                # dropped instead of blocking the stream forever.
+                newline = pending.find('\n')
+                next_value = pending[newline + 1:].lstrip() if newline != -1 else ''
+                if next_value[:1] in ('{', '['):
+                    logger.error(f"MCP: Error parsing JSON: {e}; dropping line {pending[:newline][:200]!r}")
+                    pending = pending[newline + 1:]
+                    continue
+                if len(pending) > self.MAX_PENDING_CHARS:
+                    logger.error(f"MCP: Error parsing JSON: {e}; dropping {len(pending)} buffered chars")
+                    return ''
+                return pending
+            
+            pending = pending[end:]
+            if not isinstance(request, dict):
+                logger.error(f"MCP: Ignoring non-object JSON-RPC message: {str(request)[:200]}")
                 continue
+            
+            # Handle request in a thread
+            thread = threading.Thread(
+                target=self._handle_request,
+                args=(request,),
+                daemon=True
+            )
+            thread.start()
+    
+    def start_http(self, host: str = '127.0.0.1', port: int = 8765, token: Optional[str] = None):
+        """
+        Start the HTTP + SSE listener (MCP 2024-11-05 HTTP transport).
+        
+        NOTE: This blocks, so run in a thread.
+        
+        Clients open GET /sse and receive an `endpoint` event with the URL to POST
+        JSON-RPC requests to (/messages?session_id=...). Each POST is answered with
+        202 Accepted; the JSON-RPC response is pushed as a `message` event on that
+        client's SSE stream. Requests go through the same _handle_request as stdio.
+        
+        Args:
+            host: Address to bind; keep 127.0.0.1 unless remote clients need access.
+            port: TCP port.
+            token: If set, requests must send "Authorization: Bearer <token>".
+        """
+        with self._sse_lock:
+            if self._sse_sessions is None:
+                self._sse_sessions = {}
+        server = ThreadingHTTPServer((host, port), self._make_http_handler(token))
+        server.daemon_threads = True
+        logger.info(f"MCP Server starting on http://{host}:{port}/sse ...")
+        server.serve_forever()
     
-    def _handle_request(self, request: Dict[str, Any]):
-        """Handle a single JSON-RPC request."""
+    def _make_http_handler(self, token: Optional[str]):
+        mcp = self
+        
+        class Handler(BaseHTTPRequestHandler):
+            protocol_version = 'HTTP/1.1'
+            
+            def log_message(self, format, *args):
+                logger.debug(f"MCP HTTP: {self.address_string()} {format % args}")
+            
+            def _authorized(self) -> bool:
+                # 常数时间比较，避免通过响应时间逐字节猜出 token
+                supplied = self.headers.get('Authorization', '').encode('utf-8')
+                if not token or hmac.compare_digest(supplied, f'Bearer {token}'.encode('utf-8')):
+                    return True
+                self._reply(401, 'Unauthorized')
+                return False
+            
+            def _reply(self, status: int, text: str):
+                body = text.encode('utf-8')
+                self.send_response(status)
+                self.send_header('Content-Type', 'text/plain; charset=utf-8')
+                self.send_header('Content-Length', str(len(body)))
+                if status >= 400:
+                    # 出错时请求体可能没有读取，不能继续复用连接，否则会被当作下一个请求解析
+                    self.send_header('Connection', 'close')
+                    self.close_connection = True
+                self.end_headers()
+                self.wfile.write(body)
+            
+            def do_GET(self):
+                if urlparse(self.path).path != '/sse':
+                    self._reply(404, 'Not found')
+                    return
+                if not self._authorized():
+                    return
+                session_id = uuid.uuid4().hex
+                messages: queue.Queue = queue.Queue()
+                with mcp._sse_lock:
+                    mcp._sse_sessions[session_id] = messages
+                logger.info(f"MCP HTTP: SSE session {session_id} opened from {self.address_string()}")
+                try:
+                    self.send_response(200)
+                    self.send_header('Content-Type', 'text/event-stream')
+                    self.send_header('Cache-Control', 'no-cache')
+                    self.send_header('Connection', 'keep-alive')
+                    self.end_headers()
+                    self._send_event('endpoint', f'/messages?session_id={session_id}')
+                    while True:
+                        try:
+                            message = messages.get(timeout=mcp.SSE_KEEPALIVE_SECONDS)
+                        except queue.Empty:
+                            self.wfile.write(b': keepalive\n\n')
+                            self.wfile.flush()
+                            continue
+                        self._send_event('message', message)
+                except (BrokenPipeError, ConnectionResetError, OSError):
+                    pass
+                finally:
+                    with mcp._sse_lock:
+                        mcp._sse_sessions.pop(session_id, None)
+                    logger.info(f"MCP HTTP: SSE session {session_id} closed")
+                    self.close_connection = True
+            
+            def _send_event(self, event: str, data: str):
+                self.wfile.write(f'event: {event}\ndata: {data}\n\n'.encode('utf-8'))
+                self.wfile.flush()
+            
+            def do_POST(self):
+                url = urlparse(self.path)
+                if url.path != '/messages':
+                    self._reply(404, 'Not found')
+                    return
+                if not self._authorized():
+                    return
+                session_id = parse_qs(url.query).get('session_id', [''])[0]
+                with mcp._sse_lock:
+                    messages = mcp._sse_sessions.get(session_id)
+                if messages is None:
+                    self._reply(404, 'Unknown session_id')
+                    return
+                try:
+                    length = int(self.headers.get('Content-Length', '0'))
+                except ValueError:
+                    length = -1
+                if length < 0 or length > mcp.MAX_HTTP_BODY:
+                    self._reply(413 if length > 0 else 400, 'Invalid Content-Length')
+                    return
+                try:
+                    payload = json.loads(self.rfile.read(length).decode('utf-8'))
+                except (ValueError, UnicodeDecodeError) as e:
+                    self._reply(400, f'Invalid JSON: {e}')
+                    return
+                requests = payload if isinstance(payload, list) else [payload]
+                if not all(isinstance(request, dict) for request in requests):
+                    self._reply(400, 'JSON-RPC message must be an object')
+                    return
+                self._reply(202, 'Accepted')
+                for request in requests:
+                    threading.Thread(
+                        target=mcp._handle_request,
+                        args=(request, messages.put),
+                        daemon=True
+                    ).start()
+        
+        return Handler
+    
+    def _handle_request(self, request: Dict[str, Any], write: Optional[Callable[[str], None]] = None):
+        """
+        Handle a single JSON-RPC request.
+        
+        The response goes to write (the requesting SSE session) when given,
+        otherwise to stdout.
+        """
         method = request.get('method', '')
         request_id = request.get('id')
         # 确保 params 始终是字典（修复 params: null 的情况）
@@ -119,11 +493,18 @@ class MCPServer:
             logger.debug(f"MCP: Ignoring notification: {method}")
             return
         
+        self.check_tools_changed()
+        
         response: Dict[str, Any] = {
             'jsonrpc': '2.0',
             'id': request_id
         }
         
+        # 请求本身仍在各自线程中处理；只有非只读工具调用需要排队
+        serialize = method == 'tools/call' and not self.is_read_only_tool(params.get('name', ''))
+        if serialize:
+            self._mutating_tool_lock.acquire()
+        
         try:
             if method == 'initialize':
                 # 严格按照 MCP 协议规范返回
@@ -131,7 +512,7 @@ class MCPServer:
                     'protocolVersion': '2024-11-05',
                     'capabilities': {
                         'tools': {
-                            'listChanged': False  # 明确声明不支持动态工具列表变更通知
+                            'listChanged': True  # 开放的工具集合变化时发送 notifications/tools/list_changed
                         },
                     },
                     'serverInfo': {
@@ -145,74 +526,109 @@ class MCPServer:
                 response['result'] = {}
                 
             elif method == 'tools/list':
+                enabled = self.get_enabled_tools()
+                with self._advertised_lock:
+                    self._advertised_tools = enabled
                 response['result'] = {
-                    'tools': [
-                        {
-                            'name': 'reply_to_telegram',
-                            'description': 'Send a message reply to a Telegram Chat ID',
-                            'inputSchema': {
-                                'type': 'object',
-                                'properties': {
-                                    'chat_id': {
-                                        'type': 'string',
-                                        'description': 'The Telegram Chat ID to reply to (optional, uses last message sender if not provided)',
-                                    },
-                                    'text': {
-                                        'type': 'string',
-                                        'description': 'The content of the message',
-                                    },
-                                },
-                                'required': ['text'],
-                            },
-                        },
-                    ],
+                    'tools': [tool for tool in self.TOOL_DEFINITIONS if tool['name'] in enabled],
                 }
                 
             elif method == 'tools/call':
                 tool_name = params.get('name', '')
                 arguments = params.get('arguments', {})
                 
-                if tool_name == 'reply_to_telegram':
+                if tool_name not in self.get_enabled_tools():
+                    response['error'] = {
+                        'code': -32601,
+                        'message': f'Tool not found or disabled: {tool_name}',
+                    }
+                elif tool_name == 'reply_to_telegram':
                     chat_id = arguments.get('chat_id', '') or self.get_last_chat_id() or ''
                     text = arguments.get('text', '')
+                    parse_mode = arguments.get('parse_mode') or None
                     
                     if not chat_id:
                         response['error'] = {
                             'code': -32602,
                             'message': 'chat_id is required (no last_chat_id available)',
                         }
-                    elif not text:
+                    elif not str(text).strip():
+                        # 空白回复在 Telegram 里没有意义（发送也会被拒绝），按缺参处理
                         response['error'] = {
                             'code': -32602,
-                            'message': 'text is required',
+                            'message': 'text is required (empty or whitespace-only)',
+                        }
+                    elif parse_mode is not None and parse_mode not in self.PARSE_MODES:
+                        response['error'] = {
+                            'code': -32602,
+                            'message': f"Invalid parse_mode: {parse_mode} (expected one of {', '.join(self.PARSE_MODES)})",
                         }
                     elif self.telegram_func:
-                        logger.info(f"MCP: Calling reply_to_telegram({chat_id}, {text[:50]}...)")
-                        error = self.telegram_func(chat_id, text)
-                        if error:
+                        chat_ids = [cid.strip() for cid in str(chat_id).split(',') if cid.strip()]
+                        failures: Dict[str, str] = {}
+                        logger.info(f"MCP: Calling reply_to_telegram({', '.join(chat_ids)}, {text[:50]}...)")
+                        # 长回复会被拆成多条依次发送，截止时间按分段数放宽
+                        errors = self._call_all_with_timeout(
+                            self.telegram_func, [(target, text, parse_mode) for target in chat_ids],
+                            scale=max(1, -(-len(text) // self.TELEGRAM_CHUNK_LEN)),
+                        )
+                        for target, error in zip(chat_ids, errors):
+                            if error:
+                                failures[target] = str(error)
+                        
+                        if failures:
+                            self._notify_error(
+                                f"reply_to_telegram 发送到 {', '.join(failures)} 失败: "
+                                f"{'; '.join(f'{cid}: {err}' for cid, err in failures.items())}\n"
+                                f"未送达内容:\n{text[:3000]}"
+                            )
+                        
+                        if len(failures) == len(chat_ids):
                             response['error'] = {
                                 'code': -32000,
-                                'message': f'Telegram Error: {error}',
+                                'message': 'Telegram Error: ' + '; '.join(
+                                    f'{cid}: {err}' if len(chat_ids) > 1 else err
+                                    for cid, err in failures.items()
+                                ),
                             }
                         else:
                             # Signal monitoring loop to stop sending "思考中..."
-                            with self._reply_event_lock:
-                                if self._reply_event:
-                                    self._reply_event.set()
-                                    logger.info("MCP: reply_event set, stopping thinking heartbeat")
+                            self._signal_reply([cid for cid in chat_ids if cid not in failures])
+                            summary = 'Message sent successfully'
+                            if len(chat_ids) > 1:
+                                lines = [
+                                    f'{cid}: ' + (f'failed ({failures[cid]})' if cid in failures else 'sent')
+                                    for cid in chat_ids
+                                ]
+                                summary = f'Sent to {len(chat_ids) - len(failures)}/{len(chat_ids)} chats\n' + '\n'.join(lines)
+                            content: List[Dict[str, Any]] = [
+                                {
+                                    'type': 'text',
+                                    'text': summary,
+                                },
+                            ]
+                            if arguments.get('include_screenshot'):
+                                content.append(self._screenshot_content())
                             response['result'] = {
-                                'content': [
-                                    {
-                                        'type': 'text',
-                                        'text': 'Message sent successfully',
-                                    },
-                                ],
+                                'content': content,
                             }
                     else:
                         response['error'] = {
                             'code': -32000,
                             'message': 'Telegram function not initialized',
                         }
+                elif tool_name == 'send_photo_to_telegram':
+                    result, error = self._send_photo(arguments)
+                    if error:
+                        response['error'] = error
+                    else:
+                        response['result'] = result
+                elif tool_name == 'list_templates':
+                    result, error = self._list_templates(arguments)
+                    if error:
+                        response['error'] = error
+                    else:
+                        response['result'] = result
                 else:
                     response['error'] = {
                         'code': -32601,
@@ -231,11 +647,208 @@ class MCPServer:
                 'code': -32603,
                 'message': f'Internal error: {str(e)}',
             }
+            self._notify_error(f"MCP 请求 {method} 内部错误: {e}")
+        finally:
+            if serialize:
+                self._mutating_tool_lock.release()
         
         # Send response
-        self._write_output(json.dumps(response))
+        (write or self._write_stdout)(json.dumps(response))
+    
+    def _call_with_timeout(self, func: Callable[..., Optional[Exception]], *args) -> Optional[Exception]:
+        """
+        在工作线程中调用发送回调，最多等待 MCP_TOOL_TIMEOUT 秒（默认 10）。
+        
+        网络卡住时超时返回 TimeoutError，让客户端尽快收到错误响应，而不是一直等待；
+        卡住的线程继续在后台运行，其结果被丢弃，响应仍只由 _handle_request 写出一次。
+        """
+        return self._call_all_with_timeout(func, [args])[0]
+    
+    def _call_all_with_timeout(self, func: Callable[..., Optional[Exception]],
+                               calls: List[tuple], scale: int = 1) -> List[Optional[Exception]]:
+        """
+        为每组参数并行调用 func，所有调用共用一个 MCP_TOOL_TIMEOUT 截止时间。
+        
+        群发到多个 chat 时总耗时不超过一次超时（而不是 N 倍），
+        避免长时间占用 _mutating_tool_lock；超时的调用结果为 TimeoutError。
+        每次调用内部需要依次发送多条消息时，scale 为条数，截止时间相应放大。
+        """
+        try:
+            timeout = float(os.getenv('MCP_TOOL_TIMEOUT', '10') or 10)
+        except ValueError:
+            timeout = 10.0
+        timeout *= scale
+        if timeout <= 0:
+            results: List[Optional[Exception]] = []
+            for args in calls:
+                try:
+                    results.append(func(*args))
+                except Exception as e:
+                    results.append(e)
+            return results
+        
+        outcomes: List[Dict[str, Optional[Exception]]] = [{} for _ in calls]
+        
+        def run(args, outcome):
+            try:
+                outcome['error'] = func(*args)
+            except Exception as e:
+                outcome['error'] = e
+        
+        workers = [
+            threading.Thread(target=run, args=(args, outcome), daemon=True)
+            for args, outcome in zip(calls, outcomes)
+        ]
+        for worker in workers:
+            worker.start()
+        deadline = time.monotonic() + timeout
+        errors: List[Optional[Exception]] = []
+        for worker, outcome in zip(workers, outcomes):
+            worker.join(max(0.0, deadline - time.monotonic()))
+            if worker.is_alive():
+                logger.error(f"MCP: {getattr(func, '__name__', 'callback')} timed out after {timeout:g}s")
+                errors.append(TimeoutError(f'timed out after {timeout:g}s'))
+            else:
+                errors.append(outcome.get('error'))
+        return errors
+    
+    def _signal_reply(self, chat_ids: List[str]):
+        """回复已送达这些 chat，通知对应的监控循环停止发送“思考中...”。"""
+        with self._reply_event_lock:
+            for key in [None] + [str(cid) for cid in chat_ids]:
+                events = self._reply_events.pop(key, [])
+                for event in events:
+                    event.set()
+                if events:
+                    logger.info(f"MCP: reply_event set for {key or 'any chat'}, stopping thinking heartbeat")
+    
+    def _send_photo(self, arguments: Dict[str, Any]):
+        """
+        处理 send_photo_to_telegram：发送本地图片（file_path）或 base64 图片（data）。
+        
+        Returns:
+            (result, error)，其中一个为 None
+        """
+        chat_id = str(arguments.get('chat_id', '') or self.get_last_chat_id() or '')
+        file_path = arguments.get('file_path') or ''
+        data = arguments.get('data') or ''
+        caption = arguments.get('caption') or None
+        
+        if not chat_id:
+            return None, {'code': -32602, 'message': 'chat_id is required (no last_chat_id available)'}
+        if not file_path and not data:
+            return None, {'code': -32602, 'message': 'file_path or data is required'}
+        if file_path and not os.path.isfile(file_path):
+            return None, {'code': -32602, 'message': f'File not found: {file_path}'}
+        if not self.photo_func:
+            return None, {'code': -32000, 'message': 'Telegram function not initialized'}
+        
+        temp_path = None
+        if not file_path:
+            try:
+                raw = base64.b64decode(data, validate=True)
+            except (ValueError, TypeError) as e:
+                return None, {'code': -32602, 'message': f'Invalid base64 data: {e}'}
+            fd, temp_path = tempfile.mkstemp(prefix='mcp_photo_', suffix='.png')
+            with os.fdopen(fd, 'wb') as f:
+                f.write(raw)
+            file_path = temp_path
+        
+        def send_photo():
+            # 临时文件在发送结束后由工作线程删除，超时后仍在上传的线程不会读到已删除的文件
+            try:
+                return self.photo_func(chat_id, file_path, caption)
+            finally:
+                if temp_path:
+                    try:
+                        os.remove(temp_path)
+                    except OSError:
+                        pass
+        
+        logger.info(f"MCP: Calling send_photo_to_telegram({chat_id}, {file_path})")
+        error = self._call_with_timeout(send_photo)
+        
+        if error:
+            self._notify_error(f"send_photo_to_telegram 发送到 {chat_id} 失败: {error}")
+            return None, {'code': -32000, 'message': f'Telegram Error: {error}'}
+        self._signal_reply([chat_id])
+        return {'content': [{'type': 'text', 'text': 'Photo sent successfully'}]}, None
+    
+    def _list_templates(self, arguments: Dict[str, Any]):
+        """
+        处理 list_templates：列出模板目录中的图片、像素尺寸以及能否正常解码。
+        
+        Returns:
+            (result, error)，其中一个为 None
+        """
+        if not self.templates_dir_func:
+            return None, {'code': -32000, 'message': 'Templates directory not initialized'}
+        chat_id = str(arguments.get('chat_id') or '').strip() or None
+        try:
+            templates_dir = self.templates_dir_func(chat_id)
+        except Exception as e:
+            return None, {'code': -32602, 'message': f'Cannot resolve templates for chat {chat_id}: {e}'}
+        if not templates_dir or not os.path.isdir(templates_dir):
+            return None, {'code': -32000, 'message': f'Templates directory not found: {templates_dir}'}
+        
+        from PIL import Image
+        
+        lines = [f'Templates in {templates_dir}:']
+        names = sorted(name for name in os.listdir(templates_dir) if name.lower().endswith('.png'))
+        for name in names:
+            try:
+                with Image.open(os.path.join(templates_dir, name)) as img:
+                    img.load()
+                    width, height = img.size
+            except Exception as e:
+                lines.append(f'{name}: FAILED to decode ({e})')
+                continue
+            line = f'{name}: {width}x{height} ok'
+            if min(width, height) < self.TEMPLATE_MIN_SIDE or max(width, height) > self.TEMPLATE_MAX_SIDE:
+                line += ' (suspicious size, recapture?)'
+            lines.append(line)
+        if not names:
+            lines.append('(no .png templates)')
+        return {'content': [{'type': 'text', 'text': '\n'.join(lines)}]}, None
+    
+    def _screenshot_content(self) -> Dict[str, Any]:
+        """截取当前屏幕，返回 MCP image content block；失败时返回说明文字。"""
+        png = None
+        if self.screenshot_func:
+            try:
+                png = self.screenshot_func()
+            except Exception as e:
+                logger.error(f"MCP: Error taking screenshot: {e}")
+        if not png:
+            return {
+                'type': 'text',
+                'text': 'Screenshot unavailable',
+            }
+        return {
+            'type': 'image',
+            'data': base64.b64encode(png).decode('ascii'),
+            'mimeType': 'image/png',
+        }
+    
+    def _notify_error(self, text: str):
+        """把工具调用失败报告给运维通知通道（未配置时忽略）。"""
+        if not self.error_notify_func:
+            return
+        try:
+            self.error_notify_func(f"⚠️ [MCP] {text}")
+        except Exception as e:
+            logger.error(f"MCP: Error notifying operator: {e}")
     
     def _write_output(self, message: str):
+        """Send a server-initiated message (notification) to every connected client: stdout and all SSE sessions."""
+        with self._sse_lock:
+            sessions = list(self._sse_sessions.values()) if self._sse_sessions is not None else None
+        for messages in sessions or []:
+            messages.put(message)
+        if sessions is None or self._stdio_started:
+            self._write_stdout(message)
+    
+    def _write_stdout(self, message: str):
         """Thread-safe write to stdout."""
         with self._output_lock:
             self._stdout.write(message + '\n')
@@ -0,0 +1,49 @@
+"""
+测试公共设施。
+
+测试只覆盖不依赖真实桌面的逻辑；没有安装 telegram、PIL 等第三方包的环境（如 CI）
+中注入占位模块，使 main / automation 可以被导入。已安装时使用真实的包。
+"""
+
+import importlib
+import os
+import sys
+from unittest import mock
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+if ROOT not in sys.path:
+    sys.path.insert(0, ROOT)
+
+_OPTIONAL_MODULES = (
+    "dotenv",
+    "pyperclip",
+    "PIL",
+    "telegram",
+    "telegram.ext",
+    "telegram.utils",
+    "telegram.utils.helpers",
+)
+
+for _name in _OPTIONAL_MODULES:
+    try:
+        importlib.import_module(_name)
+    except ImportError:
+        sys.modules[_name] = mock.MagicMock(name=_name)
+
+
+def has_module(name: str) -> bool:
+    """可选依赖（cv2、numpy）是否可用，用于 skipUnless。"""
+    try:
+        importlib.import_module(name)
+        return True
+    except ImportError:
+        return False
+
+
+def import_main():
+    """导入 main；main 导入时会把 sys.stdout 重定向到 stderr（为 MCP 保留 stdout），这里恢复。"""
+    saved = sys.stdout
+    try:
+        return importlib.import_module("main")
+    finally:
+        sys.stdout = saved
@@ -0,0 +1,63 @@
+"""click_all_accept_buttons：accept_button.png 和 accept_all.png 匹配到同一个按钮时只点击一次。"""
+
+import os
+import shutil
+import tempfile
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+
+class CrossTemplateOverlapTest(unittest.TestCase):
+
+    MATCHES = {
+        "accept_button.png": [(0.9, (100, 200)), (0.85, (100, 300))],
+        # 与 accept_button.png 的 (100, 200) 是同一个按钮，分数更高
+        "accept_all.png": [(0.95, (103, 201)), (0.8, (400, 500))],
+    }
+
+    def setUp(self):
+        self.templates_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.templates_dir)
+        for name in ("input_box.png", "accept_button.png", "accept_all.png"):
+            open(os.path.join(self.templates_dir, name), "wb").close()
+        self.click_at = mock.MagicMock()
+        env = {k: v for k, v in os.environ.items() if k != "VERIFY_ACCEPT"}
+        for patcher in (
+            mock.patch.dict(os.environ, env, clear=True),
+            mock.patch.object(gui_automation, "pyautogui", mock.MagicMock(name="pyautogui")),
+            mock.patch.object(gui_automation, "find_all_on_screen", side_effect=self._find_all),
+            mock.patch.object(gui_automation, "_template_size", return_value=(60, 24)),
+            mock.patch.object(gui_automation, "_matches_enabled_color", return_value=True),
+            mock.patch.object(gui_automation, "_confirm_match", return_value=True),
+            mock.patch.object(gui_automation, "click_at", self.click_at),
+            mock.patch.object(gui_automation.time, "sleep"),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def _find_all(self, image_path, confidence, max_results=10):
+        return self.MATCHES[os.path.basename(image_path)]
+
+    def _clicked(self):
+        return [tuple(call[0][:2]) for call in self.click_at.call_args_list]
+
+    def test_same_button_from_two_templates_is_clicked_once(self):
+        count, _ = gui_automation.click_all_accept_buttons(self.templates_dir)
+
+        self.assertEqual(count, 3)
+        # 从下往上点，重叠的两个匹配只保留分数更高的 accept_all.png
+        self.assertEqual(self._clicked(), [(400, 500), (100, 300), (103, 201)])
+
+    def test_max_clicks_applies_after_merging(self):
+        count, _ = gui_automation.click_all_accept_buttons(self.templates_dir, max_clicks=2)
+
+        self.assertEqual(count, 2)
+        self.assertEqual(self._clicked(), [(400, 500), (100, 300)])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,35 @@
+"""ACTIVE_HOURS 解析：HH:MM-HH:MM，可跨午夜，结束时间允许 24:00。"""
+
+import unittest
+
+from tests.support import import_main
+
+main = import_main()
+
+
+class ParseActiveHoursTest(unittest.TestCase):
+
+    def test_daytime_window(self):
+        self.assertEqual(main.parse_active_hours("09:00-18:30"), (9 * 60, 18 * 60 + 30))
+
+    def test_overnight_window(self):
+        self.assertEqual(main.parse_active_hours(" 22:00 - 06:00 "), (22 * 60, 6 * 60))
+
+    def test_end_of_day(self):
+        self.assertEqual(main.parse_active_hours("00:00-24:00"), (0, 24 * 60))
+
+    def test_24_only_as_24_00(self):
+        for spec in ("09:00-24:30", "09:00-24:01", "24:00-06:00"):
+            self.assertIsNone(main.parse_active_hours(spec), spec)
+
+    def test_empty_window_is_rejected(self):
+        for spec in ("09:00-09:00", "00:00-00:00"):
+            self.assertIsNone(main.parse_active_hours(spec), spec)
+
+    def test_out_of_range_or_malformed(self):
+        for spec in ("09:60-18:00", "09:00-25:00", "9-18", "", "09:00"):
+            self.assertIsNone(main.parse_active_hours(spec), spec)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,43 @@
+"""聊天白名单：TELEGRAM_CHAT_ID / ALLOWED_CHAT_IDS 未设置时允许所有聊天。"""
+
+import os
+import unittest
+from unittest import mock
+
+from tests.support import import_main
+
+main = import_main()
+
+
+class AllowlistTest(unittest.TestCase):
+
+    def _bridge(self, **env):
+        values = {"TELEGRAM_CHAT_ID": "", "ALLOWED_CHAT_IDS": ""}
+        values.update(env)
+        bridge = main.AntigravityBridge()
+        with mock.patch.dict(os.environ, values):
+            bridge._load_allowed_chat_ids()
+        return bridge
+
+    def test_unset_allows_all_chats(self):
+        bridge = self._bridge()
+        self.assertTrue(bridge.is_chat_allowed(123))
+        self.assertTrue(bridge.is_chat_allowed(-100456))
+
+    def test_whitespace_only_counts_as_unset(self):
+        self.assertTrue(self._bridge(ALLOWED_CHAT_IDS="  ").is_chat_allowed(123))
+
+    def test_listed_chats_only(self):
+        bridge = self._bridge(TELEGRAM_CHAT_ID="123", ALLOWED_CHAT_IDS="456, -789,123")
+        self.assertEqual(bridge.ALLOWED_CHAT_IDS, [123, 456, -789])
+        self.assertTrue(bridge.is_chat_allowed(-789))
+        self.assertFalse(bridge.is_chat_allowed(999))
+
+    def test_only_invalid_ids_does_not_allow_all(self):
+        bridge = self._bridge(ALLOWED_CHAT_IDS="abc")
+        self.assertEqual(bridge.ALLOWED_CHAT_IDS, [])
+        self.assertFalse(bridge.is_chat_allowed(123))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,47 @@
+"""request_approval：等待批准时工作流被取消立即返回，超时读取 APPROVAL_TIMEOUT。"""
+
+import os
+import threading
+import time
+import unittest
+from unittest import mock
+
+from tests.support import import_main
+
+main = import_main()
+
+
+class RequestApprovalTest(unittest.TestCase):
+
+    def setUp(self):
+        self.bridge = main.AntigravityBridge()
+        self.bridge.bot = mock.MagicMock()
+        patcher = mock.patch.object(main, "take_screenshot", return_value=(False, "no display"))
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_cancel_stops_waiting(self):
+        cancel_event = threading.Event()
+        threading.Timer(0.1, cancel_event.set).start()
+        started = time.monotonic()
+        with mock.patch.dict(os.environ, {"APPROVAL_TIMEOUT": "30"}):
+            approved = self.bridge.request_approval(1, "删除文件？", cancel_event)
+
+        self.assertIsNone(approved)
+        self.assertLess(time.monotonic() - started, 5)
+        self.assertEqual(self.bridge._pending_approvals, {})
+
+    def test_invalid_timeout_falls_back_to_default(self):
+        def answer(*args, **kwargs):
+            with self.bridge._approvals_lock:
+                entry = next(iter(self.bridge._pending_approvals.values()))
+            entry['approved'] = True
+            entry['event'].set()
+
+        self.bridge.bot.send_message.side_effect = answer
+        with mock.patch.dict(os.environ, {"APPROVAL_TIMEOUT": "five"}):
+            self.assertTrue(self.bridge.request_approval(1, "删除文件？"))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,57 @@
+import unittest
+
+from tests.support import import_main
+
+main = import_main()
+Bridge = main.AntigravityBridge
+
+
+class InterleavedOrderTest(unittest.TestCase):
+    def test_single_photo_with_caption_keeps_default_order(self):
+        # 说明在 content_items 中先于图片记录，但属于同一条消息，不算交错
+        items = [(0, "text", "what is this?"), (0, "image", "/tmp/a.png")]
+        self.assertIsNone(Bridge._interleaved_order(items))
+
+    def test_album_with_caption_on_last_photo_keeps_default_order(self):
+        items = [(0, "image", "/tmp/a.png"), (1, "text", "compare"), (1, "image", "/tmp/b.png")]
+        self.assertIsNone(Bridge._interleaved_order(items))
+
+    def test_attachments_then_text_keeps_default_order(self):
+        items = [(0, "image", "/tmp/a.png"), (1, "file", "/tmp/b.log"), (2, "text", "see above")]
+        self.assertIsNone(Bridge._interleaved_order(items))
+
+    def test_text_only_keeps_default_order(self):
+        self.assertIsNone(Bridge._interleaved_order([(0, "text", "a"), (1, "text", "b")]))
+
+    def test_text_between_attachments_is_ordered(self):
+        items = [(0, "image", "/tmp/a.png"), (1, "text", "then"), (2, "image", "/tmp/b.png")]
+        self.assertEqual(
+            Bridge._interleaved_order(items),
+            [("image", "/tmp/a.png"), ("text", "then"), ("image", "/tmp/b.png")],
+        )
+
+    def test_caption_stays_with_its_own_photo(self):
+        items = [(0, "text", "first"), (0, "image", "/tmp/a.png"), (1, "image", "/tmp/b.png")]
+        self.assertEqual(
+            Bridge._interleaved_order(items),
+            [("image", "/tmp/a.png"), ("text", "first"), ("image", "/tmp/b.png")],
+        )
+
+    def test_text_message_before_attachment_is_ordered(self):
+        items = [(0, "text", "look at this"), (1, "image", "/tmp/a.png"), (2, "text", "and fix it")]
+        self.assertEqual(
+            Bridge._interleaved_order(items),
+            [("text", "look at this"), ("image", "/tmp/a.png"), ("text", "and fix it")],
+        )
+
+    def test_decorate_adds_context_to_first_and_last_text(self):
+        items = Bridge._decorate_ordered_items(
+            [("text", "one"), ("image", "/tmp/a.png"), ("text", "two")], "be brief"
+        )
+        self.assertEqual(items[0], ("text", "[Instructions for this conversation]\nbe brief\n\nFrom Telegram: one\n"))
+        self.assertEqual(items[1], ("image", "/tmp/a.png"))
+        self.assertTrue(items[2][1].startswith("two (Group/Attachments)\n"))
+
+
+if __name__ == "__main__":
+    unittest.main()
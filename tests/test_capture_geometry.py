@@ -0,0 +1,83 @@
+"""CAPTURE_GEOMETRY：截屏命令只截取该区域，识别出的坐标换算回桌面绝对坐标。"""
+
+import os
+import subprocess
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+TSV_HEADER = "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext"
+
+
+class _Runner(gui_automation.CommandRunner):
+
+    def __init__(self, stdout=""):
+        self.calls = []
+        self.stdout = stdout
+
+    def run(self, args, **kwargs):
+        self.calls.append(list(args))
+        return subprocess.CompletedProcess(args, 0, stdout=self.stdout, stderr="")
+
+
+class CaptureGeometryTest(unittest.TestCase):
+
+    def setUp(self):
+        self.runner = _Runner()
+        previous = gui_automation.set_command_runner(self.runner)
+        self.addCleanup(gui_automation.set_command_runner, previous)
+
+        self.fake_pyautogui = mock.MagicMock(name="pyautogui")
+        self.fake_pyautogui.size.return_value = (3840, 1080)
+        env = {k: v for k, v in os.environ.items()
+               if k not in ("WAYLAND_DISPLAY", "XDG_SESSION_TYPE", "SCREENSHOT_CMD", "CHECK_SCREENSHOT_FRESH")}
+        env["CAPTURE_GEOMETRY"] = "1920x1080+1920+0"
+        for patcher in (
+            mock.patch.dict(os.environ, env, clear=True),
+            mock.patch.object(gui_automation, "_capture_geometry_cache", (None, None)),
+            mock.patch.object(gui_automation, "pyautogui", None),
+            mock.patch.object(gui_automation, "_ensure_pyautogui", side_effect=self._load_pyautogui),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def _load_pyautogui(self):
+        gui_automation.pyautogui = self.fake_pyautogui
+        return self.fake_pyautogui
+
+    def test_capture_region_loads_pyautogui_before_reading_screen_size(self):
+        self.assertEqual(gui_automation._capture_region(), (1920, 0, 1920, 1080))
+        self.fake_pyautogui.size.assert_called_once_with()
+
+    def test_expand_region_loads_pyautogui(self):
+        self.assertEqual(gui_automation._expand_region((3800, 10, 30, 30), 20), (3780, 0, 60, 60))
+
+    def test_scrot_gets_area(self):
+        ok, _ = gui_automation.take_screenshot("/tmp/geometry_test.png")
+        self.assertTrue(ok)
+        self.assertEqual(self.runner.calls, [['scrot', '-a', '1920,0,1920,1080', '/tmp/geometry_test.png']])
+
+    def test_grim_gets_geometry_on_wayland(self):
+        with mock.patch.dict(os.environ, {"WAYLAND_DISPLAY": "wayland-0"}):
+            gui_automation.take_screenshot("/tmp/geometry_test.png")
+        self.assertEqual(self.runner.calls, [['grim', '-g', '1920,0 1920x1080', '/tmp/geometry_test.png']])
+
+    def test_full_desktop_without_geometry(self):
+        with mock.patch.dict(os.environ, {"CAPTURE_GEOMETRY": ""}):
+            gui_automation.take_screenshot("/tmp/geometry_test.png")
+        self.assertEqual(self.runner.calls, [['scrot', '/tmp/geometry_test.png']])
+
+    def test_ocr_coordinates_are_absolute(self):
+        self.runner.stdout = "\n".join([
+            TSV_HEADER,
+            "5\t1\t1\t1\t1\t1\t100\t40\t60\t20\t95\tRetry",
+        ])
+        self.assertEqual(gui_automation.ocr_find_text("retry"), (1920 + 130, 50))
+        self.assertEqual(self.runner.calls[0][:3], ['scrot', '-a', '1920,0,1920,1080'])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,100 @@
+"""并发工作流的临时截图按 workflow_id 区分，互不覆盖。"""
+
+import os
+import shutil
+import subprocess
+import tempfile
+import threading
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+
+class _TesseractRunner(gui_automation.CommandRunner):
+    """tesseract 调用返回截图文件内容（即写入它的工作流），其余命令直接成功。"""
+
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.ocr_reads = {}
+
+    def run(self, args, **kwargs):
+        stdout = ""
+        if args[0] == 'tesseract':
+            with open(args[1]) as f:
+                content = f.read()
+            with self.lock:
+                self.ocr_reads.setdefault(threading.current_thread().name, []).append((args[1], content))
+        return subprocess.CompletedProcess(args, 0, stdout=stdout, stderr="")
+
+
+class ConcurrentMonitorTest(unittest.TestCase):
+
+    def setUp(self):
+        self.runner = _TesseractRunner()
+        previous = gui_automation.set_command_runner(self.runner)
+        self.addCleanup(gui_automation.set_command_runner, previous)
+
+        self.templates_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.templates_dir)
+        for name in ("input_box.png", "Retry.png"):
+            open(os.path.join(self.templates_dir, name), "wb").close()
+
+        # 两个工作流都截好图之后才继续，保证临时文件同时存在
+        barrier = threading.Barrier(2, timeout=5)
+
+        def fake_take_screenshot(path, region=None):
+            with open(path, "w") as f:
+                f.write(threading.current_thread().name)
+            barrier.wait()
+            return True, ""
+
+        for patcher in (
+            mock.patch.dict(os.environ, {"OCR_FALLBACK": "1"}),
+            mock.patch.object(gui_automation, "pyautogui", mock.MagicMock(name="pyautogui")),
+            mock.patch.object(gui_automation, "take_screenshot", side_effect=fake_take_screenshot),
+            mock.patch.object(gui_automation, "wait_for_template", return_value=(False, None)),
+            mock.patch.object(gui_automation, "replying_frames", return_value=[]),
+            mock.patch.object(gui_automation, "find_image", return_value=None),
+            mock.patch.object(gui_automation, "best_match_on_screen", return_value=None),
+            mock.patch.object(gui_automation, "handle_model_switch", return_value="NOT_FOUND"),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_two_monitors_use_separate_screenshots(self):
+        errors = []
+
+        def monitor(workflow_id):
+            try:
+                gui_automation.monitor_process(self.templates_dir, workflow_id=workflow_id)
+            except Exception as e:  # pragma: no cover - 失败时在主线程报告
+                errors.append(e)
+
+        threads = [threading.Thread(target=monitor, args=(wid,), name=wid) for wid in ("wf000001", "wf000002")]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join(10)
+
+        self.assertEqual(errors, [])
+        self.assertEqual(set(self.runner.ocr_reads), {"wf000001", "wf000002"})
+        paths = set()
+        for workflow_id, reads in self.runner.ocr_reads.items():
+            for path, content in reads:
+                self.assertIn(workflow_id, os.path.basename(path))
+                self.assertEqual(content, workflow_id)
+                self.assertFalse(os.path.exists(path))
+                paths.add(path)
+        self.assertEqual(len(paths), 2)
+
+    def test_without_workflow_id_paths_are_unique(self):
+        first = gui_automation._temp_image_path("ocr_screen")
+        second = gui_automation._temp_image_path("ocr_screen")
+        self.assertNotEqual(first, second)
+
+
+if __name__ == "__main__":
+    unittest.main()
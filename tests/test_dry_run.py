@@ -0,0 +1,70 @@
+"""DRY_RUN：与真实运行使用同一个输入框查找路径，且不激活窗口、不点击。"""
+
+import os
+import shutil
+import tempfile
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+
+class DryRunTest(unittest.TestCase):
+
+    def setUp(self):
+        self.templates_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.templates_dir)
+        open(os.path.join(self.templates_dir, "input_box.png"), "wb").close()
+        self.locate = mock.MagicMock(return_value=(300, 400))
+        self.activate = mock.MagicMock(return_value=True)
+        self.click_at = mock.MagicMock()
+        env = {k: v for k, v in os.environ.items() if k != "CAPTURE_PREDELAY_MS"}
+        env["DRY_RUN"] = "1"
+        for patcher in (
+            mock.patch.dict(os.environ, env, clear=True),
+            mock.patch.object(gui_automation, "pyautogui", mock.MagicMock(name="pyautogui")),
+            mock.patch.object(gui_automation, "locate_center_on_screen", self.locate),
+            mock.patch.object(gui_automation, "activate_window", self.activate),
+            mock.patch.object(gui_automation, "click_at", self.click_at),
+            mock.patch.object(gui_automation, "_click_point", side_effect=lambda path, center, offset, default_offset=(0, 0): (
+                center[0] + default_offset[0], center[1] + default_offset[1])),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        self.statuses = []
+
+    def _run(self):
+        return gui_automation.full_workflow("hello", self.templates_dir, self.statuses.append,
+                                            window_title="antigravity")
+
+    def test_found_with_the_real_locate_path(self):
+        result = self._run()
+
+        self.assertTrue(result.success)
+        self.locate.assert_called_once_with(os.path.join(self.templates_dir, "input_box.png"), 0.8)
+        self.assertIn("找到 @ (300, 400)，将点击 (280, 390)", self.statuses[-1])
+        self.activate.assert_not_called()
+        self.click_at.assert_not_called()
+
+    def test_not_found_even_if_best_candidate_scores_high(self):
+        self.locate.return_value = None
+        with mock.patch.object(gui_automation, "best_match_on_screen", return_value=(0.95, (10, 20))):
+            result = self._run()
+
+        self.assertFalse(result.success)
+        self.assertEqual(result.error_code, "input_box_not_found")
+        self.assertIn("未找到，最佳候选 95/100 @ (10, 20)", self.statuses[-1])
+        self.activate.assert_not_called()
+
+    def test_media_group_skips_window_activation(self):
+        result = gui_automation.full_workflow_media_group(
+            [], "hello", self.templates_dir, self.statuses.append, window_title="antigravity")
+
+        self.assertTrue(result.success)
+        self.activate.assert_not_called()
+
+
+if __name__ == "__main__":
+    unittest.main()
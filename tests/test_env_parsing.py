@@ -0,0 +1,69 @@
+"""环境变量解析：格式错误时记录警告并回退到默认值。"""
+
+import os
+import unittest
+from unittest import mock
+
+from tests.support import import_main
+
+main = import_main()
+
+
+class EnvIntTest(unittest.TestCase):
+
+    def test_valid_value(self):
+        with mock.patch.dict(os.environ, {"MAX_PROMPT_CHARS": " 5000 "}):
+            self.assertEqual(main._env_int("MAX_PROMPT_CHARS", 0), 5000)
+
+    def test_unset_or_empty_uses_default(self):
+        with mock.patch.dict(os.environ, {"MAX_PROMPT_CHARS": ""}):
+            self.assertEqual(main._env_int("MAX_PROMPT_CHARS", 7), 7)
+
+    def test_invalid_value_warns_and_uses_default(self):
+        with mock.patch.dict(os.environ, {"MAX_PROMPT_CHARS": "5k"}), \
+                self.assertLogs(main.logger, level="WARNING") as logs:
+            self.assertEqual(main._env_int("MAX_PROMPT_CHARS", 0), 0)
+        self.assertIn("MAX_PROMPT_CHARS", logs.output[0])
+
+
+
+class EnvFloatTest(unittest.TestCase):
+
+    def test_valid_value(self):
+        with mock.patch.dict(os.environ, {"EDIT_DEBOUNCE_SECONDS": "2.5"}):
+            self.assertEqual(main._env_float("EDIT_DEBOUNCE_SECONDS", 8.0), 2.5)
+
+    def test_invalid_value_warns_and_uses_default(self):
+        with mock.patch.dict(os.environ, {"EDIT_DEBOUNCE_SECONDS": "8s"}), \
+                self.assertLogs(main.logger, level="WARNING"):
+            self.assertEqual(main._env_float("EDIT_DEBOUNCE_SECONDS", 8.0), 8.0)
+
+
+class ScreenshotSettingsTest(unittest.TestCase):
+
+    def _load(self, **env):
+        values = {"SCREENSHOT_MAX_DIM": "", "SCREENSHOT_JPEG_QUALITY": ""}
+        values.update(env)
+        bridge = main.AntigravityBridge()
+        with mock.patch.dict(os.environ, values):
+            bridge._load_screenshot_settings()
+        return bridge._screenshot_max_dim, bridge._screenshot_jpeg_quality
+
+    def test_defaults_keep_original(self):
+        self.assertEqual(self._load(), (0, 0))
+
+    def test_valid_values(self):
+        self.assertEqual(self._load(SCREENSHOT_MAX_DIM="1600", SCREENSHOT_JPEG_QUALITY="70"), (1600, 70))
+
+    def test_quality_is_clamped(self):
+        self.assertEqual(self._load(SCREENSHOT_JPEG_QUALITY="100")[1], 95)
+        self.assertEqual(self._load(SCREENSHOT_JPEG_QUALITY="1")[1], 1)
+        self.assertEqual(self._load(SCREENSHOT_JPEG_QUALITY="-3")[1], 0)
+
+    def test_invalid_values_fall_back(self):
+        with self.assertLogs(main.logger, level="WARNING"):
+            self.assertEqual(self._load(SCREENSHOT_MAX_DIM="big", SCREENSHOT_JPEG_QUALITY="high"), (0, 0))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,98 @@
+"""HTTP + SSE 传输：token 校验、POST 请求的响应通过 SSE 推送给对应会话。"""
+
+import http.client
+import json
+import threading
+import unittest
+from http.server import ThreadingHTTPServer
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from mcp.server import MCPServer
+
+
+class MCPHttpTest(unittest.TestCase):
+
+    TOKEN = "s3cret"
+
+    def setUp(self):
+        self.server = MCPServer(stdout_stream=mock.MagicMock())
+        self.server._sse_sessions = {}
+        self.httpd = ThreadingHTTPServer(("127.0.0.1", 0), self.server._make_http_handler(self.TOKEN))
+        self.httpd.daemon_threads = True
+        threading.Thread(target=self.httpd.serve_forever, daemon=True).start()
+        self.addCleanup(self.httpd.server_close)
+        self.addCleanup(self.httpd.shutdown)
+        self.port = self.httpd.server_address[1]
+
+    def _connection(self):
+        connection = http.client.HTTPConnection("127.0.0.1", self.port, timeout=5)
+        self.addCleanup(connection.close)
+        return connection
+
+    def _headers(self, token=TOKEN):
+        return {"Authorization": f"Bearer {token}"} if token else {}
+
+    @staticmethod
+    def _read_event(response):
+        """读取一个 SSE 事件，返回 (event, data)。"""
+        event = data = None
+        while True:
+            line = response.readline().decode("utf-8").rstrip("\n")
+            if line.startswith("event: "):
+                event = line[len("event: "):]
+            elif line.startswith("data: "):
+                data = line[len("data: "):]
+            elif not line and event:
+                return event, data
+
+    def _open_sse(self):
+        connection = self._connection()
+        connection.request("GET", "/sse", headers=self._headers())
+        response = connection.getresponse()
+        self.assertEqual(response.status, 200)
+        event, endpoint = self._read_event(response)
+        self.assertEqual(event, "endpoint")
+        return response, endpoint
+
+    def test_missing_or_wrong_token_is_rejected(self):
+        for token in (None, "wrong"):
+            with self.subTest(token=token):
+                connection = self._connection()
+                connection.request("GET", "/sse", headers=self._headers(token))
+                response = connection.getresponse()
+                response.read()
+                self.assertEqual(response.status, 401)
+
+                connection = self._connection()
+                connection.request("POST", "/messages?session_id=x", body=b"{}", headers=self._headers(token))
+                response = connection.getresponse()
+                response.read()
+                self.assertEqual(response.status, 401)
+
+    def test_post_response_is_delivered_over_sse(self):
+        stream, endpoint = self._open_sse()
+
+        connection = self._connection()
+        body = json.dumps({"jsonrpc": "2.0", "id": 7, "method": "ping"}).encode("utf-8")
+        connection.request("POST", endpoint, body=body,
+                           headers=dict(self._headers(), **{"Content-Type": "application/json"}))
+        response = connection.getresponse()
+        response.read()
+        self.assertEqual(response.status, 202)
+
+        event, data = self._read_event(stream)
+        self.assertEqual(event, "message")
+        self.assertEqual(json.loads(data), {"jsonrpc": "2.0", "id": 7, "result": {}})
+
+    def test_unknown_session_is_rejected(self):
+        connection = self._connection()
+        connection.request("POST", "/messages?session_id=nope", body=b"{}", headers=self._headers())
+        response = connection.getresponse()
+        response.read()
+        self.assertEqual(response.status, 404)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,90 @@
+"""MCP stdio 输入按字节块读取：消息可跨块、可同块多条、可不带结尾换行，坏行被丢弃。"""
+
+import json
+import threading
+import time
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from mcp.server import MCPServer
+
+
+class _ChunkedStream:
+    """每次 read1 返回预设的一块字节，模拟管道中任意切分的写入。"""
+
+    def __init__(self, chunks):
+        self._chunks = list(chunks)
+
+    def read1(self, size=-1):
+        return self._chunks.pop(0) if self._chunks else b''
+
+
+def _request(request_id, text="hi"):
+    return json.dumps({"jsonrpc": "2.0", "id": request_id, "method": "ping", "params": {"text": text}}, ensure_ascii=False)
+
+
+class StdinChunkingTest(unittest.TestCase):
+
+    def setUp(self):
+        self.server = MCPServer(stdout_stream=mock.MagicMock())
+        self.received = []
+        self.lock = threading.Lock()
+
+        def record(request, write=None):
+            with self.lock:
+                self.received.append(request)
+
+        self.server._handle_request = record
+
+    def _run(self, chunks, expected):
+        self.server.start(_ChunkedStream(chunks))
+        deadline = time.time() + 2
+        while time.time() < deadline:
+            with self.lock:
+                if len(self.received) >= expected:
+                    break
+            time.sleep(0.01)
+        time.sleep(0.05)
+        with self.lock:
+            return sorted(self.received, key=lambda request: request["id"])
+
+    def test_message_split_across_reads(self):
+        data = (_request(1, "你好") + "\n").encode("utf-8")
+        # 在多字节汉字中间切开
+        cut = data.index("你".encode("utf-8")) + 1
+        received = self._run([data[:5], data[5:cut], data[cut:]], 1)
+        self.assertEqual([(r["id"], r["params"]["text"]) for r in received], [(1, "你好")])
+
+    def test_two_messages_in_one_chunk(self):
+        received = self._run([(_request(1) + "\n" + _request(2) + "\n").encode()], 2)
+        self.assertEqual([r["id"] for r in received], [1, 2])
+
+    def test_unterminated_last_message_is_dispatched(self):
+        received = self._run([(_request(1) + "\n").encode(), _request(2).encode()], 2)
+        self.assertEqual([r["id"] for r in received], [1, 2])
+
+    def test_garbage_line_is_dropped(self):
+        chunks = [b"not json at all\n", (_request(1) + "\n").encode(), b"{broken\n", (_request(2) + "\n").encode()]
+        received = self._run(chunks, 2)
+        self.assertEqual([r["id"] for r in received], [1, 2])
+
+    def test_non_object_message_is_ignored(self):
+        received = self._run([b"[1, 2]\n", (_request(1) + "\n").encode()], 1)
+        self.assertEqual([r["id"] for r in received], [1])
+
+    def test_pending_overflow_is_discarded(self):
+        self.server.MAX_PENDING_CHARS = 64
+        chunks = [b'{"jsonrpc": "2.0", "id": 9, "params": {"text": "' + b"x" * 100, (_request(1) + "\n").encode()]
+        received = self._run(chunks, 1)
+        self.assertEqual([r["id"] for r in received], [1])
+
+    def test_incomplete_message_below_limit_waits_for_more_data(self):
+        data = (_request(1) + "\n").encode()
+        self.assertEqual(self.server._dispatch_complete(data[:10].decode()), data[:10].decode())
+        self.assertEqual(self.received, [])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,96 @@
+"""MCP_TOOL_TIMEOUT：群发共用一个截止时间，发图同样受超时限制。"""
+
+import base64
+import json
+import os
+import threading
+import time
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from mcp.server import MCPServer
+
+
+class MCPTimeoutTest(unittest.TestCase):
+
+    TIMEOUT = 0.3
+
+    def setUp(self):
+        self.release = threading.Event()
+        self.addCleanup(self.release.set)
+        self.responses = []
+        env = {k: v for k, v in os.environ.items() if k != "ENABLED_TOOLS"}
+        env["MCP_TOOL_TIMEOUT"] = str(self.TIMEOUT)
+        patcher = mock.patch.dict(os.environ, env, clear=True)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def _hang(self, *args):
+        self.release.wait(5)
+
+    def _call(self, server, name, arguments):
+        request = {"jsonrpc": "2.0", "id": 1, "method": "tools/call",
+                   "params": {"name": name, "arguments": arguments}}
+        started = time.monotonic()
+        server._handle_request(request, write=lambda line: self.responses.append(json.loads(line)))
+        return time.monotonic() - started, self.responses[-1]
+
+    def test_fan_out_shares_one_deadline(self):
+        server = MCPServer(telegram_func=self._hang, stdout_stream=mock.MagicMock())
+        elapsed, response = self._call(server, "reply_to_telegram", {"chat_id": "1,2,3,4", "text": "hi"})
+
+        self.assertLess(elapsed, self.TIMEOUT * 2)
+        self.assertIn("timed out", response["error"]["message"])
+
+    def test_fan_out_sends_in_parallel(self):
+        sent = []
+
+        def slow_send(chat_id, text, parse_mode):
+            time.sleep(self.TIMEOUT / 2)
+            sent.append(chat_id)
+
+        server = MCPServer(telegram_func=slow_send, stdout_stream=mock.MagicMock())
+        _, response = self._call(server, "reply_to_telegram", {"chat_id": "1,2,3,4", "text": "hi"})
+
+        self.assertNotIn("error", response)
+        self.assertEqual(sorted(sent), ["1", "2", "3", "4"])
+
+    def test_long_reply_deadline_scales_with_chunks(self):
+        def chunked_send(chat_id, text, parse_mode):
+            # 模拟 send_telegram 依次发送三段，每段耗时接近一次超时
+            for _ in range(3):
+                time.sleep(self.TIMEOUT * 0.8)
+
+        server = MCPServer(telegram_func=chunked_send, stdout_stream=mock.MagicMock())
+        text = "x" * (MCPServer.TELEGRAM_CHUNK_LEN * 3)
+        _, response = self._call(server, "reply_to_telegram", {"chat_id": "1", "text": text})
+
+        self.assertNotIn("error", response)
+
+    def test_send_photo_times_out(self):
+        paths = []
+
+        def hang_photo(chat_id, file_path, caption):
+            paths.append(file_path)
+            self.release.wait(5)
+
+        server = MCPServer(photo_func=hang_photo, stdout_stream=mock.MagicMock())
+        data = base64.b64encode(b"\x89PNG").decode()
+        elapsed, response = self._call(server, "send_photo_to_telegram", {"chat_id": "1", "data": data})
+
+        self.assertLess(elapsed, self.TIMEOUT * 2)
+        self.assertIn("timed out", response["error"]["message"])
+        # 仍在上传的线程结束后才删除临时文件
+        self.assertTrue(os.path.exists(paths[0]))
+        self.release.set()
+        for _ in range(50):
+            if not os.path.exists(paths[0]):
+                break
+            time.sleep(0.01)
+        self.assertFalse(os.path.exists(paths[0]))
+
+
+if __name__ == "__main__":
+    unittest.main()
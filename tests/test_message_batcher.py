@@ -0,0 +1,74 @@
+import threading
+import time
+import unittest
+from types import SimpleNamespace
+
+from tests.support import import_main
+
+main = import_main()
+
+
+def _message(message_id: int):
+    return SimpleNamespace(message_id=message_id, to_dict=lambda: {"message_id": message_id})
+
+
+class MessageBatcherTest(unittest.TestCase):
+    def setUp(self):
+        self.flushed = []
+        self.flushed_event = threading.Event()
+
+        def on_flush(chat_id, messages):
+            self.flushed.append((chat_id, [m.message_id for m in messages]))
+            self.flushed_event.set()
+
+        self.on_flush = on_flush
+
+    def test_flushes_after_quiescence(self):
+        batcher = main.MessageBatcher(self.on_flush, quiescence=0.05)
+        self.assertEqual(batcher.add(1, _message(10)), 1)
+        self.assertTrue(self.flushed_event.wait(2))
+        self.assertEqual(self.flushed, [(1, [10])])
+
+    def test_new_message_restarts_timer(self):
+        batcher = main.MessageBatcher(self.on_flush, quiescence=0.3)
+        batcher.add(1, _message(10))
+        time.sleep(0.2)
+        self.assertEqual(batcher.add(1, _message(11)), 2)
+        # 第一条消息的计时器本应在 0.3 秒时触发，已被第二条消息重置
+        time.sleep(0.15)
+        self.assertEqual(self.flushed, [])
+        self.assertTrue(self.flushed_event.wait(2))
+        self.assertEqual(self.flushed, [(1, [10, 11])])
+
+    def test_buffer_removed_after_flush(self):
+        batcher = main.MessageBatcher(self.on_flush, quiescence=0.05)
+        batcher.add(1, _message(10))
+        self.assertEqual(batcher.pending(1), 1)
+        self.assertTrue(self.flushed_event.wait(2))
+        self.assertEqual(batcher.pending(1), 0)
+        self.assertNotIn(1, batcher._buffers)
+        # 已处理过的消息再次投递时被识别为重复，不会重新缓冲
+        self.assertIsNone(batcher.add(1, _message(10)))
+        self.assertEqual(batcher.pending(1), 0)
+
+    def test_chats_are_buffered_independently(self):
+        batcher = main.MessageBatcher(self.on_flush, quiescence=0.05)
+        batcher.add(1, _message(10))
+        batcher.add(2, _message(20))
+        deadline = time.time() + 2
+        while len(self.flushed) < 2 and time.time() < deadline:
+            time.sleep(0.01)
+        self.assertCountEqual(self.flushed, [(1, [10]), (2, [20])])
+
+    def test_was_flushed_only_for_sent_messages(self):
+        batcher = main.MessageBatcher(self.on_flush, quiescence=0.05)
+        batcher.add(1, _message(10))
+        self.assertFalse(batcher.was_flushed(1, 10))
+        self.assertTrue(self.flushed_event.wait(2))
+        self.assertTrue(batcher.was_flushed(1, 10))
+        self.assertFalse(batcher.was_flushed(1, 11))
+        self.assertFalse(batcher.was_flushed(2, 10))
+
+
+if __name__ == "__main__":
+    unittest.main()
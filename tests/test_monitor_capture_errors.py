@@ -0,0 +1,60 @@
+"""monitor_process 阶段 1：截屏失败不能被当作“Replying 未出现”，应记为 screenshot_failed。"""
+
+import os
+import shutil
+import tempfile
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+
+class PhaseOneCaptureErrorTest(unittest.TestCase):
+
+    def setUp(self):
+        self.templates_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.templates_dir)
+        for name in ("input_box.png", "Replying.png"):
+            open(os.path.join(self.templates_dir, name), "wb").close()
+        self.locate = mock.MagicMock(side_effect=RuntimeError("cannot open display"))
+        self.phase3 = mock.MagicMock(return_value=False)
+        env = {k: v for k, v in os.environ.items() if k != "REPLYING_REGION"}
+        for patcher in (
+            mock.patch.dict(os.environ, env, clear=True),
+            mock.patch.object(gui_automation, "pyautogui", mock.MagicMock(name="pyautogui")),
+            mock.patch.object(gui_automation, "locate_center_on_screen", self.locate),
+            mock.patch.object(gui_automation, "_check_retry", self.phase3),
+            mock.patch.object(gui_automation.time, "sleep"),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        self.statuses = []
+
+    def _monitor(self, **options):
+        result = gui_automation.WorkflowResult()
+        gui_automation.monitor_process(
+            self.templates_dir, self.statuses.append, result=result,
+            options=gui_automation.MonitorOptions(**options),
+        )
+        return result
+
+    def test_repeated_failures_stop_the_monitor(self):
+        result = self._monitor(appear_timeout=60, max_capture_errors=3)
+
+        self.assertEqual(result.error_code, "screenshot_failed")
+        self.assertEqual(self.locate.call_count, 3)
+        self.assertIn("截屏失败", self.statuses[-1])
+        self.phase3.assert_not_called()
+
+    def test_timeout_without_any_capture_is_a_failure(self):
+        result = self._monitor(appear_timeout=0, max_capture_errors=3)
+
+        self.assertEqual(result.error_code, "screenshot_failed")
+        self.assertEqual(self.locate.call_count, 1)
+        self.phase3.assert_not_called()
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,113 @@
+"""VERIFY_PASTE：OCR 输入框确认提示词已粘贴，中文提示词同样可以校验，无法校验时不当作成功。"""
+
+import os
+import subprocess
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+REGION = (100, 200, 600, 120)
+
+
+class PasteTokensTest(unittest.TestCase):
+
+    def test_chinese_is_split_into_four_character_chunks(self):
+        self.assertEqual(
+            gui_automation._paste_tokens("请帮我把这个函数改成异步的"),
+            ["改成异步", "请帮我把", "这个函数"],
+        )
+
+    def test_short_chinese_phrase_is_kept_whole(self):
+        self.assertEqual(gui_automation._paste_tokens("修复"), ["修复"])
+
+    def test_mixed_prompt(self):
+        self.assertEqual(gui_automation._paste_tokens("优化 parser 性能"), ["parser", "优化", "性能"])
+
+    def test_short_ascii_falls_back_to_two_letters(self):
+        self.assertEqual(gui_automation._paste_tokens("ok"), ["ok"])
+
+
+class PasteLandedTest(unittest.TestCase):
+
+    def setUp(self):
+        self.ocr = mock.MagicMock(return_value="")
+        for patcher in (
+            mock.patch.object(gui_automation, "_input_box_region", return_value=REGION),
+            mock.patch.object(gui_automation, "ocr_region_text", self.ocr),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_chinese_prompt_with_spaced_ocr_output(self):
+        self.ocr.return_value = "请 帮 我 把 这 个 函 数\n改 成 异 步 的"
+        self.assertTrue(gui_automation._paste_landed("/tmp", "请帮我把这个函数改成异步的"))
+        self.ocr.assert_called_once_with(REGION, None)
+
+    def test_chinese_prompt_missing(self):
+        self.ocr.return_value = "在此输入消息"
+        self.assertFalse(gui_automation._paste_landed("/tmp", "请帮我把这个函数改成异步的"))
+
+    def test_input_box_not_found_is_unverified(self):
+        with mock.patch.object(gui_automation, "_input_box_region", return_value=None):
+            self.assertIsNone(gui_automation._paste_landed("/tmp", "请帮我把这个函数改成异步的"))
+        self.ocr.assert_not_called()
+
+    def test_ocr_unavailable_is_unverified(self):
+        self.ocr.return_value = None
+        self.assertIsNone(gui_automation._paste_landed("/tmp", "请帮我把这个函数改成异步的"))
+
+
+class VerifyPasteTest(unittest.TestCase):
+
+    def setUp(self):
+        patcher = mock.patch.dict(os.environ, {"VERIFY_PASTE": "1"})
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.statuses = []
+
+    def _verify(self):
+        return gui_automation._verify_paste("/tmp", "请帮我把这个函数改成异步的", self.statuses.append,
+                                            mock.MagicMock(), None, False)
+
+    def test_unverified_paste_cancels_submit(self):
+        with mock.patch.object(gui_automation, "_paste_landed", return_value=None):
+            self.assertFalse(self._verify())
+        self.assertIn("无法确认", self.statuses[-1])
+
+    def test_landed_paste_submits(self):
+        with mock.patch.object(gui_automation, "_paste_landed", return_value=True):
+            self.assertTrue(self._verify())
+        self.assertEqual(self.statuses, [])
+
+
+class OcrLanguageTest(unittest.TestCase):
+
+    def setUp(self):
+        self.calls = []
+        runner = mock.MagicMock(spec=gui_automation.CommandRunner)
+        runner.run.side_effect = lambda args, **kwargs: (
+            self.calls.append(list(args)) or subprocess.CompletedProcess(args, 0, stdout="文字", stderr="")
+        )
+        previous = gui_automation.set_command_runner(runner)
+        self.addCleanup(gui_automation.set_command_runner, previous)
+        patcher = mock.patch.object(gui_automation, "pyautogui", mock.MagicMock(name="pyautogui"))
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_default_language_includes_chinese(self):
+        env = {k: v for k, v in os.environ.items() if k != "TESSERACT_LANG"}
+        with mock.patch.dict(os.environ, env, clear=True):
+            self.assertEqual(gui_automation.ocr_region_text(REGION), "文字")
+        self.assertEqual(self.calls[0][-2:], ["-l", "chi_sim+eng"])
+
+    def test_language_is_configurable(self):
+        with mock.patch.dict(os.environ, {"TESSERACT_LANG": "jpn+eng"}):
+            gui_automation.ocr_region_text(REGION)
+        self.assertEqual(self.calls[0][-2:], ["-l", "jpn+eng"])
+
+
+if __name__ == "__main__":
+    unittest.main()
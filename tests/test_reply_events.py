@@ -0,0 +1,42 @@
+"""reply_event：回复送达时 set，工作流结束时未 set 的也会被移除。"""
+
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from mcp.server import MCPServer
+
+
+class ReplyEventTest(unittest.TestCase):
+
+    def setUp(self):
+        self.server = MCPServer(stdout_stream=mock.MagicMock())
+
+    def test_unsignalled_event_is_removed(self):
+        first = self.server.create_reply_event("1")
+        second = self.server.create_reply_event("1")
+
+        self.server.remove_reply_event("1", first)
+        self.assertEqual(self.server._reply_events, {"1": [second]})
+        self.server.remove_reply_event("1", second)
+        self.assertEqual(self.server._reply_events, {})
+
+    def test_removing_signalled_event_is_harmless(self):
+        event = self.server.create_reply_event("1")
+        self.server._signal_reply(["1"])
+        self.assertTrue(event.is_set())
+
+        self.server.remove_reply_event("1", event)
+        self.assertEqual(self.server._reply_events, {})
+
+    def test_other_chats_are_untouched(self):
+        mine = self.server.create_reply_event("1")
+        other = self.server.create_reply_event("2")
+
+        self.server.remove_reply_event("1", mine)
+        self.assertEqual(self.server._reply_events, {"2": [other]})
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,57 @@
+"""_split_text：长消息按段落/换行拆分，Markdown 模式下跨段的代码块会补全并重新打开。"""
+
+import unittest
+
+from tests.support import import_main
+
+main = import_main()
+split_text = main.AntigravityBridge._split_text
+
+
+class SplitTextTest(unittest.TestCase):
+
+    def test_short_text_is_single_chunk(self):
+        self.assertEqual(split_text("hello", max_len=100), ["hello"])
+
+    def test_prefers_paragraph_boundaries(self):
+        text = "a" * 60 + "\n\n" + "b" * 60
+        self.assertEqual(split_text(text, max_len=100), ["a" * 60, "b" * 60])
+
+    def test_hard_cut_without_newlines(self):
+        chunks = split_text("x" * 250, max_len=100)
+        self.assertEqual(chunks, ["x" * 100, "x" * 100, "x" * 50])
+
+    def test_fence_is_closed_and_reopened(self):
+        body = "\n".join(f"line {i:03d}" for i in range(30))
+        text = "intro\n```python\n" + body + "\n```\noutro"
+        chunks = split_text(text, max_len=150, keep_fences=True)
+
+        self.assertGreater(len(chunks), 1)
+        for chunk in chunks:
+            self.assertLessEqual(len(chunk), 150)
+            # 每段内的代码块标记成对出现，可单独渲染
+            self.assertEqual(chunk.count("```") % 2, 0, chunk)
+        for chunk in chunks[1:-1]:
+            self.assertTrue(chunk.startswith("```python\n"), chunk)
+        self.assertTrue(chunks[-1].endswith("outro"))
+        joined = "\n".join(chunks)
+        for i in range(30):
+            self.assertIn(f"line {i:03d}", joined)
+
+    def test_oversized_line_inside_fence(self):
+        text = "```\n" + "y" * 300 + "\n```"
+        chunks = split_text(text, max_len=100, keep_fences=True)
+
+        for chunk in chunks:
+            self.assertLessEqual(len(chunk), 100)
+            self.assertEqual(chunk.count("```") % 2, 0, chunk)
+        self.assertEqual(sum(chunk.count("y") for chunk in chunks), 300)
+
+    def test_fences_untouched_without_keep_fences(self):
+        text = "```\n" + "z" * 150 + "\n```"
+        chunks = split_text(text, max_len=100)
+        self.assertEqual(sum(chunk.count("```") for chunk in chunks), 2)
+
+
+if __name__ == "__main__":
+    unittest.main()
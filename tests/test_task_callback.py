@@ -0,0 +1,42 @@
+"""“取消”按钮：只能取消按钮所在 chat 自己的 GUI 工作流。"""
+
+import threading
+import unittest
+from types import SimpleNamespace
+from unittest import mock
+
+from tests.support import import_main
+
+main = import_main()
+
+
+class TaskCallbackTest(unittest.TestCase):
+
+    def setUp(self):
+        self.bridge = main.AntigravityBridge()
+        self.bridge._allow_all_chats = True
+        self.event = threading.Event()
+        self.bridge._gui_task_events["wf1"] = (100, self.event)
+
+    @staticmethod
+    def _update(chat_id, data="task:cancel:wf1"):
+        query = mock.MagicMock(data=data, message=SimpleNamespace(chat=SimpleNamespace(id=chat_id)))
+        return SimpleNamespace(callback_query=query), query
+
+    def test_owning_chat_can_cancel(self):
+        update, query = self._update(100)
+        self.bridge.handle_task_callback(update, None)
+
+        self.assertTrue(self.event.is_set())
+        query.answer.assert_called_once_with("🛑 正在取消...")
+
+    def test_other_chat_cannot_cancel(self):
+        update, query = self._update(200)
+        self.bridge.handle_task_callback(update, None)
+
+        self.assertFalse(self.event.is_set())
+        query.answer.assert_called_once_with("该任务已结束或已取消")
+
+
+if __name__ == "__main__":
+    unittest.main()
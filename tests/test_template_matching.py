@@ -0,0 +1,430 @@
+"""模板匹配（OpenCV）：用合成的屏幕和模板验证，不需要真实桌面。"""
+
+import os
+import shutil
+import tempfile
+import unittest
+from unittest import mock
+
+from tests.support import has_module
+
+from automation import gui_automation
+
+HAS_CV2 = has_module("cv2") and has_module("numpy")
+
+if HAS_CV2:
+    import cv2
+    import numpy as np
+
+
+@unittest.skipUnless(HAS_CV2, "需要 opencv-python 和 numpy")
+class _MatchingTestCase(unittest.TestCase):
+
+    def setUp(self):
+        self.tmpdir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.tmpdir)
+        env = {k: v for k, v in os.environ.items()
+               if k not in ("MATCH_MODE", "TEMPLATE_ALPHA_THRESHOLD", "MATCH_COARSE_STEP", "MATCH_JITTER",
+                            "WAYLAND_DISPLAY", "XDG_SESSION_TYPE")}
+        patcher = mock.patch.dict(os.environ, env, clear=True)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    @staticmethod
+    def noise(height, width, channels=3, seed=0):
+        return np.random.RandomState(seed).randint(0, 256, (height, width, channels)).astype(np.uint8)
+
+    def write_template(self, name, image):
+        """image 为 BGR / BGRA（cv2.imwrite 的通道顺序）。"""
+        path = os.path.join(self.tmpdir, name)
+        self.assertTrue(cv2.imwrite(path, np.ascontiguousarray(image)))
+        return path
+
+    def patch_screen(self, screen_bgr):
+        """pyautogui.screenshot() 返回 RGB 图像。"""
+        fake = mock.MagicMock(name="pyautogui")
+        fake.screenshot.return_value = np.ascontiguousarray(screen_bgr[:, :, ::-1])
+        patcher = mock.patch.object(gui_automation, "pyautogui", fake)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        return fake
+
+
+class CoarseLocateEdgeTest(_MatchingTestCase):
+    """模板紧贴截图右/下边缘时粗到精匹配仍能找到（精确匹配窗口裁剪到 sw/sh）。"""
+
+    SCREEN_H, SCREEN_W = 120, 200
+    TEMPLATE_H, TEMPLATE_W = 24, 40
+    STEP = 4
+
+    def setUp(self):
+        super().setUp()
+        self.screen = self.noise(self.SCREEN_H, self.SCREEN_W)
+        self.patch_screen(self.screen)
+
+    def _template_at(self, x, y):
+        return self.write_template(
+            "edge.png", self.screen[y:y + self.TEMPLATE_H, x:x + self.TEMPLATE_W]
+        )
+
+    def test_bottom_right_corner(self):
+        path = self._template_at(self.SCREEN_W - self.TEMPLATE_W, self.SCREEN_H - self.TEMPLATE_H)
+        location = gui_automation._coarse_locate(path, 0.9, None, self.STEP)
+        self.assertEqual(
+            location,
+            (self.SCREEN_W - self.TEMPLATE_W // 2, self.SCREEN_H - self.TEMPLATE_H // 2),
+        )
+
+    def test_right_edge_with_region_offset(self):
+        path = self._template_at(self.SCREEN_W - self.TEMPLATE_W, 40)
+        region = (1000, 500, self.SCREEN_W, self.SCREEN_H)
+        location = gui_automation._coarse_locate(path, 0.9, region, self.STEP)
+        self.assertEqual(
+            location,
+            (1000 + self.SCREEN_W - self.TEMPLATE_W // 2, 500 + 40 + self.TEMPLATE_H // 2),
+        )
+
+    def test_bottom_edge(self):
+        path = self._template_at(80, self.SCREEN_H - self.TEMPLATE_H)
+        location = gui_automation._coarse_locate(path, 0.9, None, self.STEP)
+        self.assertEqual(location, (80 + self.TEMPLATE_W // 2, self.SCREEN_H - self.TEMPLATE_H // 2))
+
+
+class NonContiguousWindowTest(_MatchingTestCase):
+    """整屏切片得到的窗口（非连续视图）与连续副本的匹配结果一致。"""
+
+    def setUp(self):
+        super().setUp()
+        self.screen = self.noise(90, 160, seed=1)
+        self.template = np.ascontiguousarray(self.screen[40:60, 70:100])
+        self.window = self.screen[30:75, 55:120]
+
+    def _assert_same_match(self, mask=None):
+        self.assertFalse(self.window.flags['C_CONTIGUOUS'])
+        contiguous = np.ascontiguousarray(self.window)
+        self.assertTrue(contiguous.flags['C_CONTIGUOUS'])
+
+        sliced_scores = gui_automation._match_template(self.window, self.template, mask)
+        contiguous_scores = gui_automation._match_template(contiguous, self.template, mask)
+
+        self.assertEqual(sliced_scores.shape, contiguous_scores.shape)
+        np.testing.assert_allclose(sliced_scores, contiguous_scores, atol=1e-5)
+        _, sliced_max, _, sliced_loc = cv2.minMaxLoc(sliced_scores)
+        _, contiguous_max, _, contiguous_loc = cv2.minMaxLoc(contiguous_scores)
+        self.assertEqual(sliced_loc, contiguous_loc)
+        self.assertEqual(contiguous_loc, (70 - 55, 40 - 30))
+        self.assertAlmostEqual(sliced_max, contiguous_max, places=5)
+
+    def test_plain_template(self):
+        self._assert_same_match()
+
+    def test_masked_template(self):
+        mask = np.zeros(self.template.shape, dtype=np.uint8)
+        mask[4:16, 5:25] = 255
+        self._assert_same_match(mask)
+
+
+class MaskedMatchTest(_MatchingTestCase):
+    """带透明边框的模板按掩码匹配，与屏幕上露出的背景无关。"""
+
+    def setUp(self):
+        super().setUp()
+        self.pattern = self.noise(12, 12, seed=2)
+        bgra = np.zeros((20, 20, 4), dtype=np.uint8)
+        bgra[4:16, 4:16, :3] = self.pattern
+        bgra[4:16, 4:16, 3] = 255
+        self.path = self.write_template("transparent.png", bgra)
+
+    def _screen_with_pattern(self, background):
+        screen = background.copy()
+        screen[25 + 4:25 + 16, 30 + 4:30 + 16] = self.pattern
+        return screen
+
+    def _assert_found(self, background):
+        template, mask = gui_automation._read_template(self.path, False)
+        self.assertIsNotNone(mask)
+        scores = gui_automation._match_template(self._screen_with_pattern(background), template, mask)
+        _, max_val, _, max_loc = cv2.minMaxLoc(scores)
+        self.assertEqual(max_loc, (30, 25))
+        self.assertGreater(max_val, 0.99)
+
+    def test_light_background(self):
+        self._assert_found(np.full((80, 100, 3), 200, dtype=np.uint8))
+
+    def test_dark_background(self):
+        self._assert_found(np.full((80, 100, 3), 30, dtype=np.uint8))
+
+    def test_noisy_background(self):
+        self._assert_found(self.noise(80, 100, seed=3))
+
+    def test_semi_transparent_edge_is_ignored(self):
+        # 不透明图案外围一圈半透明阴影：屏幕上阴影与背景混合后的颜色和模板里的不同
+        bgra = np.zeros((20, 20, 4), dtype=np.uint8)
+        bgra[2:18, 2:18, :3] = 40
+        bgra[2:18, 2:18, 3] = 128
+        bgra[4:16, 4:16, :3] = self.pattern
+        bgra[4:16, 4:16, 3] = 255
+        path = self.write_template("shadow.png", bgra)
+        screen = self._screen_with_pattern(np.full((80, 100, 3), 220, dtype=np.uint8))
+        screen[25 + 2:25 + 18, 30 + 2:30 + 4] = 130
+        screen[25 + 2:25 + 18, 30 + 16:30 + 18] = 130
+
+        template, mask = gui_automation._read_template(path, False)
+        self.assertIsNotNone(mask)
+        _, max_val, _, max_loc = cv2.minMaxLoc(gui_automation._match_template(screen, template, mask))
+        self.assertEqual(max_loc, (30, 25))
+        self.assertGreater(max_val, 0.99)
+
+    def test_flat_screen_scores_are_finite(self):
+        template, mask = gui_automation._read_template(self.path, False)
+        scores = gui_automation._match_template(np.full((80, 100, 3), 128, dtype=np.uint8), template, mask)
+        self.assertTrue(np.isfinite(scores).all())
+
+    def test_nan_and_inf_become_zero(self):
+        raw = np.array([[np.nan, np.inf], [-np.inf, 0.5]], dtype=np.float32)
+        template, mask = gui_automation._read_template(self.path, False)
+        with mock.patch.object(cv2, "matchTemplate", return_value=raw):
+            scores = gui_automation._match_template(np.zeros((21, 21, 3), dtype=np.uint8), template, mask)
+        np.testing.assert_array_equal(scores, np.array([[0.0, 0.0], [0.0, 0.5]], dtype=np.float32))
+
+
+class ClickInputBoxTest(_MatchingTestCase):
+    """四周带透明边距的 input_box.png 经掩码匹配找到，而不是交给会丢弃 alpha 的 pyautogui。"""
+
+    def setUp(self):
+        super().setUp()
+        self.pattern = self.noise(12, 12, seed=6)
+        bgra = np.dstack([self.noise(24, 24, seed=7), np.zeros((24, 24), dtype=np.uint8)])
+        bgra[6:18, 6:18, :3] = self.pattern
+        bgra[6:18, 6:18, 3] = 255
+        self.template_path = self.write_template("input_box.png", bgra)
+
+        screen = self.noise(120, 200, seed=8)
+        screen[50:62, 100:112] = self.pattern
+        fake = self.patch_screen(screen)
+        fake.locateCenterOnScreen.side_effect = AssertionError("alpha 被 pyautogui 丢弃")
+        self.click_at = mock.MagicMock()
+        for patcher in (
+            mock.patch.object(gui_automation, "activate_window", return_value=True),
+            mock.patch.object(gui_automation, "_capture_region", return_value=None),
+            mock.patch.object(gui_automation, "click_at", self.click_at),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_padded_transparent_template_is_found(self):
+        success, info = gui_automation.click_input_box(self.tmpdir)
+
+        self.assertTrue(success, info)
+        # 模板左上角在 (94, 44)，中心 (106, 56)
+        expected = gui_automation._click_point(self.template_path, (106, 56), None, default_offset=(-20, -10))
+        self.assertEqual(tuple(self.click_at.call_args[0][:2]), expected)
+
+
+class AlphaThresholdTest(_MatchingTestCase):
+    """TEMPLATE_ALPHA_THRESHOLD：低于阈值的半透明像素视为通配，阈值限制在 1..255。"""
+
+    def setUp(self):
+        super().setUp()
+        self.color = self.noise(20, 20, seed=4)
+        alpha = np.zeros((20, 20), dtype=np.uint8)
+        alpha[4:16, 4:16] = 128  # 半透明的柔和边缘
+        alpha[7:13, 7:13] = 255  # 完全不透明的中心
+        self.path = self.write_template("soft_edge.png", np.dstack([self.color, alpha]))
+
+    def _mask(self, threshold=None, grayscale=False, path=None):
+        env = {} if threshold is None else {"TEMPLATE_ALPHA_THRESHOLD": threshold}
+        with mock.patch.dict(os.environ, env):
+            template, mask = gui_automation._read_template(path or self.path, grayscale)
+        self.assertIsNotNone(template)
+        return mask
+
+    def test_default_only_fully_opaque_pixels_are_compared(self):
+        mask = self._mask()
+        self.assertEqual(mask.shape, (20, 20, 3))
+        self.assertEqual(mask[10, 10, 0], 255)
+        self.assertEqual(mask[5, 5, 0], 0)
+        self.assertEqual(mask[0, 0, 0], 0)
+
+    def test_partial_alpha_is_a_wildcard(self):
+        screen = self.noise(80, 100, seed=5)
+        screen[25 + 7:25 + 13, 30 + 7:30 + 13] = self.color[7:13, 7:13]
+        template, mask = gui_automation._read_template(self.path, False)
+        _, max_val, _, max_loc = cv2.minMaxLoc(gui_automation._match_template(screen, template, mask))
+        self.assertEqual(max_loc, (30, 25))
+        self.assertGreater(max_val, 0.99)
+
+    def test_lower_threshold_includes_soft_edge(self):
+        mask = self._mask("100")
+        self.assertEqual(mask[5, 5, 0], 255)
+        self.assertEqual(mask[10, 10, 0], 255)
+        self.assertEqual(mask[0, 0, 0], 0)
+
+    def test_threshold_is_clamped_to_1(self):
+        for value in ("0", "-5"):
+            mask = self._mask(value)
+            self.assertIsNotNone(mask, value)
+            self.assertEqual(mask[0, 0, 0], 0, value)
+            self.assertEqual(mask[5, 5, 0], 255, value)
+
+    def test_threshold_is_clamped_to_255(self):
+        np.testing.assert_array_equal(self._mask("1000"), self._mask())
+
+    def test_grayscale_mask_is_single_channel(self):
+        mask = self._mask(grayscale=True)
+        self.assertEqual(mask.shape, (20, 20))
+
+    def test_all_transparent_falls_back_to_unmasked(self):
+        bgra = np.dstack([self.color, np.zeros((20, 20), dtype=np.uint8)])
+        self.assertIsNone(self._mask(path=self.write_template("all_transparent.png", bgra)))
+
+    def test_no_pixel_reaching_threshold_falls_back_to_unmasked(self):
+        bgra = np.dstack([self.color, np.full((20, 20), 128, dtype=np.uint8)])
+        path = self.write_template("half_transparent.png", bgra)
+        self.assertIsNone(self._mask(path=path))
+
+    def test_fully_opaque_template_has_no_mask(self):
+        bgra = np.dstack([self.color, np.full((20, 20), 255, dtype=np.uint8)])
+        self.assertIsNone(self._mask(path=self.write_template("opaque.png", bgra)))
+
+
+class AlphaThresholdLocateTest(_MatchingTestCase):
+    """click_input_box 等调用方经 locate_center_on_screen 查找，同样遵守 TEMPLATE_ALPHA_THRESHOLD。"""
+
+    def setUp(self):
+        super().setUp()
+        self.color = self.noise(20, 20, seed=9)
+        alpha = np.full((20, 20), 128, dtype=np.uint8)
+        alpha[4:16, 4:16] = 255
+        self.path = self.write_template("soft_button.png", np.dstack([self.color, alpha]))
+        screen = self.noise(80, 100, seed=10)
+        screen[30 + 4:30 + 16, 40 + 4:40 + 16] = self.color[4:16, 4:16]
+        self.fake = self.patch_screen(screen)
+        self.fake.locateCenterOnScreen.return_value = None
+        for patcher in (
+            mock.patch.object(gui_automation, "_capture_region", return_value=None),
+            mock.patch.object(gui_automation, "_transparency_cache", {}),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_default_threshold_ignores_soft_edge(self):
+        self.assertEqual(gui_automation.locate_center_on_screen(self.path, 0.9), (50, 40))
+        self.fake.locateCenterOnScreen.assert_not_called()
+
+    def test_lowered_threshold_compares_soft_edge(self):
+        # 所有像素都达到阈值，与 _read_template 一样按整张图比较，屏幕上的边缘对不上
+        with mock.patch.dict(os.environ, {"TEMPLATE_ALPHA_THRESHOLD": "100"}):
+            self.assertIsNone(gui_automation.locate_center_on_screen(self.path, 0.9))
+        self.fake.locateCenterOnScreen.assert_called_once()
+
+
+class FindAllOnScreenTest(_MatchingTestCase):
+    """find_all_on_screen：同一个按钮附近的高分位置只报告一次，相邻按钮各报告一次，按 max_results 截断。"""
+
+    def setUp(self):
+        super().setUp()
+        screen = np.random.RandomState(11).randint(45, 56, (120, 200, 3)).astype(np.uint8)
+        # 平滑的圆形按钮：偏移一两个像素分数仍然很高，不抑制就会重复报告
+        cv2.circle(screen, (30, 40), 7, (200, 180, 160), -1)
+        button = screen[30:50, 20:40].copy()
+        screen[30:50, 40:60] = button  # 紧挨着的第二个按钮
+        screen[80:100, 120:140] = button
+        self.path = self.write_template("accept_button.png", button)
+        self.patch_screen(screen)
+        patcher = mock.patch.object(gui_automation, "_capture_region", return_value=None)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_adjacent_buttons_are_reported_once_each(self):
+        matches = gui_automation.find_all_on_screen(self.path, 0.8)
+
+        self.assertEqual(sorted(center for _, center in matches), [(30, 40), (50, 40), (130, 90)])
+        for score, _ in matches:
+            self.assertGreater(score, 0.99)
+
+    def test_max_results_caps_the_matches(self):
+        matches = gui_automation.find_all_on_screen(self.path, 0.8, max_results=2)
+
+        self.assertEqual(len(matches), 2)
+        (_, (x1, y1)), (_, (x2, y2)) = matches
+        self.assertTrue(abs(x1 - x2) >= 20 or abs(y1 - y2) >= 20)
+
+
+class TransparencyCacheTest(unittest.TestCase):
+    """_template_has_transparency 按文件缓存，模板被替换或阈值变化后重新读取。"""
+
+    def setUp(self):
+        self.tmpdir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.tmpdir)
+        self.path = os.path.join(self.tmpdir, "accept_button.png")
+        with open(self.path, "wb") as f:
+            f.write(b"v1")
+        for patcher in (
+            mock.patch.dict(os.environ, {"TEMPLATE_ALPHA_THRESHOLD": "255"}),
+            mock.patch.object(gui_automation, "_transparency_cache", {}),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        self.read = mock.MagicMock(return_value=(object(), object()))
+        patcher = mock.patch.object(gui_automation, "_read_template", self.read)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_repeated_checks_read_once(self):
+        for _ in range(3):
+            self.assertTrue(gui_automation._template_has_transparency(self.path))
+        self.assertEqual(self.read.call_count, 1)
+
+    def test_replaced_template_is_read_again(self):
+        gui_automation._template_has_transparency(self.path)
+        with open(self.path, "wb") as f:
+            f.write(b"version 2")
+        self.read.return_value = (object(), None)
+        self.assertFalse(gui_automation._template_has_transparency(self.path))
+        self.assertEqual(self.read.call_count, 2)
+
+    def test_threshold_change_is_read_again(self):
+        gui_automation._template_has_transparency(self.path)
+        with mock.patch.dict(os.environ, {"TEMPLATE_ALPHA_THRESHOLD": "100"}):
+            gui_automation._template_has_transparency(self.path)
+        self.assertEqual(self.read.call_count, 2)
+
+    def test_missing_template_is_not_transparent(self):
+        self.assertFalse(gui_automation._template_has_transparency(os.path.join(self.tmpdir, "missing.png")))
+        self.read.assert_not_called()
+
+
+
+class FindAndClickDiagnosticsTest(unittest.TestCase):
+    """find_and_click 未找到时，只有 MATCH_DIAGNOSTICS=1 才额外计算最佳候选。"""
+
+    def setUp(self):
+        self.best = mock.MagicMock(return_value=(0.72, (40, 50)))
+        env = {k: v for k, v in os.environ.items() if k not in ("MATCH_DIAGNOSTICS", "DRY_RUN")}
+        for patcher in (
+            mock.patch.dict(os.environ, env, clear=True),
+            mock.patch.object(gui_automation, "find_image", return_value=None),
+            mock.patch.object(gui_automation, "_ocr_fallback_click", return_value=None),
+            mock.patch.object(gui_automation, "best_match_on_screen", self.best),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_no_best_match_by_default(self):
+        success, message = gui_automation.find_and_click("/tmp/retry.png", confidence=0.8)
+
+        self.assertFalse(success)
+        self.assertNotIn("Best match", message)
+        self.best.assert_not_called()
+
+    def test_best_match_with_diagnostics(self):
+        with mock.patch.dict(os.environ, {"MATCH_DIAGNOSTICS": "1"}):
+            success, message = gui_automation.find_and_click("/tmp/retry.png", confidence=0.8)
+
+        self.assertFalse(success)
+        self.assertIn("Best match 72/100 @ (40, 50), threshold 80.", message)
+
+
+if __name__ == "__main__":
+    unittest.main()
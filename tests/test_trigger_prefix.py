@@ -0,0 +1,58 @@
+"""TRIGGER_PREFIX：群聊只接受带前缀的消息，返回去掉前缀后的文字，不改动原消息。"""
+
+import os
+import unittest
+from types import SimpleNamespace
+from unittest import mock
+
+from tests.support import import_main
+
+main = import_main()
+
+
+class TriggerPrefixTest(unittest.TestCase):
+
+    def setUp(self):
+        self.bridge = main.AntigravityBridge()
+        self.bridge.bot = SimpleNamespace(username="AgBot")
+        patcher = mock.patch.dict(os.environ, {"TRIGGER_PREFIX": "!ai"})
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    @staticmethod
+    def _message(text=None, caption=None, chat_type="group"):
+        return SimpleNamespace(text=text, caption=caption, chat_id=-100, chat=SimpleNamespace(type=chat_type))
+
+    def test_prefix_is_stripped_without_mutating_message(self):
+        message = self._message(text="!ai: 写个测试")
+        self.assertEqual(self.bridge._accept_trigger(message), (True, "写个测试"))
+        self.assertEqual(message.text, "!ai: 写个测试")
+
+    def test_caption_and_bot_mention(self):
+        message = self._message(caption="@agbot 看看这张图")
+        self.assertEqual(self.bridge._accept_trigger(message), (True, "看看这张图"))
+        self.assertEqual(message.caption, "@agbot 看看这张图")
+
+    def test_prefix_requires_word_boundary(self):
+        for text in ("!aiko 在吗", "!ai_bot 你好", "@agbotfan 你好"):
+            with self.subTest(text=text):
+                self.assertEqual(self.bridge._accept_trigger(self._message(text=text)), (False, None))
+
+    def test_prefix_alone_or_before_punctuation(self):
+        self.assertEqual(self.bridge._accept_trigger(self._message(text="!ai")), (True, ""))
+        self.assertEqual(self.bridge._accept_trigger(self._message(text="!ai，帮我看看")), (True, "帮我看看"))
+
+    def test_group_chatter_is_ignored(self):
+        self.assertEqual(self.bridge._accept_trigger(self._message(text="大家好")), (False, None))
+
+    def test_private_chat_without_prefix_is_unchanged(self):
+        message = self._message(text="你好", chat_type="private")
+        self.assertEqual(self.bridge._accept_trigger(message), (True, None))
+
+    def test_unset_prefix_accepts_everything(self):
+        with mock.patch.dict(os.environ, {"TRIGGER_PREFIX": ""}):
+            self.assertEqual(self.bridge._accept_trigger(self._message(text="大家好")), (True, None))
+
+
+if __name__ == "__main__":
+    unittest.main()
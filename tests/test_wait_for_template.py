@@ -0,0 +1,76 @@
+"""wait_for_template：找到即返回、超时返回 (False, None)、截屏出错按 max_capture_errors 处理。"""
+
+import os
+import shutil
+import tempfile
+import threading
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+
+class WaitForTemplateTest(unittest.TestCase):
+
+    def setUp(self):
+        self.templates_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.templates_dir)
+        for name in ("input_box.png", "Replying.png", "Generating.png"):
+            open(os.path.join(self.templates_dir, name), "wb").close()
+        self.locate = mock.MagicMock(return_value=None)
+        for patcher in (
+            mock.patch.object(gui_automation, "pyautogui", mock.MagicMock(name="pyautogui")),
+            mock.patch.object(gui_automation, "locate_center_on_screen", self.locate),
+            mock.patch.object(gui_automation.time, "sleep"),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def _wait(self, template="Replying.png", timeout=60, **kwargs):
+        return gui_automation.wait_for_template(self.templates_dir, template, timeout, **kwargs)
+
+    def test_found_after_polling(self):
+        self.locate.side_effect = [None, None, (10, 20)]
+
+        self.assertEqual(self._wait(), (True, (10, 20)))
+        self.assertEqual(self.locate.call_count, 3)
+
+    def test_any_of_several_templates(self):
+        self.locate.side_effect = lambda path, confidence, region: (1, 2) if path.endswith("Generating.png") else None
+
+        self.assertEqual(self._wait(["Replying.png", "Generating.png"]), (True, (1, 2)))
+
+    def test_timeout(self):
+        self.assertEqual(self._wait(timeout=0), (False, None))
+        self.assertEqual(self.locate.call_count, 1)
+
+    def test_stop_event(self):
+        stop_event = threading.Event()
+        stop_event.set()
+
+        self.assertEqual(self._wait(stop_event=stop_event), (False, None))
+        self.locate.assert_not_called()
+
+    def test_capture_errors_are_ignored_by_default(self):
+        self.locate.side_effect = [RuntimeError("cannot open display")] * 5 + [(3, 4)]
+
+        self.assertEqual(self._wait(), (True, (3, 4)))
+
+    def test_consecutive_capture_errors_raise(self):
+        self.locate.side_effect = RuntimeError("cannot open display")
+
+        with self.assertRaises(RuntimeError):
+            self._wait(max_capture_errors=3)
+        self.assertEqual(self.locate.call_count, 3)
+
+    def test_successful_capture_resets_error_count(self):
+        error = RuntimeError("cannot open display")
+        self.locate.side_effect = [error, error, None, error, error, (5, 6)]
+
+        self.assertEqual(self._wait(max_capture_errors=3), (True, (5, 6)))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,76 @@
+"""Wayland 会话：模板匹配等截屏改用 grim（_capture_screen），不走只支持 X11 的 pyautogui 截屏。"""
+
+import os
+import subprocess
+import unittest
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+
+class _Runner(gui_automation.CommandRunner):
+
+    def __init__(self):
+        self.calls = []
+
+    def run(self, args, **kwargs):
+        self.calls.append(list(args))
+        return subprocess.CompletedProcess(args, 0, stdout="", stderr="")
+
+
+class WaylandCaptureTest(unittest.TestCase):
+
+    def setUp(self):
+        self.runner = _Runner()
+        previous = gui_automation.set_command_runner(self.runner)
+        self.addCleanup(gui_automation.set_command_runner, previous)
+
+        self.fake_pyautogui = mock.MagicMock(name="pyautogui")
+        self.fake_pyautogui.screenshot.side_effect = AssertionError("pyautogui 截屏只支持 X11")
+        self.fake_pyautogui.locateCenterOnScreen.side_effect = AssertionError("pyautogui 截屏只支持 X11")
+        self.image = mock.MagicMock(name="image")
+        opened = mock.MagicMock(name="opened")
+        opened.__enter__.return_value.convert.return_value = self.image
+
+        env = {k: v for k, v in os.environ.items()
+               if k not in ("SCREENSHOT_CMD", "XDG_SESSION_TYPE", "MATCH_COARSE_STEP", "MATCH_JITTER")}
+        env["WAYLAND_DISPLAY"] = "wayland-0"
+        for patcher in (
+            mock.patch.dict(os.environ, env, clear=True),
+            mock.patch.object(gui_automation, "pyautogui", self.fake_pyautogui),
+            mock.patch.object(gui_automation.Image, "open", return_value=opened),
+            mock.patch.object(gui_automation, "_capture_region", return_value=None),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_grab_screen_uses_grim(self):
+        self.assertIs(gui_automation._grab_screen((10, 20, 300, 200)), self.image)
+        self.assertEqual(len(self.runner.calls), 1)
+        command = self.runner.calls[0]
+        self.assertEqual(command[:3], ['grim', '-g', '10,20 300x200'])
+        self.assertFalse(os.path.exists(command[-1]))
+
+    def test_grab_screen_raises_when_capture_fails(self):
+        with mock.patch.object(gui_automation, "_capture_screen", return_value=(False, "no compositor")):
+            with self.assertRaises(RuntimeError):
+                gui_automation._grab_screen()
+
+    def test_locate_uses_opencv_matching(self):
+        with mock.patch.object(gui_automation, "_best_match", return_value=(0.95, (40, 50))) as best, \
+                mock.patch.object(gui_automation, "_template_has_transparency", return_value=False):
+            self.assertEqual(gui_automation.locate_center_on_screen("/tmp/input_box.png", 0.8), (40, 50))
+        best.assert_called_once_with("/tmp/input_box.png", None)
+
+    def test_x11_still_uses_pyautogui(self):
+        self.fake_pyautogui.screenshot.side_effect = None
+        with mock.patch.dict(os.environ, {"WAYLAND_DISPLAY": ""}):
+            gui_automation._grab_screen((1, 2, 3, 4))
+        self.fake_pyautogui.screenshot.assert_called_once_with(region=(1, 2, 3, 4))
+        self.assertEqual(self.runner.calls, [])
+
+
+if __name__ == "__main__":
+    unittest.main()
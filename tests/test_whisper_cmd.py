@@ -0,0 +1,37 @@
+"""WHISPER_CMD：写错的命令作为失败原因返回，而不是抛出异常。"""
+
+import os
+import unittest
+from unittest import mock
+
+from tests.support import import_main
+
+main = import_main()
+
+
+class WhisperCmdTest(unittest.TestCase):
+
+    def setUp(self):
+        self.bridge = main.AntigravityBridge()
+        self.bridge.bot = mock.MagicMock()
+
+    def test_unbalanced_quotes_are_reported(self):
+        with mock.patch.dict(os.environ, {"WHISPER_CMD": "whisper --model 'base"}):
+            transcript, problem = self.bridge._transcribe_voice("file-id", 1, "wf", 0)
+
+        self.assertEqual(transcript, "")
+        self.assertIn("WHISPER_CMD", problem)
+        self.bridge.bot.get_file.assert_not_called()
+
+    def test_file_placeholder_is_substituted(self):
+        completed = mock.MagicMock(returncode=0, stdout=" 你好 \n", stderr="")
+        with mock.patch.dict(os.environ, {"WHISPER_CMD": "whisper {file} --lang zh"}), \
+                mock.patch.object(main.subprocess, "run", return_value=completed) as run:
+            transcript, problem = self.bridge._transcribe_voice("file-id", 1, "wf", 0)
+
+        self.assertEqual((transcript, problem), ("你好", ""))
+        self.assertEqual(run.call_args[0][0], ["whisper", "/tmp/tg_batch_1_wf_0.oga", "--lang", "zh"])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,83 @@
+"""WorkflowQueue：并发提交的 GUI 工作流按 FIFO 逐个执行，并报告排队位置。"""
+
+import threading
+import time
+import unittest
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation.gui_automation import WorkflowQueue
+
+
+class WorkflowQueueTest(unittest.TestCase):
+
+    def setUp(self):
+        self.queue = WorkflowQueue()
+
+    def test_runs_one_at_a_time_in_submission_order(self):
+        release = threading.Event()
+        lock = threading.Lock()
+        running = []
+        max_running = []
+        order = []
+
+        def job(name):
+            with lock:
+                running.append(name)
+                max_running.append(len(running))
+            if name == 0:
+                release.wait(5)
+            time.sleep(0.01)
+            with lock:
+                running.remove(name)
+                order.append(name)
+            return name * 10
+
+        submitted = [self.queue.submit(job, i) for i in range(4)]
+        self.assertEqual([ahead for _, ahead in submitted], [0, 1, 2, 3])
+        self.assertEqual(self.queue.pending(), 4)
+
+        release.set()
+        results = [future.result(timeout=5) for future, _ in submitted]
+
+        self.assertEqual(results, [0, 10, 20, 30])
+        self.assertEqual(order, [0, 1, 2, 3])
+        self.assertEqual(max(max_running), 1)
+        self.assertEqual(self.queue.pending(), 0)
+
+    def test_concurrent_submitters_get_distinct_positions(self):
+        release = threading.Event()
+        blocker, _ = self.queue.submit(release.wait, 5)
+        positions = []
+        lock = threading.Lock()
+
+        def submit():
+            _, ahead = self.queue.submit(lambda: None)
+            with lock:
+                positions.append(ahead)
+
+        threads = [threading.Thread(target=submit) for _ in range(5)]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join(5)
+        release.set()
+        blocker.result(timeout=5)
+
+        self.assertEqual(sorted(positions), [1, 2, 3, 4, 5])
+
+    def test_exception_is_reported_and_queue_keeps_running(self):
+        def boom():
+            raise RuntimeError("boom")
+
+        failed, _ = self.queue.submit(boom)
+        ok, ahead = self.queue.submit(lambda: "ok")
+
+        with self.assertRaises(RuntimeError):
+            failed.result(timeout=5)
+        self.assertEqual(ok.result(timeout=5), "ok")
+        self.assertEqual(self.queue.pending(), 0)
+
+
+if __name__ == "__main__":
+    unittest.main()
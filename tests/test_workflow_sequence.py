@@ -0,0 +1,173 @@
+"""full_workflow 的外部命令顺序：复制到剪贴板 -> 点击输入框 -> 粘贴 -> 提交。"""
+
+import os
+import shutil
+import subprocess
+import tempfile
+import unittest
+from types import SimpleNamespace
+from unittest import mock
+
+from tests import support  # noqa: F401  注入占位模块
+
+from automation import gui_automation
+
+
+class _FakeProcess:
+    returncode = 0
+
+    def __init__(self, runner, args):
+        self._runner = runner
+        self._args = args
+
+    def communicate(self, input=None, timeout=None):
+        if input is not None and self._args[0] == 'xclip':
+            self._runner.clipboard = input
+        return "", ""
+
+    def wait(self, timeout=None):
+        return 0
+
+    def terminate(self):
+        pass
+
+
+class _RecordingRunner(gui_automation.CommandRunner):
+    """记录所有外部命令，不触碰真实桌面。"""
+
+    WINDOW_ID = "42"
+
+    def __init__(self):
+        self.calls = []
+        self.clipboard = ""
+
+    def run(self, args, **kwargs):
+        self.calls.append(list(args))
+        stdout = ""
+        if args[:2] == ['xdotool', 'search'] or args[:2] == ['xdotool', 'getactivewindow']:
+            stdout = self.WINDOW_ID
+        elif args[0] == 'xclip' and '-o' in args:
+            stdout = self.clipboard
+        return subprocess.CompletedProcess(args, 0, stdout=stdout, stderr="")
+
+    def popen(self, args, **kwargs):
+        self.calls.append(list(args))
+        return _FakeProcess(self, args)
+
+
+class _SequenceTestCase(unittest.TestCase):
+    """用 _RecordingRunner 和假 pyautogui 驱动工作流，记录外部命令。"""
+
+    def setUp(self):
+        self.runner = _RecordingRunner()
+        previous = gui_automation.set_command_runner(self.runner)
+        self.addCleanup(gui_automation.set_command_runner, previous)
+
+        self.templates_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.templates_dir)
+        open(os.path.join(self.templates_dir, "input_box.png"), "wb").close()
+
+        fake_pyautogui = mock.MagicMock(name="pyautogui")
+        fake_pyautogui.ImageNotFoundException = type("ImageNotFoundException", (Exception,), {})
+        fake_pyautogui.locateCenterOnScreen.return_value = SimpleNamespace(x=300, y=400)
+        fake_pyperclip = mock.MagicMock(name="pyperclip")
+        fake_pyperclip.copy.side_effect = RuntimeError("no clipboard backend")
+
+        env = {k: v for k, v in os.environ.items()
+               if k not in ("WAYLAND_DISPLAY", "XDG_SESSION_TYPE", "DRY_RUN",
+                            "VERIFY_PASTE", "VERIFY_SUBMIT", "INPUT_READY_TIMEOUT")}
+        for patcher in (
+            mock.patch.dict(os.environ, env, clear=True),
+            mock.patch.object(gui_automation, "pyautogui", fake_pyautogui),
+            mock.patch.object(gui_automation, "pyperclip", fake_pyperclip),
+            mock.patch.object(gui_automation, "_capture_region", return_value=None),
+            mock.patch.object(gui_automation.Image, "open", side_effect=OSError("placeholder template")),
+            mock.patch.object(gui_automation, "monitor_process"),
+            mock.patch.object(gui_automation.time, "sleep"),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        self.fake_pyautogui = fake_pyautogui
+
+    def _actions(self):
+        """把记录的命令归纳为动作序列，忽略窗口查找和剪贴板回读。"""
+        actions = []
+        for args in self.runner.calls:
+            if args[0] == 'xclip' and '-o' not in args:
+                actions.append("clipboard")
+            elif args[:2] == ['xdotool', 'click']:
+                actions.append("click")
+            elif args[:2] == ['xdotool', 'key']:
+                actions.append("key " + args[2])
+        return actions
+
+
+class FullWorkflowSequenceTest(_SequenceTestCase):
+
+    def test_clipboard_click_paste_submit_in_order(self):
+        result = gui_automation.full_workflow("hello", self.templates_dir, lambda msg: None,
+                                              window_title="antigravity")
+
+        self.assertTrue(result.success)
+        self.assertEqual(self._actions(), ["clipboard", "click", "key ctrl+v", "key Return"])
+        self.assertEqual(self.runner.clipboard, "hello")
+        self.assertIn(['xdotool', 'mousemove', '280', '390'], self.runner.calls)
+        self.fake_pyautogui.hotkey.assert_not_called()
+        self.fake_pyautogui.press.assert_not_called()
+
+    def test_key_press_falls_back_to_pyautogui(self):
+        def failing_run(args, **kwargs):
+            raise FileNotFoundError("xdotool")
+
+        with mock.patch.object(self.runner, "run", side_effect=failing_run):
+            gui_automation.press_keys('ctrl', 'v')
+            gui_automation.press_keys('return')
+
+        self.fake_pyautogui.hotkey.assert_called_once_with('ctrl', 'v')
+        self.fake_pyautogui.press.assert_called_once_with('return')
+
+
+
+class MediaGroupSequenceTest(_SequenceTestCase):
+    """full_workflow_media_group 按 Telegram 中的顺序交错粘贴文字和图片。"""
+
+    def setUp(self):
+        super().setUp()
+        self.image_path = os.path.join(self.templates_dir, "photo.png")
+        open(self.image_path, "wb").close()
+        run = self.runner.run
+
+        def run_with_targets(args, **kwargs):
+            if 'TARGETS' in args:
+                self.runner.calls.append(list(args))
+                return subprocess.CompletedProcess(args, 0, stdout="TARGETS\nimage/png", stderr="")
+            return run(args, **kwargs)
+
+        for patcher in (
+            mock.patch.object(self.runner, "run", side_effect=run_with_targets),
+            mock.patch.object(gui_automation.shutil, "which", side_effect=lambda name: f"/usr/bin/{name}"),
+        ):
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_text_image_text_pasted_in_order(self):
+        items = [("text", "看这张图"), ("image", self.image_path), ("text", "有什么问题？")]
+        result = gui_automation.full_workflow_media_group([], "", self.templates_dir, lambda msg: None,
+                                                          window_title="antigravity", items=items)
+
+        self.assertTrue(result.success)
+        self.assertEqual(self._actions(), [
+            "clipboard", "click", "key ctrl+v",
+            "clipboard", "click", "key ctrl+v",
+            "clipboard", "click", "key ctrl+v",
+            "key Return",
+        ])
+        clipboard_calls = [args for args in self.runner.calls if args[0] == 'xclip' and '-o' not in args]
+        self.assertEqual(clipboard_calls[0], ['xclip', '-selection', 'clipboard'])
+        self.assertIn(os.path.abspath(self.image_path), clipboard_calls[1])
+        self.assertEqual(clipboard_calls[2], ['xclip', '-selection', 'clipboard'])
+        self.assertEqual(self.runner.clipboard, "有什么问题？")
+
+
+if __name__ == "__main__":
+    unittest.main()